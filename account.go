@@ -0,0 +1,260 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/yzzyx/nm-imap-sync/config"
+	"github.com/yzzyx/nm-imap-sync/imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// Exit codes
+const (
+	exitOK             = 0 // Everything was synchronized
+	exitConfigError    = 1 // Configuration or startup error, or an account error that retrying won't fix, see needsAttention
+	exitAccountsFailed = 2 // One or more accounts could not be synchronized
+	exitPartial        = 3 // All accounts were synchronized, but some messages were skipped
+	exitInterrupted    = 4 // Interrupted by a signal
+)
+
+// exitStatus describes each exit code in the summary
+var exitStatus = map[int]string{
+	exitOK:             "ok",
+	exitConfigError:    "configuration error",
+	exitAccountsFailed: "failed",
+	exitPartial:        "partially synchronized",
+	exitInterrupted:    "interrupted",
+}
+
+// errNotSynchronized is the result of accounts that were not reached,
+// since the run was stopped early
+var errNotSynchronized = errors.New("not synchronized, the run was stopped early")
+
+// runOptions contains the command line settings that affect how accounts are synchronized
+type runOptions struct {
+	fullScan bool
+	failFast bool
+	renames  map[string]string // Folders renamed on the server, from old to new name
+
+	// heartbeat is called whenever progress is made, see watchdog
+	heartbeat func()
+
+	// pushOnly skips checking the server for changes, and folders limits the local scan
+	// to the listed folders, if set. Folders are local paths relative to the account maildir.
+	pushOnly bool
+	folders  []string
+}
+
+// accountResult is the outcome of synchronizing a single account
+type accountResult struct {
+	Name    string
+	Err     error
+	Skipped int // Number of messages that could not be updated
+	Stats   imap.Stats
+}
+
+// syncAccount pushes local changes for an account to the server,
+// and then fetches new messages and flags from the server, unless opts.pushOnly is set
+func syncAccount(ctx context.Context, syncdb *sync.DB, name string, mailbox config.Mailbox, folderPath string, opts runOptions) (result accountResult) {
+	result.Name = name
+
+	// Make sure that the local scan is stopped if we bail out early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The last seen UIDs were previously stored in the maildir
+	err := migrateLegacyFile(filepath.Join(folderPath, ".imap-uids"), filepath.Join(mailbox.StateDir, "imap-uids"))
+	if err != nil {
+		result.Err = fmt.Errorf("cannot migrate state: %w", err)
+		return result
+	}
+
+	err = os.MkdirAll(folderPath, 0700)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	h, err := imap.New(folderPath, mailbox)
+	if err != nil {
+		result.Err = fmt.Errorf("cannot initalize new imap connection: %w", err)
+		return result
+	}
+
+	if opts.heartbeat != nil {
+		h.SetHeartbeat(opts.heartbeat)
+	}
+
+	// Always save our state, since parts of the account may have been synchronized
+	defer func() {
+		result.Stats = h.Stats()
+		err := h.Close()
+		if err != nil && result.Err == nil {
+			result.Err = fmt.Errorf("cannot close imap handler: %w", err)
+		}
+	}()
+
+	// Let the local scan finish before pushing anything, so that we know how much work there is
+	imapQueue := make(chan sync.Update, 10000)
+	checkErr := make(chan error, 1)
+	go func() {
+		defer close(imapQueue)
+		if opts.folders == nil {
+			checkErr <- syncdb.CheckFolders(ctx, mailbox, folderPath, imapQueue)
+			return
+		}
+		for _, folder := range opts.folders {
+			if err := syncdb.CheckFolder(ctx, mailbox, folderPath, folder, imapQueue); err != nil {
+				checkErr <- err
+				return
+			}
+		}
+		checkErr <- nil
+	}()
+
+	var updates []sync.Update
+	for msgUpdate := range imapQueue {
+		updates = append(updates, msgUpdate)
+		if opts.heartbeat != nil {
+			opts.heartbeat()
+		}
+	}
+
+	err = <-checkErr
+	if err != nil {
+		result.Err = fmt.Errorf("cannot check folders for new tags: %w", err)
+		return result
+	}
+
+	if mailbox.PushExcludeQuery != "" {
+		count, err := syncdb.CountPushExcluded(ctx)
+		if err != nil {
+			log.Printf("%s: cannot count excluded messages: %v\n", name, err)
+		} else if count > 0 {
+			fmt.Printf("%s: %d messages with local changes match push_exclude_query, and are not pushed\n", name, count)
+		}
+	}
+
+	// Folders are scanned concurrently, so the updates are put in folder order.
+	// The order within each folder is kept.
+	sort.SliceStable(updates, func(i, j int) bool {
+		return filepath.Dir(updates[i].Filename) < filepath.Dir(updates[j].Filename)
+	})
+
+	// Once the server is out of space, there's no point in trying to upload more messages
+	quotaExceeded := false
+
+	progress := progressbar.NewOptions(len(updates), progressbar.OptionSetDescription("updating server flags"))
+	for _, msgUpdate := range updates {
+		progress.Add(1)
+		if quotaExceeded && msgUpdate.Created {
+			result.Skipped++
+			continue
+		}
+		err = h.Update(ctx, syncdb, msgUpdate)
+		if err != nil {
+			if opts.failFast || ctx.Err() != nil {
+				result.Err = fmt.Errorf("cannot update message on server: %w", err)
+				return result
+			}
+			log.Printf("%s: skipping message %s: %v\n", name, msgUpdate.MessageID, err)
+			result.Skipped++
+			if errors.Is(err, imap.ErrQuotaExceeded) {
+				log.Printf("%s: not uploading any more new messages during this run\n", name)
+				quotaExceeded = true
+			}
+		}
+	}
+	progress.Finish()
+
+	if opts.pushOnly {
+		return result
+	}
+
+	err = h.CheckMessages(ctx, syncdb, opts.fullScan, opts.renames)
+	if err != nil {
+		result.Err = fmt.Errorf("cannot check for new messages on server: %w", err)
+		return result
+	}
+	return result
+}
+
+// needsAttention returns true if err won't go away by retrying later,
+// such as rejected credentials or a damaged sync database
+func needsAttention(err error) bool {
+	return errors.Is(err, imap.ErrAuthentication) || errors.Is(err, sync.ErrCorrupt)
+}
+
+// summarize prints a summary of all results, and returns the corresponding exit code.
+// Messages that were skipped outside of any account are counted in 'skipped'.
+func summarize(ctx context.Context, results []accountResult, skipped int) int {
+	failed := 0
+	locked := 0
+	attention := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			log.Printf("%s: %v\n", r.Name, r.Err)
+			if needsAttention(r.Err) {
+				attention++
+			}
+		}
+		skipped += r.Skipped
+		locked += len(r.Stats.Locked)
+		if len(r.Stats.Locked) > 0 {
+			fmt.Printf("%s: the notmuch database was locked, these folders were not fully synchronized: %s\n",
+				r.Name, strings.Join(r.Stats.Locked, ", "))
+		}
+
+		recovered := make(map[string]bool, len(r.Stats.Recovered))
+		for _, folder := range r.Stats.Recovered {
+			recovered[folder] = true
+		}
+		for _, folder := range r.Stats.Anomalies {
+			if recovered[folder] {
+				fmt.Printf("%s: UIDs in %s had been reset on the server, the folder was checked again completely\n", r.Name, folder)
+			} else {
+				fmt.Printf("%s: UIDs in %s had been reset on the server, the folder will be checked again during the next run\n", r.Name, folder)
+			}
+		}
+
+		if len(r.Stats.Rejected) > 0 {
+			fmt.Printf("%s: the server refuses to store these keywords, run with --retry-rejected to try again: %s\n",
+				r.Name, strings.Join(r.Stats.Rejected, ", "))
+		}
+
+		for _, folder := range r.Stats.Backfilled {
+			fmt.Printf("%s: all older messages in %s have been fetched\n", r.Name, folder)
+		}
+		if len(r.Stats.Backfilling) > 0 {
+			fmt.Printf("%s: older messages remain to be fetched in %s\n", r.Name, strings.Join(r.Stats.Backfilling, ", "))
+		}
+	}
+
+	code := exitOK
+	switch {
+	case ctx.Err() != nil:
+		code = exitInterrupted
+	case attention > 0:
+		code = exitConfigError
+	case failed > 0:
+		code = exitAccountsFailed
+	case skipped > 0 || locked > 0:
+		code = exitPartial
+	}
+
+	fmt.Printf("synchronized %d of %d accounts, %d messages skipped: %s (exit code %d)\n",
+		len(results)-failed, len(results), skipped, exitStatus[code], code)
+	return code
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/yzzyx/nm-imap-sync/imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+func TestSummarize(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	authErr := fmt.Errorf("cannot initalize new imap connection: %w", &imap.Error{Class: imap.ErrAuthentication, Err: errors.New("invalid credentials")})
+	corruptErr := fmt.Errorf("cannot open sync database: %w", sync.ErrCorrupt)
+	unreachableErr := &imap.Error{Class: imap.ErrUnreachable, Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		results []accountResult
+		skipped int
+		want    int
+	}{
+		{
+			name:    "ok",
+			results: []accountResult{{Name: "a"}, {Name: "b"}},
+			want:    exitOK,
+		},
+		{
+			name:    "skipped messages",
+			results: []accountResult{{Name: "a", Skipped: 1}},
+			want:    exitPartial,
+		},
+		{
+			name:    "skipped outside of accounts",
+			results: []accountResult{{Name: "a"}},
+			skipped: 1,
+			want:    exitPartial,
+		},
+		{
+			name:    "unreachable",
+			results: []accountResult{{Name: "a", Err: unreachableErr}, {Name: "b"}},
+			want:    exitAccountsFailed,
+		},
+		{
+			name:    "authentication failed",
+			results: []accountResult{{Name: "a", Err: authErr}, {Name: "b"}},
+			want:    exitConfigError,
+		},
+		{
+			name:    "corrupt sync database",
+			results: []accountResult{{Name: "a", Err: unreachableErr}, {Name: "b", Err: corruptErr}},
+			want:    exitConfigError,
+		},
+		{
+			name:    "interrupted",
+			ctx:     cancelled,
+			results: []accountResult{{Name: "a", Err: authErr}, {Name: "b", Err: errNotSynchronized}},
+			want:    exitInterrupted,
+		},
+	}
+
+	for _, tt := range tests {
+		ctx := tt.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if got := summarize(ctx, tt.results, tt.skipped); got != tt.want {
+			t.Errorf("%s: summarize() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -3,8 +3,30 @@
 // See COPYING at the root of the repository for details.
 package config
 
+import "time"
+
 // Config describes the available configuration layout
 type Config struct {
 	Maildir   string
+	StateDir  string `yaml:"state_dir"` // Defaults to $XDG_STATE_HOME/nm-imap-sync
 	Mailboxes map[string]Mailbox
+
+	// SyncDBPath is the location of the sync database, which defaults to nmsyncdb in StateDir.
+	// The database contains no paths, so it can be moved to another location
+	// as long as this setting is updated to match.
+	SyncDBPath string `yaml:"syncdb_path"`
+
+	// MetricsFile is where Prometheus metrics are written after each run, if set
+	MetricsFile string `yaml:"metrics_file"`
+
+	// LocalTrashDir is where files removed from the maildir are moved, instead of being deleted
+	LocalTrashDir string `yaml:"local_trash_dir"`
+
+	// NotmuchLockTimeout is how long we wait for another process to release its write lock
+	// on the notmuch database, i.e. "30s". Defaults to sync.DefaultLockTimeout.
+	NotmuchLockTimeout time.Duration `yaml:"notmuch_lock_timeout"`
+
+	// ScanWorkers is the number of local folders that are scanned for changes at the same time.
+	// Defaults to sync.DefaultScanWorkers.
+	ScanWorkers int `yaml:"scan_workers"`
 }
@@ -0,0 +1,161 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Expand replaces references to environment variables of the form ${NAME} or $NAME in s,
+// and "$$" with a single "$". A "$" that isn't followed by a variable name is kept as is.
+// An error is returned if a referenced variable is not set.
+func Expand(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		var name string
+		switch next := s[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case next == '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("missing '}' in %q", s)
+			}
+			name = s[i+2 : i+2+end]
+			if name == "" {
+				return "", fmt.Errorf("empty variable name in %q", s)
+			}
+			i += end + 2
+		case isNameChar(next, true):
+			end := i + 1
+			for end < len(s) && isNameChar(s[end], false) {
+				end++
+			}
+			name = s[i+1 : end]
+			i = end - 1
+		default:
+			b.WriteByte('$')
+			continue
+		}
+
+		value, err := lookupEnv(name)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(!first && c >= '0' && c <= '9')
+}
+
+func lookupEnv(name string) (string, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, nil
+	}
+
+	// $HOME is not always set on Windows
+	if name == "HOME" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home, nil
+		}
+	}
+	return "", fmt.Errorf("environment variable %s is not set", name)
+}
+
+// expandedSettings returns the settings of cfg that environment variables are expanded in, by name
+func (cfg *Config) expandedSettings() map[string]*string {
+	return map[string]*string{
+		"maildir":         &cfg.Maildir,
+		"state_dir":       &cfg.StateDir,
+		"syncdb_path":     &cfg.SyncDBPath,
+		"metrics_file":    &cfg.MetricsFile,
+		"local_trash_dir": &cfg.LocalTrashDir,
+	}
+}
+
+// expandedSettings returns the settings of m that environment variables are expanded in, by name.
+// These are the server and login, paths and folder names. Tags and search filters are left
+// alone, since keywords like $MDNSent start with "$".
+func (m *Mailbox) expandedSettings() map[string]*string {
+	settings := map[string]*string{
+		"server":        &m.Server,
+		"username":      &m.Username,
+		"password":      &m.Password,
+		"drafts_folder": &m.DraftsFolder,
+		"state_dir":     &m.StateDir,
+		"notmuch_db":    &m.NotmuchDB,
+		"syncdb_path":   &m.SyncDBPath,
+	}
+	for name, folders := range map[string][]string{
+		"folders.include":        m.Folders.Include,
+		"folders.exclude":        m.Folders.Exclude,
+		"notify_folders.include": m.NotifyFolders.Include,
+		"notify_folders.exclude": m.NotifyFolders.Exclude,
+	} {
+		for i := range folders {
+			settings[fmt.Sprintf("%s[%d]", name, i)] = &folders[i]
+		}
+	}
+	return settings
+}
+
+// expandEnv expands environment variables in the settings of cfg and its mailboxes
+// that are listed by expandedSettings. Other settings are used as is.
+func expandEnv(cfg *Config) error {
+	err := expandSettings(cfg.expandedSettings(), "")
+	if err != nil {
+		return err
+	}
+
+	for name, mailbox := range cfg.Mailboxes {
+		err = expandSettings(mailbox.expandedSettings(), "mailboxes."+name+".")
+		if err != nil {
+			return err
+		}
+
+		// Map values cannot be modified in place, so the special-use folders are copied
+		if len(mailbox.SpecialUseFolders) > 0 {
+			folders := make(map[string]string, len(mailbox.SpecialUseFolders))
+			for attr, folder := range mailbox.SpecialUseFolders {
+				folders[attr], err = Expand(folder)
+				if err != nil {
+					return fmt.Errorf("mailboxes.%s.special_use_folders.%s: %w", name, attr, err)
+				}
+			}
+			mailbox.SpecialUseFolders = folders
+		}
+		cfg.Mailboxes[name] = mailbox
+	}
+	return nil
+}
+
+func expandSettings(settings map[string]*string, prefix string) error {
+	for name, value := range settings {
+		expanded, err := Expand(*value)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", prefix, name, err)
+		}
+		*value = expanded
+	}
+	return nil
+}
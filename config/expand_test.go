@@ -0,0 +1,43 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	os.Setenv("NM_IMAP_SYNC_TEST", "/data")
+	defer os.Unsetenv("NM_IMAP_SYNC_TEST")
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "~/.mail", want: "~/.mail"},
+		{in: "${NM_IMAP_SYNC_TEST}/mail", want: "/data/mail"},
+		{in: "${NM_IMAP_SYNC_TEST}${NM_IMAP_SYNC_TEST}", want: "/data/data"},
+		{in: "$NM_IMAP_SYNC_TEST/mail", want: "/data/mail"},
+		{in: "$NM_IMAP_SYNC_TEST", want: "/data"},
+		{in: "pa$$word", want: "pa$word"},
+		{in: "$$NM_IMAP_SYNC_TEST", want: "$NM_IMAP_SYNC_TEST"},
+		{in: "$$$NM_IMAP_SYNC_TEST", want: "$/data"},
+		{in: "a$", want: "a$"},
+		{in: "$ $1 $/", want: "$ $1 $/"},
+		{in: "$NM_IMAP_SYNC_UNSET/mail", wantErr: true},
+		{in: "${NM_IMAP_SYNC_UNSET}", wantErr: true},
+		{in: "${NM_IMAP_SYNC_TEST", wantErr: true},
+		{in: "${}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Expand(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Expand(%q): unexpected error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// AccountsDir is the name of the directory, next to the main configuration file,
+// where additional mailbox definitions are read from
+const AccountsDir = "accounts"
+
+// Load reads the configuration from path, which is either a configuration file
+// or a directory containing config.yml.
+// Mailboxes defined in *.yml files in the accounts directory next to the
+// configuration file are merged into the configuration, in lexical order.
+// Defaults from the provider preset of each mailbox are applied, and the
+// merged configuration is validated, and if it's invalid, both the
+// configuration and a *ValidationError is returned.
+func Load(path string) (Config, error) {
+	cfg := Config{}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	mainFile := path
+	baseDir := filepath.Dir(path)
+	if st.IsDir() {
+		mainFile = filepath.Join(path, "config.yml")
+		baseDir = path
+	}
+
+	// The main file may be omitted if we have a directory
+	sources := make(map[string]string)
+	if _, err = os.Stat(mainFile); err == nil || !st.IsDir() {
+		err = readFile(mainFile, &cfg)
+		if err != nil {
+			return cfg, err
+		}
+
+		for name, mailbox := range cfg.Mailboxes {
+			sources[name] = mainFile
+			mailbox.Source = mainFile
+			cfg.Mailboxes[name] = mailbox
+		}
+	}
+
+	files, err := accountFiles(filepath.Join(baseDir, AccountsDir))
+	if err != nil {
+		return cfg, err
+	}
+
+	for _, f := range files {
+		accountCfg := Config{}
+		err = readFile(f, &accountCfg)
+		if err != nil {
+			return cfg, err
+		}
+
+		if cfg.Mailboxes == nil {
+			cfg.Mailboxes = make(map[string]Mailbox, len(accountCfg.Mailboxes))
+		}
+
+		for name, mailbox := range accountCfg.Mailboxes {
+			if other, ok := sources[name]; ok {
+				return cfg, fmt.Errorf("mailbox %s is defined in both %s and %s", name, other, f)
+			}
+			sources[name] = f
+			mailbox.Source = f
+			cfg.Mailboxes[name] = mailbox
+		}
+	}
+
+	for name, mailbox := range cfg.Mailboxes {
+		mailbox.applyPreset()
+		cfg.Mailboxes[name] = mailbox
+	}
+
+	err = cfg.Validate()
+	return cfg, err
+}
+
+// accountFiles returns all configuration files in dir, sorted by name
+func accountFiles(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func readFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file '%s': %w", path, err)
+	}
+
+	// Unknown fields are most likely typos, so we don't allow them
+	err = yaml.UnmarshalStrict(data, cfg)
+	if err != nil {
+		return fmt.Errorf("cannot parse config file '%s': %w", path, err)
+	}
+
+	err = expandEnv(cfg)
+	if err != nil {
+		return fmt.Errorf("config file '%s': %w", path, err)
+	}
+	return nil
+}
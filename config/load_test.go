@@ -0,0 +1,287 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load(filepath.Join("..", "config.example.yml"))
+	if err != nil {
+		t.Fatalf("cannot load config.example.yml: %v", err)
+	}
+
+	mailbox, ok := cfg.Mailboxes["someone@something.xyz"]
+	if !ok {
+		t.Fatalf("example mailbox is missing, got %v", cfg.Mailboxes)
+	}
+	if len(mailbox.IgnoredTags) != 1 || mailbox.IgnoredTags[0] != "$MDNSent" {
+		t.Errorf("ignored_tags = %v, want [$MDNSent]", mailbox.IgnoredTags)
+	}
+}
+
+func TestLoadExpandsEnv(t *testing.T) {
+	os.Setenv("NM_IMAP_SYNC_TEST", "/data")
+	defer os.Unsetenv("NM_IMAP_SYNC_TEST")
+	os.Setenv("NM_IMAP_SYNC_TEST_USER", "someone")
+	defer os.Unsetenv("NM_IMAP_SYNC_TEST_USER")
+
+	dir, err := ioutil.TempDir("", "nm-imap-sync-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(path, []byte(`maildir: $NM_IMAP_SYNC_TEST/mail
+mailboxes:
+  test:
+    server: imap.${NM_IMAP_SYNC_TEST_USER}.example.com
+    username: $NM_IMAP_SYNC_TEST_USER
+    password: pa$$word
+    notmuch_db: ${NM_IMAP_SYNC_TEST}/work
+    drafts_folder: Drafts-$NM_IMAP_SYNC_TEST_USER
+    folders:
+      include:
+        - INBOX
+        - Users/${NM_IMAP_SYNC_TEST_USER}
+        - Drafts-$NM_IMAP_SYNC_TEST_USER
+    special_use_folders:
+      \Sent: Sent-$NM_IMAP_SYNC_TEST_USER
+    ignored_tags:
+      - "$MDNSent"
+    search_filter:
+      INBOX: "NOT KEYWORD $Junk"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("cannot load configuration: %v", err)
+	}
+
+	mailbox := cfg.Mailboxes["test"]
+	for _, tt := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{name: "maildir", got: cfg.Maildir, want: "/data/mail"},
+		{name: "server", got: mailbox.Server, want: "imap.someone.example.com"},
+		{name: "username", got: mailbox.Username, want: "someone"},
+		{name: "password", got: mailbox.Password, want: "pa$word"},
+		{name: "notmuch_db", got: mailbox.NotmuchDB, want: "/data/work"},
+		{name: "drafts_folder", got: mailbox.DraftsFolder, want: "Drafts-someone"},
+		{name: "folders.include", got: mailbox.Folders.Include[1], want: "Users/someone"},
+		{name: "special_use_folders", got: mailbox.SpecialUseFolders["\\Sent"], want: "Sent-someone"},
+		// Keywords in tags and search filters are never expanded
+		{name: "ignored_tags", got: mailbox.IgnoredTags[0], want: "$MDNSent"},
+		{name: "search_filter", got: mailbox.SearchFilter["INBOX"], want: "NOT KEYWORD $Junk"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadUnsetEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nm-imap-sync-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(path, []byte(`mailboxes:
+  test:
+    server: imap.example.com
+    password: $NM_IMAP_SYNC_UNSET
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Load(path)
+	if err == nil || !strings.Contains(err.Error(), "mailboxes.test.password: environment variable NM_IMAP_SYNC_UNSET is not set") {
+		t.Errorf("Load() = %v, want an error about NM_IMAP_SYNC_UNSET", err)
+	}
+}
+
+// writeConfig creates the files in 'files', relative to a new temporary directory,
+// which is returned
+func writeConfig(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "nm-imap-sync-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// mailboxYAML returns the definition of a mailbox called name
+func mailboxYAML(name string) string {
+	return "  " + name + ":\n    server: imap.example.com\n    username: " + name + "\n"
+}
+
+func TestLoadMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		path    string            // Relative to the directory, the directory itself if empty
+		want    map[string]string // Mailbox names and the file they were read from
+		maildir string
+		wantErr []string // Parts of the expected error
+	}{
+		{
+			name: "main file and accounts",
+			files: map[string]string{
+				"config.yml":          "maildir: /mail\nmailboxes:\n" + mailboxYAML("main"),
+				"accounts/work.yml":   "mailboxes:\n" + mailboxYAML("work"),
+				"accounts/home.yaml":  "mailboxes:\n" + mailboxYAML("home") + mailboxYAML("family"),
+				"accounts/README.txt": "not a configuration file",
+			},
+			want: map[string]string{
+				"main":   "config.yml",
+				"work":   "accounts/work.yml",
+				"home":   "accounts/home.yaml",
+				"family": "accounts/home.yaml",
+			},
+			maildir: "/mail",
+		},
+		{
+			name: "main file given by name",
+			files: map[string]string{
+				"custom.yml":        "maildir: /mail\nmailboxes:\n" + mailboxYAML("main"),
+				"accounts/work.yml": "mailboxes:\n" + mailboxYAML("work"),
+			},
+			path: "custom.yml",
+			want: map[string]string{
+				"main": "custom.yml",
+				"work": "accounts/work.yml",
+			},
+			maildir: "/mail",
+		},
+		{
+			name: "directory without main file",
+			files: map[string]string{
+				"accounts/work.yml": "mailboxes:\n" + mailboxYAML("work"),
+			},
+			want: map[string]string{
+				"work": "accounts/work.yml",
+			},
+		},
+		{
+			name: "main file without accounts",
+			files: map[string]string{
+				"config.yml": "maildir: /mail\nmailboxes:\n" + mailboxYAML("main"),
+			},
+			want: map[string]string{
+				"main": "config.yml",
+			},
+			maildir: "/mail",
+		},
+		{
+			name: "duplicate in account files",
+			files: map[string]string{
+				"config.yml":     "maildir: /mail\n",
+				"accounts/b.yml": "mailboxes:\n" + mailboxYAML("work"),
+				"accounts/a.yml": "mailboxes:\n" + mailboxYAML("work"),
+			},
+			// Files are read in lexical order, so a.yml is always the first definition
+			wantErr: []string{"mailbox work is defined in both", "a.yml and", "b.yml"},
+		},
+		{
+			name: "duplicate in main file and account file",
+			files: map[string]string{
+				"config.yml":        "maildir: /mail\nmailboxes:\n" + mailboxYAML("work"),
+				"accounts/work.yml": "mailboxes:\n" + mailboxYAML("work"),
+			},
+			wantErr: []string{"mailbox work is defined in both", "config.yml and", "work.yml"},
+		},
+		{
+			name: "invalid account file",
+			files: map[string]string{
+				"config.yml":       "maildir: /mail\n",
+				"accounts/bad.yml": "mailboxes:\n  work:\n    srever: imap.example.com\n",
+			},
+			wantErr: []string{"bad.yml"},
+		},
+		{
+			name: "no mailboxes",
+			files: map[string]string{
+				"config.yml": "maildir: /mail\n",
+			},
+			wantErr: []string{"no mailboxes configured"},
+		},
+	}
+
+	for _, tt := range tests {
+		dir := writeConfig(t, tt.files)
+		cfg, err := Load(filepath.Join(dir, tt.path))
+
+		if len(tt.wantErr) > 0 {
+			if err == nil {
+				t.Errorf("%s: no error, want %q", tt.name, tt.wantErr)
+				continue
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("%s: error = %v, want it to contain %q", tt.name, err, want)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		got := make(map[string]string, len(cfg.Mailboxes))
+		for name, mailbox := range cfg.Mailboxes {
+			rel, err := filepath.Rel(dir, mailbox.Source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[name] = filepath.ToSlash(rel)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: mailboxes = %v, want %v", tt.name, got, tt.want)
+		}
+		if cfg.Maildir != tt.maildir {
+			t.Errorf("%s: maildir = %q, want %q", tt.name, cfg.Maildir, tt.maildir)
+		}
+	}
+}
+
+func TestLoadMergeAppliesPresets(t *testing.T) {
+	dir := writeConfig(t, map[string]string{
+		"accounts/gmail.yml": "mailboxes:\n  personal:\n    provider: gmail\n    username: someone@gmail.com\n",
+	})
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server := cfg.Mailboxes["personal"].Server; server != "imap.gmail.com" {
+		t.Errorf("server = %q, want imap.gmail.com from the gmail preset", server)
+	}
+}
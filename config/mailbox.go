@@ -1,14 +1,35 @@
 package config
 
+import (
+	"path"
+	"strings"
+	"time"
+)
+
 // Mailbox defines the available options for a IMAP mailbox to pull from
 type Mailbox struct {
+	// Provider selects a preset with defaults for a mail provider, see Presets
+	Provider string `yaml:"provider,omitempty"`
+
 	Server      string
 	Port        int
 	Username    string
 	Password    string
 	UseTLS      bool `yaml:"use_tls"`
 	UseStartTLS bool `yaml:"use_starttls"`
-	Folders     struct {
+	// TLSFingerprint is the SHA-256 fingerprint of the server certificate.
+	// If set, the certificate is accepted if it matches, even if it's not signed by a trusted CA
+	TLSFingerprint string `yaml:"tls_fingerprint"`
+	// AuthMechanisms lists the ways of logging in, in order of preference, of which the first one
+	// the server supports is used. "PLAIN" and "XOAUTH2" use AUTHENTICATE, in which case the password
+	// must be an OAuth 2.0 access token for XOAUTH2, and "LOGIN" uses the LOGIN command.
+	// Defaults to LOGIN only.
+	AuthMechanisms []string `yaml:"auth_mechanisms"`
+	// ThrottleDelay is the shortest time between downloading or uploading two messages, i.e. "100ms",
+	// for servers that throttle clients sending many commands at once
+	ThrottleDelay time.Duration `yaml:"throttle_delay"`
+
+	Folders struct {
 		Include []string
 		Exclude []string
 	}
@@ -18,5 +39,274 @@ type Mailbox struct {
 	IgnoredTags []string          `yaml:"ignored_tags"`
 	FolderTags  map[string]string `yaml:"folder_tags"`
 
-	DBPath string // This is usually inherited from the base configuration
+	// AllowedTags, if set, limits the synchronized keywords and tags to those matching
+	// one of its patterns, i.e. "project-*". Tags for system flags are always synchronized.
+	// IgnoredTags is applied after AllowedTags.
+	AllowedTags []string `yaml:"allowed_tags"`
+
+	// SearchFilter limits which messages are fetched from a folder to those matching
+	// the IMAP SEARCH criteria given for it, i.e. "TO me@example.com NOT KEYWORD $Junk".
+	// Messages that stop matching are left alone.
+	SearchFilter map[string]string `yaml:"search_filter"`
+
+	// PushExcludeQuery is a notmuch query, i.e. "tag:personal". Local changes to matching
+	// messages are never pushed to the server, and new messages aren't uploaded.
+	// Changes made on the server are still pulled.
+	PushExcludeQuery string `yaml:"push_exclude_query"`
+
+	// DraftsFolder is the folder on the server where drafts are kept.
+	// New revisions of a draft saved locally replace the previous revision on the server,
+	// and removing the "draft" tag removes the draft from the server.
+	DraftsFolder string `yaml:"drafts_folder"`
+
+	// SpecialUseFolders maps RFC 6154 special-use attributes, i.e. \Sent, to the folder
+	// with that use, for servers that don't announce them. Attributes announced by the
+	// server take precedence.
+	SpecialUseFolders map[string]string `yaml:"special_use_folders"`
+
+	// StateDir is where the state of this mailbox is kept.
+	// If it's not specified, a subdirectory of the base configuration state_dir is used
+	StateDir string `yaml:"state_dir"`
+
+	// DeletedTag is the tag that messages flagged as \Deleted on the server get locally.
+	// Defaults to "server-deleted", since the "deleted" tag is hidden by notmuch.
+	// If IgnoreDeleted is set, \Deleted is not imported at all.
+	DeletedTag    string `yaml:"deleted_tag"`
+	IgnoreDeleted bool   `yaml:"ignore_deleted"`
+
+	// AutoFolderTags makes every message carry a tag for each folder it's stored in on the server,
+	// made up of FolderTagPrefix (default "folder/") and the folder name.
+	// These tags are maintained by nm-imap-sync, and are never pushed to the server.
+	AutoFolderTags  bool   `yaml:"auto_folder_tags"`
+	FolderTagPrefix string `yaml:"folder_tag_prefix"`
+
+	// StoreProperties stores the folder, UID validity and UID of each copy of a message
+	// on the server in its notmuch properties, see sync.DB.SetLocationProperties.
+	// This costs an extra write to the notmuch database for every message that's changed.
+	StoreProperties bool `yaml:"store_properties"`
+
+	// ThreadTagInherit lists tags, i.e. "muted", that new messages get when they're
+	// downloaded into a thread where another message has them. If ThreadTagMarkRead is set,
+	// such messages are also marked as read. The changes are recorded as the state of the
+	// message on the server, so they stay local unless ThreadTagPush is set.
+	ThreadTagInherit  []string `yaml:"thread_tag_inherit"`
+	ThreadTagMarkRead bool     `yaml:"thread_tag_mark_read"`
+	ThreadTagPush     bool     `yaml:"thread_tag_push"`
+
+	// Notify enables desktop notifications for new messages in the folders selected by
+	// NotifyFolders, which defaults to INBOX only. Messages with one of the tags in
+	// NotifyIgnoreTags, which defaults to DefaultNotifyIgnoreTags, don't notify.
+	Notify        bool `yaml:"notify"`
+	NotifyFolders struct {
+		Include []string
+		Exclude []string
+	} `yaml:"notify_folders"`
+	NotifyIgnoreTags []string `yaml:"notify_ignore_tags"`
+
+	// BackfillBatch limits how many older messages are fetched from each folder per run.
+	// New folders are fetched newest first, so recent mail arrives first, and the
+	// rest is fetched during the following runs. If it's 0, all messages are fetched at once.
+	BackfillBatch int `yaml:"backfill_batch"`
+
+	// UIDChunkSize is the number of UIDs that are searched for new messages at a time.
+	// The state is saved after each chunk. Defaults to DefaultUIDChunkSize.
+	UIDChunkSize int `yaml:"uid_chunk_size"`
+
+	// SyncMetadata fetches the ANNOTATE annotations of new messages into notmuch properties,
+	// and the METADATA entries in MetadataEntries of each folder into the sync database,
+	// if the server supports it. Nothing is written back to the server.
+	SyncMetadata bool `yaml:"sync_metadata"`
+	// MetadataEntries are the folder METADATA entries that are fetched.
+	// Defaults to DefaultMetadataEntries.
+	MetadataEntries []string `yaml:"metadata_entries"`
+
+	// NotmuchDB is the root of the notmuch database used for this mailbox, i.e. database.path
+	// in the notmuch configuration. The mailbox is stored in a subdirectory named after it.
+	// Defaults to the base configuration maildir. Mailboxes with their own notmuch database
+	// also get their own sync database in StateDir, unless SyncDBPath is set.
+	NotmuchDB string `yaml:"notmuch_db"`
+
+	// SyncDBPath overrides the location of the sync database for this mailbox.
+	// Note that messages are only recognized across mailboxes that share a sync database.
+	SyncDBPath string `yaml:"syncdb_path"`
+
+	// StoreHeaders controls if From, Subject and Date are stored in the sync database,
+	// which is used to describe messages in reports. Defaults to true.
+	StoreHeaders *bool `yaml:"store_headers"`
+
+	DBPath string `yaml:"-"` // This is usually inherited from the base configuration
+	Source string `yaml:"-"` // Source is the file this mailbox was defined in
+}
+
+// IncludesFolder returns true if folder should be synchronized,
+// according to the include and exclude lists
+func (m Mailbox) IncludesFolder(folder string) bool {
+	if len(m.Folders.Include) > 0 {
+		for _, includeFolder := range m.Folders.Include {
+			if folder == includeFolder {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, excludeFolder := range m.Folders.Exclude {
+		if folder == excludeFolder {
+			return false
+		}
+	}
+	return true
+}
+
+// NotifiesFolder returns true if new messages in folder should be notified about,
+// according to the notify_folders include and exclude lists
+func (m Mailbox) NotifiesFolder(folder string) bool {
+	if !m.Notify {
+		return false
+	}
+
+	include := m.NotifyFolders.Include
+	if len(include) == 0 && len(m.NotifyFolders.Exclude) == 0 {
+		include = []string{"INBOX"}
+	}
+	if len(include) > 0 {
+		for _, includeFolder := range include {
+			if folder == includeFolder {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, excludeFolder := range m.NotifyFolders.Exclude {
+		if folder == excludeFolder {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultNotifyIgnoreTags are the tags of messages that don't notify if nothing else is specified
+var DefaultNotifyIgnoreTags = []string{"muted", "spam"}
+
+// NotifyIgnoresTag returns true if messages with tag should not be notified about
+func (m Mailbox) NotifyIgnoresTag(tag string) bool {
+	ignored := m.NotifyIgnoreTags
+	if len(ignored) == 0 {
+		ignored = DefaultNotifyIgnoreTags
+	}
+	for _, t := range ignored {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// StoresHeaders returns true if message headers should be stored in the sync database
+func (m Mailbox) StoresHeaders() bool {
+	return m.StoreHeaders == nil || *m.StoreHeaders
+}
+
+// DefaultDeletedTag is the tag used for \Deleted messages if nothing else is specified
+const DefaultDeletedTag = "server-deleted"
+
+// ServerDeletedTag returns the tag used for messages flagged as \Deleted on the server,
+// or an empty string if the flag should be ignored
+func (m Mailbox) ServerDeletedTag() string {
+	if m.IgnoreDeleted {
+		return ""
+	}
+	if m.DeletedTag == "" {
+		return DefaultDeletedTag
+	}
+	return m.DeletedTag
+}
+
+// systemTags are the tags that correspond to IMAP system flags,
+// except for the tag used for \Deleted, see ServerDeletedTag
+var systemTags = map[string]bool{
+	"unread":  true,
+	"replied": true,
+	"flagged": true,
+	"draft":   true,
+}
+
+// SyncsTag returns true if tag should be synchronized with the server,
+// according to allowed_tags and ignored_tags
+func (m Mailbox) SyncsTag(tag string) bool {
+	for _, ignore := range m.IgnoredTags {
+		if tag == ignore {
+			return false
+		}
+	}
+	if len(m.AllowedTags) == 0 || systemTags[tag] || tag == m.ServerDeletedTag() {
+		return true
+	}
+	for _, pattern := range m.AllowedTags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthMechanisms are the values auth_mechanisms may contain
+var AuthMechanisms = []string{"LOGIN", "PLAIN", "XOAUTH2"}
+
+// SpecialUseAttributes are the RFC 6154 attributes that mark special folders
+var SpecialUseAttributes = []string{
+	"\\All",
+	"\\Archive",
+	"\\Drafts",
+	"\\Flagged",
+	"\\Junk",
+	"\\Sent",
+	"\\Trash",
+}
+
+// DefaultUIDChunkSize is the number of UIDs searched at a time if nothing else is specified
+const DefaultUIDChunkSize = 10000
+
+// UIDChunk returns the number of UIDs that are searched for new messages at a time
+func (m Mailbox) UIDChunk() uint32 {
+	if m.UIDChunkSize <= 0 {
+		return DefaultUIDChunkSize
+	}
+	return uint32(m.UIDChunkSize)
+}
+
+// DefaultMetadataEntries are the folder METADATA entries that are fetched if nothing else is specified
+var DefaultMetadataEntries = []string{"/private/comment", "/shared/comment"}
+
+// FolderMetadataEntries returns the folder METADATA entries that are fetched when SyncMetadata is set
+func (m Mailbox) FolderMetadataEntries() []string {
+	if len(m.MetadataEntries) == 0 {
+		return DefaultMetadataEntries
+	}
+	return m.MetadataEntries
+}
+
+// DefaultFolderTagPrefix is the prefix of automatic folder tags if nothing else is specified
+const DefaultFolderTagPrefix = "folder/"
+
+func (m Mailbox) folderTagPrefix() string {
+	if m.FolderTagPrefix == "" {
+		return DefaultFolderTagPrefix
+	}
+	return m.FolderTagPrefix
+}
+
+// FolderTag returns the automatic tag for messages in folder,
+// or an empty string if auto_folder_tags is not enabled
+func (m Mailbox) FolderTag(folder string) string {
+	if !m.AutoFolderTags {
+		return ""
+	}
+	return m.folderTagPrefix() + folder
+}
+
+// IsFolderTag returns true if tag is an automatic folder tag
+func (m Mailbox) IsFolderTag(tag string) bool {
+	return m.AutoFolderTags && strings.HasPrefix(tag, m.folderTagPrefix())
 }
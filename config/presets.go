@@ -0,0 +1,127 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package config
+
+import (
+	"sort"
+	"time"
+)
+
+// Preset contains default settings for a mail provider.
+// Settings in the configuration always take precedence over the preset.
+type Preset struct {
+	Server string
+	Port   int
+	UseTLS bool
+
+	// ExcludeFolders are not synchronized, unless the configuration lists folders itself
+	ExcludeFolders []string
+	IgnoredTags    []string
+
+	AuthMechanisms    []string
+	SpecialUseFolders map[string]string
+	ThrottleDelay     time.Duration
+}
+
+// Presets lists the known providers, which can be selected with 'provider'
+var Presets = map[string]Preset{
+	"generic": {},
+	"gmail": {
+		Server: "imap.gmail.com",
+		Port:   993,
+		UseTLS: true,
+		// These folders contain copies of messages in other folders,
+		// and would cause every message to be downloaded several times
+		ExcludeFolders: []string{"[Gmail]/All Mail", "[Gmail]/Important", "[Gmail]/Starred"},
+		// App passwords work with PLAIN, OAuth 2.0 tokens need auth_mechanisms: [XOAUTH2]
+		AuthMechanisms: []string{"PLAIN", "LOGIN"},
+		SpecialUseFolders: map[string]string{
+			"\\All":     "[Gmail]/All Mail",
+			"\\Drafts":  "[Gmail]/Drafts",
+			"\\Flagged": "[Gmail]/Starred",
+			"\\Junk":    "[Gmail]/Spam",
+			"\\Sent":    "[Gmail]/Sent Mail",
+			"\\Trash":   "[Gmail]/Trash",
+		},
+	},
+	"office365": {
+		Server: "outlook.office365.com",
+		Port:   993,
+		UseTLS: true,
+		// Outlook keeps its own synchronization logs here
+		ExcludeFolders: []string{"Sync Issues", "Sync Issues/Conflicts", "Sync Issues/Local Failures", "Sync Issues/Server Failures"},
+		// Exchange sets this keyword on every message a read receipt has been sent for
+		IgnoredTags: []string{"$MDNSent"},
+		// Exchange Online no longer accepts passwords, only OAuth 2.0 access tokens
+		AuthMechanisms: []string{"XOAUTH2"},
+		SpecialUseFolders: map[string]string{
+			"\\Archive": "Archive",
+			"\\Drafts":  "Drafts",
+			"\\Junk":    "Junk Email",
+			"\\Sent":    "Sent Items",
+			"\\Trash":   "Deleted Items",
+		},
+		// Exchange throttles clients that send many commands in a short time
+		ThrottleDelay: 100 * time.Millisecond,
+	},
+	"dovecot": {
+		AuthMechanisms: []string{"PLAIN", "LOGIN"},
+		SpecialUseFolders: map[string]string{
+			"\\Drafts": "Drafts",
+			"\\Junk":   "Junk",
+			"\\Sent":   "Sent",
+			"\\Trash":  "Trash",
+		},
+	},
+}
+
+// PresetNames returns the names of all presets, in sorted order
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset fills in all settings of m that are not set from the preset
+// of its provider. Unknown providers are reported by Validate.
+func (m *Mailbox) applyPreset() {
+	preset, ok := Presets[m.Provider]
+	if !ok {
+		return
+	}
+
+	if m.Server == "" {
+		m.Server = preset.Server
+	}
+	// Connection security is only taken from the preset if none is configured
+	if m.Port == 0 && !m.UseTLS && !m.UseStartTLS {
+		m.Port = preset.Port
+		m.UseTLS = preset.UseTLS
+	}
+	if len(m.Folders.Include) == 0 && len(m.Folders.Exclude) == 0 {
+		m.Folders.Exclude = append([]string(nil), preset.ExcludeFolders...)
+	}
+	if m.IgnoredTags == nil {
+		m.IgnoredTags = append([]string(nil), preset.IgnoredTags...)
+	}
+	if m.AuthMechanisms == nil {
+		m.AuthMechanisms = append([]string(nil), preset.AuthMechanisms...)
+	}
+	// Folders are only added, so that single ones can be overridden
+	for attr, folder := range preset.SpecialUseFolders {
+		if _, ok := m.SpecialUseFolders[attr]; ok {
+			continue
+		}
+		if m.SpecialUseFolders == nil {
+			m.SpecialUseFolders = make(map[string]string)
+		}
+		m.SpecialUseFolders[attr] = folder
+	}
+	if m.ThrottleDelay == 0 {
+		m.ThrottleDelay = preset.ThrottleDelay
+	}
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPresets(t *testing.T) {
+	want := map[string]Preset{
+		"generic": {},
+		"gmail": {
+			Server:         "imap.gmail.com",
+			Port:           993,
+			UseTLS:         true,
+			ExcludeFolders: []string{"[Gmail]/All Mail", "[Gmail]/Important", "[Gmail]/Starred"},
+			AuthMechanisms: []string{"PLAIN", "LOGIN"},
+			SpecialUseFolders: map[string]string{
+				"\\All":     "[Gmail]/All Mail",
+				"\\Drafts":  "[Gmail]/Drafts",
+				"\\Flagged": "[Gmail]/Starred",
+				"\\Junk":    "[Gmail]/Spam",
+				"\\Sent":    "[Gmail]/Sent Mail",
+				"\\Trash":   "[Gmail]/Trash",
+			},
+		},
+		"office365": {
+			Server:         "outlook.office365.com",
+			Port:           993,
+			UseTLS:         true,
+			ExcludeFolders: []string{"Sync Issues", "Sync Issues/Conflicts", "Sync Issues/Local Failures", "Sync Issues/Server Failures"},
+			IgnoredTags:    []string{"$MDNSent"},
+			AuthMechanisms: []string{"XOAUTH2"},
+			SpecialUseFolders: map[string]string{
+				"\\Archive": "Archive",
+				"\\Drafts":  "Drafts",
+				"\\Junk":    "Junk Email",
+				"\\Sent":    "Sent Items",
+				"\\Trash":   "Deleted Items",
+			},
+			ThrottleDelay: 100 * time.Millisecond,
+		},
+		"dovecot": {
+			AuthMechanisms: []string{"PLAIN", "LOGIN"},
+			SpecialUseFolders: map[string]string{
+				"\\Drafts": "Drafts",
+				"\\Junk":   "Junk",
+				"\\Sent":   "Sent",
+				"\\Trash":  "Trash",
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(Presets, want) {
+		t.Errorf("Presets = %#v, want %#v", Presets, want)
+	}
+
+	// Every preset must result in a valid configuration
+	for _, name := range PresetNames() {
+		m := Mailbox{Provider: name, Server: "imap.example.com", Username: "test"}
+		m.applyPreset()
+		if problems := m.validate(); len(problems) > 0 {
+			t.Errorf("%s: invalid preset: %v", name, problems)
+		}
+	}
+}
+
+func TestApplyPreset(t *testing.T) {
+	m := Mailbox{Provider: "office365"}
+	m.applyPreset()
+
+	if m.Server != "outlook.office365.com" || m.Port != 993 || !m.UseTLS {
+		t.Errorf("server = %s:%d (TLS %v), want outlook.office365.com:993 (TLS true)", m.Server, m.Port, m.UseTLS)
+	}
+	if !reflect.DeepEqual(m.IgnoredTags, []string{"$MDNSent"}) {
+		t.Errorf("ignored_tags = %v, want [$MDNSent]", m.IgnoredTags)
+	}
+	if !reflect.DeepEqual(m.AuthMechanisms, []string{"XOAUTH2"}) {
+		t.Errorf("auth_mechanisms = %v, want [XOAUTH2]", m.AuthMechanisms)
+	}
+	if m.ThrottleDelay != 100*time.Millisecond {
+		t.Errorf("throttle_delay = %s, want 100ms", m.ThrottleDelay)
+	}
+	// Drafts are only synchronized when drafts_folder is set explicitly
+	if m.DraftsFolder != "" {
+		t.Errorf("drafts_folder = %q, want it unset", m.DraftsFolder)
+	}
+
+	// The preset must not be changed through the mailbox
+	m.IgnoredTags[0] = "changed"
+	m.SpecialUseFolders["\\Sent"] = "changed"
+	if Presets["office365"].IgnoredTags[0] != "$MDNSent" || Presets["office365"].SpecialUseFolders["\\Sent"] != "Sent Items" {
+		t.Errorf("preset was modified through the mailbox")
+	}
+}
+
+func TestApplyPresetOverrides(t *testing.T) {
+	m := Mailbox{
+		Provider:          "gmail",
+		Server:            "imap.example.com",
+		Port:              143,
+		UseStartTLS:       true,
+		IgnoredTags:       []string{},
+		AuthMechanisms:    []string{"XOAUTH2"},
+		SpecialUseFolders: map[string]string{"\\Sent": "Sent"},
+		ThrottleDelay:     time.Second,
+	}
+	m.Folders.Include = []string{"INBOX"}
+	m.applyPreset()
+
+	if m.Server != "imap.example.com" || m.Port != 143 || m.UseTLS || !m.UseStartTLS {
+		t.Errorf("connection settings were overridden by the preset")
+	}
+	if len(m.Folders.Exclude) != 0 {
+		t.Errorf("folders.exclude = %v, want none since folders.include is set", m.Folders.Exclude)
+	}
+	if len(m.IgnoredTags) != 0 {
+		t.Errorf("ignored_tags = %v, want none", m.IgnoredTags)
+	}
+	if !reflect.DeepEqual(m.AuthMechanisms, []string{"XOAUTH2"}) {
+		t.Errorf("auth_mechanisms = %v, want [XOAUTH2]", m.AuthMechanisms)
+	}
+	if m.ThrottleDelay != time.Second {
+		t.Errorf("throttle_delay = %s, want 1s", m.ThrottleDelay)
+	}
+	// Single special-use folders can be overridden, the rest come from the preset
+	if m.SpecialUseFolders["\\Sent"] != "Sent" || m.SpecialUseFolders["\\Trash"] != "[Gmail]/Trash" {
+		t.Errorf("special_use_folders = %v, want \\Sent overridden and the rest from the preset", m.SpecialUseFolders)
+	}
+}
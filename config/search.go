@@ -0,0 +1,155 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// searchKeys lists the IMAP SEARCH keys (RFC 3501, RFC 5032) that may be
+// used in search_filter, together with the number of arguments they take
+var searchKeys = map[string]int{
+	"ALL": 0, "ANSWERED": 0, "DELETED": 0, "DRAFT": 0, "FLAGGED": 0, "NEW": 0, "OLD": 0,
+	"RECENT": 0, "SEEN": 0, "UNANSWERED": 0, "UNDELETED": 0, "UNDRAFT": 0, "UNFLAGGED": 0, "UNSEEN": 0,
+	"BCC": 1, "BEFORE": 1, "BODY": 1, "CC": 1, "FROM": 1, "KEYWORD": 1, "LARGER": 1, "ON": 1,
+	"SENTBEFORE": 1, "SENTON": 1, "SENTSINCE": 1, "SINCE": 1, "SMALLER": 1, "SUBJECT": 1,
+	"TEXT": 1, "TO": 1, "UID": 1, "UNKEYWORD": 1, "OLDER": 1, "YOUNGER": 1, "X-GM-RAW": 1,
+	"HEADER": 2,
+}
+
+// ValidateSearchFilter checks that filter is a list of IMAP SEARCH criteria,
+// i.e. that all keys are known, and have the right number of arguments
+func ValidateSearchFilter(filter string) error {
+	tokens, err := tokenizeSearch(filter)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return errors.New("no search criteria")
+	}
+
+	p := searchParser{tokens: tokens}
+	for p.more() {
+		err = p.key()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenizeSearch splits filter into parentheses, atoms and quoted strings.
+// Quoted strings keep their quotes, so they can be told apart from keys.
+func tokenizeSearch(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, errors.New("unterminated quoted string")
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := strings.IndexAny(filter[i:], " ()\"")
+			if end < 0 {
+				end = len(filter) - i
+			}
+			tokens = append(tokens, filter[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// searchParser checks a list of search criteria
+type searchParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *searchParser) more() bool {
+	return p.pos < len(p.tokens)
+}
+
+func (p *searchParser) next() (string, error) {
+	if !p.more() {
+		return "", errors.New("unexpected end of search criteria")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+// key checks a single search key and its arguments
+func (p *searchParser) key() error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+
+	key := strings.ToUpper(t)
+	switch {
+	case key == "(":
+		if p.more() && p.tokens[p.pos] == ")" {
+			return errors.New("empty parenthesized list")
+		}
+		for p.more() && p.tokens[p.pos] != ")" {
+			err = p.key()
+			if err != nil {
+				return err
+			}
+		}
+		if !p.more() {
+			return errors.New("missing ')'")
+		}
+		p.pos++
+		return nil
+	case key == ")":
+		return errors.New("unexpected ')'")
+	case key == "NOT":
+		return p.key()
+	case key == "OR":
+		err = p.key()
+		if err != nil {
+			return err
+		}
+		return p.key()
+	case isSequenceSet(key):
+		return nil
+	}
+
+	args, ok := searchKeys[key]
+	if !ok {
+		return fmt.Errorf("unknown search key %s", t)
+	}
+	for i := 0; i < args; i++ {
+		arg, err := p.next()
+		if err != nil {
+			return fmt.Errorf("%s: missing argument", t)
+		}
+		if arg == "(" || arg == ")" {
+			return fmt.Errorf("%s: missing argument", t)
+		}
+	}
+	return nil
+}
+
+// isSequenceSet returns true if s is a sequence set, i.e. "1:100,200:*"
+func isSequenceSet(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789:,*") == ""
+}
@@ -0,0 +1,198 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package config
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists all problems found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(e.Problems, "\n  "))
+}
+
+// Validate checks the configuration for settings that are contradictory or out of range.
+// All problems are reported at once in a *ValidationError.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if len(c.Mailboxes) == 0 {
+		problems = append(problems, "no mailboxes configured")
+	}
+	if c.NotmuchLockTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("notmuch_lock_timeout: %s must not be negative", c.NotmuchLockTimeout))
+	}
+	if c.ScanWorkers < 0 {
+		problems = append(problems, fmt.Sprintf("scan_workers: %d must not be negative", c.ScanWorkers))
+	}
+
+	// Check mailboxes in a predictable order
+	names := make([]string, 0, len(c.Mailboxes))
+	for name := range c.Mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mailbox := c.Mailboxes[name]
+		prefix := fmt.Sprintf("mailboxes.%s", name)
+		if mailbox.Source != "" {
+			prefix = fmt.Sprintf("%s: %s", mailbox.Source, prefix)
+		}
+
+		for _, p := range mailbox.validate() {
+			problems = append(problems, fmt.Sprintf("%s.%s", prefix, p))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validate returns a list of problems, each prefixed with the name of the offending field
+func (m *Mailbox) validate() []string {
+	var problems []string
+
+	if _, ok := Presets[m.Provider]; m.Provider != "" && !ok {
+		problems = append(problems, fmt.Sprintf("provider: unknown provider %q, must be one of %s", m.Provider, strings.Join(PresetNames(), ", ")))
+	}
+	if m.Server == "" {
+		problems = append(problems, "server: not set")
+	}
+	if m.Username == "" {
+		problems = append(problems, "username: not set")
+	}
+	if m.Port < 0 || m.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port: %d is out of range", m.Port))
+	}
+	if m.UseTLS && m.UseStartTLS {
+		problems = append(problems, "use_starttls: cannot be combined with use_tls")
+	}
+
+	if m.TLSFingerprint != "" {
+		if !m.UseTLS && !m.UseStartTLS {
+			problems = append(problems, "tls_fingerprint: requires use_tls or use_starttls")
+		}
+		if _, err := ParseFingerprint(m.TLSFingerprint); err != nil {
+			problems = append(problems, fmt.Sprintf("tls_fingerprint: %s", err))
+		}
+	}
+
+	for _, mechanism := range m.AuthMechanisms {
+		if !contains(AuthMechanisms, strings.ToUpper(mechanism)) {
+			problems = append(problems, fmt.Sprintf("auth_mechanisms: unknown mechanism %q, must be one of %s", mechanism, strings.Join(AuthMechanisms, ", ")))
+		}
+	}
+	if m.ThrottleDelay < 0 {
+		problems = append(problems, fmt.Sprintf("throttle_delay: %s must not be negative", m.ThrottleDelay))
+	}
+	attrs := make([]string, 0, len(m.SpecialUseFolders))
+	for attr := range m.SpecialUseFolders {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	for _, attr := range attrs {
+		if !contains(SpecialUseAttributes, attr) {
+			problems = append(problems, fmt.Sprintf("special_use_folders: unknown attribute %q, must be one of %s", attr, strings.Join(SpecialUseAttributes, ", ")))
+		}
+	}
+
+	if m.BackfillBatch < 0 {
+		problems = append(problems, fmt.Sprintf("backfill_batch: %d must not be negative", m.BackfillBatch))
+	}
+	if m.UIDChunkSize < 0 {
+		problems = append(problems, fmt.Sprintf("uid_chunk_size: %d must not be negative", m.UIDChunkSize))
+	}
+	for _, entry := range m.MetadataEntries {
+		if !strings.HasPrefix(entry, "/private/") && !strings.HasPrefix(entry, "/shared/") {
+			problems = append(problems, fmt.Sprintf("metadata_entries: %q must start with /private/ or /shared/", entry))
+		}
+	}
+	for _, pattern := range m.AllowedTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("allowed_tags: invalid pattern %q", pattern))
+		}
+	}
+	if m.IgnoreDeleted && m.DeletedTag != "" {
+		problems = append(problems, "deleted_tag: cannot be combined with ignore_deleted")
+	}
+
+	excluded := make(map[string]bool, len(m.Folders.Exclude))
+	for _, folder := range m.Folders.Exclude {
+		excluded[folder] = true
+	}
+
+	included := make(map[string]bool, len(m.Folders.Include))
+	for _, folder := range m.Folders.Include {
+		included[folder] = true
+		if excluded[folder] {
+			problems = append(problems, fmt.Sprintf("folders: %s is both included and excluded", folder))
+		}
+	}
+
+	if m.DraftsFolder != "" && (excluded[m.DraftsFolder] || (len(included) > 0 && !included[m.DraftsFolder])) {
+		problems = append(problems, fmt.Sprintf("drafts_folder: %s is not a synchronized folder", m.DraftsFolder))
+	}
+
+	folders := make([]string, 0, len(m.FolderTags))
+	for folder := range m.FolderTags {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+
+	for _, folder := range folders {
+		if excluded[folder] || (len(included) > 0 && !included[folder]) {
+			problems = append(problems, fmt.Sprintf("folder_tags: %s is not a synchronized folder", folder))
+		}
+	}
+
+	folders = folders[:0]
+	for folder := range m.SearchFilter {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+
+	for _, folder := range folders {
+		if excluded[folder] || (len(included) > 0 && !included[folder]) {
+			problems = append(problems, fmt.Sprintf("search_filter: %s is not a synchronized folder", folder))
+		}
+		if err := ValidateSearchFilter(m.SearchFilter[folder]); err != nil {
+			problems = append(problems, fmt.Sprintf("search_filter: %s: %s", folder, err))
+		}
+	}
+	return problems
+}
+
+// contains returns true if list contains s
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Masked returns a copy of the configuration where all secrets have been replaced,
+// which is suitable for printing
+func (c Config) Masked() Config {
+	mailboxes := make(map[string]Mailbox, len(c.Mailboxes))
+	for name, mailbox := range c.Mailboxes {
+		if mailbox.Password != "" {
+			mailbox.Password = "********"
+		}
+		mailboxes[name] = mailbox
+	}
+	c.Mailboxes = mailboxes
+	return c
+}
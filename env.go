@@ -0,0 +1,225 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// environment contains the settings shared by all commands
+type environment struct {
+	cfg         config.Config
+	maildirPath string
+	stateDir    string
+
+	// nonInteractive disables prompting for missing passwords, see askPasswords
+	nonInteractive bool
+}
+
+// defaultConfigPath returns the path of the configuration file used if none is specified
+func defaultConfigPath() string {
+	cfgDir, err := os.UserConfigDir()
+	if err != nil {
+		cfgDir = filepath.Join(userHomeDir(), ".config")
+	}
+	configPath := filepath.Join(cfgDir, "nm-imap-sync", "config.yml")
+
+	// Older versions read the configuration from the working directory
+	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat("config.yml"); err == nil {
+			log.Printf("using config.yml from the current directory, please move it to %s\n", configPath)
+			configPath = "config.yml"
+		}
+	}
+	return configPath
+}
+
+// loadEnvironment reads the configuration in configFile, and applies defaults
+func loadEnvironment(configFile string) (*environment, error) {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Maildir == "" {
+		cfg.Maildir = "~/.mail"
+	}
+
+	env := &environment{
+		cfg:         cfg,
+		maildirPath: parsePathSetting(cfg.Maildir),
+		stateDir:    defaultStateDir(),
+	}
+	if cfg.StateDir != "" {
+		env.stateDir = parsePathSetting(cfg.StateDir)
+	}
+
+	err = env.checkSyncDBs()
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// checkSyncDBs makes sure that mailboxes sharing a sync database also share a notmuch database,
+// since the sync database refers to messages in the notmuch database by message id
+func (env *environment) checkSyncDBs() error {
+	notmuchPaths := make(map[string]string)
+	owners := make(map[string]string)
+	for _, name := range env.accountNames() {
+		path := env.syncDBPath(name)
+		nmPath := env.notmuchPath(name)
+		if prev, ok := notmuchPaths[path]; ok && prev != nmPath {
+			return fmt.Errorf("mailboxes %s and %s use the same sync database %s with different notmuch databases",
+				owners[path], name, path)
+		}
+		notmuchPaths[path] = nmPath
+		owners[path] = name
+	}
+	return nil
+}
+
+// notmuchPath returns the root of the notmuch database used for the mailbox 'account',
+// or the shared notmuch database if account is empty
+func (env *environment) notmuchPath(account string) string {
+	if mailbox, ok := env.cfg.Mailboxes[account]; ok && mailbox.NotmuchDB != "" {
+		return parsePathSetting(mailbox.NotmuchDB)
+	}
+	return env.maildirPath
+}
+
+// syncDBPath returns the location of the sync database used for the mailbox 'account',
+// or the shared sync database if account is empty
+func (env *environment) syncDBPath(account string) string {
+	if mailbox, ok := env.cfg.Mailboxes[account]; ok {
+		if mailbox.SyncDBPath != "" {
+			return parsePathSetting(mailbox.SyncDBPath)
+		}
+		// A separate notmuch database needs a separate sync database
+		if env.notmuchPath(account) != env.maildirPath {
+			mailbox, _, _ = env.mailbox(account)
+			return filepath.Join(mailbox.StateDir, "nmsyncdb")
+		}
+	}
+	if env.cfg.SyncDBPath != "" {
+		return parsePathSetting(env.cfg.SyncDBPath)
+	}
+	return filepath.Join(env.stateDir, "nmsyncdb")
+}
+
+// hasOwnSyncDB returns true if the mailbox 'account' does not use the shared sync database
+func (env *environment) hasOwnSyncDB(account string) bool {
+	return env.syncDBPath(account) != env.syncDBPath("")
+}
+
+// openSyncDB creates the maildir if necessary, and opens the sync database used
+// for the mailbox 'account', or the shared sync database if account is empty
+func (env *environment) openSyncDB(ctx context.Context, account string) (*sync.DB, error) {
+	// The sync database was previously stored in the maildir
+	syncdbPath := env.syncDBPath(account)
+	if !env.hasOwnSyncDB(account) {
+		err := migrateLegacyFile(filepath.Join(env.maildirPath, ".nmsyncdb"), syncdbPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot migrate sync database: %w", err)
+		}
+	}
+
+	// Create maildir if it doesnt exist
+	nmPath := env.notmuchPath(account)
+	err := os.MkdirAll(nmPath, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create maildir: %w", err)
+	}
+
+	syncdb, err := sync.New(ctx, nmPath, syncdbPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize sync database: %w", err)
+	}
+	syncdb.SetTrashDir(env.trashDir())
+	if env.cfg.NotmuchLockTimeout > 0 {
+		syncdb.SetLockTimeout(env.cfg.NotmuchLockTimeout)
+	}
+	if env.cfg.ScanWorkers > 0 {
+		syncdb.SetScanWorkers(env.cfg.ScanWorkers)
+	}
+	return syncdb, nil
+}
+
+// syncDBs keeps one open sync database per location, so that
+// mailboxes sharing a sync database also share the handle
+type syncDBs struct {
+	env  *environment
+	open map[string]*sync.DB
+}
+
+func newSyncDBs(env *environment) *syncDBs {
+	return &syncDBs{env: env, open: make(map[string]*sync.DB)}
+}
+
+// get returns the sync database for the mailbox 'account', opening it if necessary
+func (s *syncDBs) get(ctx context.Context, account string) (*sync.DB, error) {
+	path := s.env.syncDBPath(account)
+	if db, ok := s.open[path]; ok {
+		return db, nil
+	}
+
+	db, err := s.env.openSyncDB(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	s.open[path] = db
+	return db, nil
+}
+
+// close closes all sync databases that have been opened
+func (s *syncDBs) close() {
+	for path, db := range s.open {
+		db.Close()
+		delete(s.open, path)
+	}
+}
+
+// accountNames returns the names of all configured mailboxes, in sorted order
+func (env *environment) accountNames() []string {
+	names := make([]string, 0, len(env.cfg.Mailboxes))
+	for name := range env.cfg.Mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mailbox returns the configuration for the mailbox 'name' with all inherited
+// settings applied, together with the local path of the mailbox
+func (env *environment) mailbox(name string) (config.Mailbox, string, error) {
+	mailbox, ok := env.cfg.Mailboxes[name]
+	if !ok {
+		return mailbox, "", fmt.Errorf("no mailbox named %s is configured", name)
+	}
+
+	mailbox.DBPath = env.notmuchPath(name)
+	if mailbox.StateDir == "" {
+		mailbox.StateDir = filepath.Join(env.stateDir, name)
+	} else {
+		mailbox.StateDir = parsePathSetting(mailbox.StateDir)
+	}
+	return mailbox, filepath.Join(mailbox.DBPath, name), nil
+}
+
+// trashDir returns the path of the local trash directory, or an empty string if not configured
+func (env *environment) trashDir() string {
+	if env.cfg.LocalTrashDir == "" {
+		return ""
+	}
+	return parsePathSetting(env.cfg.LocalTrashDir)
+}
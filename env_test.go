@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+func TestSyncDBPath(t *testing.T) {
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", "/home/test")
+
+	env := &environment{
+		cfg: config.Config{
+			SyncDBPath: "~/state/sync.db",
+			Mailboxes: map[string]config.Mailbox{
+				"personal": {},
+				"work":     {SyncDBPath: "/var/lib/work/sync.db"},
+				"other":    {NotmuchDB: "/home/test/other", StateDir: "/home/test/state/other"},
+			},
+		},
+		maildirPath: "/home/test/.mail",
+		stateDir:    "/home/test/.local/state/nm-imap-sync",
+	}
+
+	tests := []struct {
+		account string
+		want    string
+	}{
+		{account: "", want: "/home/test/state/sync.db"},
+		{account: "personal", want: "/home/test/state/sync.db"},
+		{account: "work", want: "/var/lib/work/sync.db"},
+		{account: "other", want: "/home/test/state/other/nmsyncdb"},
+	}
+
+	for _, tt := range tests {
+		if got := env.syncDBPath(tt.account); got != filepath.FromSlash(tt.want) {
+			t.Errorf("%q: syncDBPath() = %s, want %s", tt.account, got, tt.want)
+		}
+	}
+}
+
+func TestOpenSyncDBCustomPath(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "nm-imap-sync-syncdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The parent directories of the database are created as needed
+	env := &environment{
+		cfg:         config.Config{SyncDBPath: filepath.Join(dir, "state", "nested", "sync.db")},
+		maildirPath: filepath.Join(dir, "mail"),
+		stateDir:    filepath.Join(dir, "default"),
+	}
+	syncdb, err := env.openSyncDB(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := sync.UID{FolderName: "INBOX", UIDValidity: 1, UID: 42}
+	err = syncdb.AddMessageSyncInfo(ctx, sync.MessageInfo{MessageID: "kept@example.com", UIDs: []sync.UID{uid}}, nil)
+	syncdb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(env.cfg.SyncDBPath); err != nil {
+		t.Fatalf("sync database was not created at the configured path: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(env.stateDir, "nmsyncdb")); !os.IsNotExist(err) {
+		t.Errorf("sync database was created at the default path as well")
+	}
+
+	// Moving the file and updating the configuration keeps the state
+	moved := filepath.Join(dir, "moved.db")
+	err = os.Rename(env.cfg.SyncDBPath, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.cfg.SyncDBPath = moved
+	syncdb, err = env.openSyncDB(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syncdb.Close()
+
+	uids, err := syncdb.LookupUIDs(ctx, "kept@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(uids, []sync.UID{uid}) {
+		t.Errorf("UIDs after moving the database = %v, want %v", uids, []sync.UID{uid})
+	}
+}
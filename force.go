@@ -0,0 +1,66 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/yzzyx/nm-imap-sync/imap"
+)
+
+// forceTags makes the tags of every synchronized message in account match either the
+// local tags or the server flags, depending on direction, and returns the exit code
+func forceTags(ctx context.Context, env *environment, account string, direction imap.ForceDirection, dryRun bool) int {
+	mailbox, folderPath, err := env.mailbox(account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	dbs := newSyncDBs(env)
+	defer dbs.close()
+
+	syncdb, err := dbs.get(ctx, account)
+	if err != nil {
+		fmt.Printf("%s: %s\n", account, err)
+		return exitAccountsFailed
+	}
+
+	err = os.MkdirAll(folderPath, 0700)
+	if err != nil {
+		fmt.Printf("%s: %s\n", account, err)
+		return exitAccountsFailed
+	}
+
+	h, err := imap.New(folderPath, mailbox)
+	if err != nil {
+		fmt.Printf("%s: cannot initalize new imap connection: %s\n", account, err)
+		return exitAccountsFailed
+	}
+	defer h.Logout()
+
+	stats, err := h.ForceTags(ctx, syncdb, direction, dryRun)
+
+	side := "server flags"
+	if direction == imap.ForcePull {
+		side = "local tags"
+	}
+	verb := "updated"
+	if dryRun {
+		verb = "would update"
+	}
+	fmt.Printf("%s: compared %d messages, %s %s on %d (%d added, %d removed)\n",
+		account, stats.Messages, verb, side, stats.Changed, stats.Added, stats.Removed)
+
+	if err != nil {
+		fmt.Printf("%s: %s\n", account, err)
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		return exitAccountsFailed
+	}
+	return exitOK
+}
@@ -0,0 +1,106 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// fsckCmd cross-checks the maildir of an account with the notmuch index and the sync database,
+// and optionally repairs the problems that can be fixed safely
+func fsckCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	account := fs.String("account", "", "Account to check")
+	repair := fs.Bool("repair", false, "Fix problems that can be repaired safely")
+	dryRun := fs.Bool("dry-run", false, "With --repair, only show what would be done")
+	fs.Parse(args)
+
+	if *account == "" {
+		fmt.Println("--account must be specified")
+		return exitConfigError
+	}
+
+	env, err := loadEnvironment(*configFile)
+	if err != nil {
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		return exitConfigError
+	}
+
+	_, folderPath, err := env.mailbox(*account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	syncdb, err := env.openSyncDB(ctx, *account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+	defer syncdb.Close()
+
+	problems, err := syncdb.Fsck(ctx, folderPath)
+	if err != nil {
+		fmt.Printf("Cannot check %s: %s\n", *account, err)
+		return exitAccountsFailed
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s: no problems found\n", *account)
+		return exitOK
+	}
+
+	// Print a report grouped by category
+	var kind sync.ProblemKind = -1
+	for _, p := range problems {
+		if p.Kind != kind {
+			kind = p.Kind
+			fmt.Printf("%s:\n", kind)
+		}
+		fmt.Printf("  %s\n", p.Subject)
+	}
+
+	if !*repair {
+		fmt.Printf("%d problems found, run with --repair to fix the ones that can be fixed automatically\n", len(problems))
+		return exitPartial
+	}
+
+	repaired, failed, remaining := 0, 0, 0
+	for _, p := range problems {
+		if !p.Kind.Repairable() {
+			remaining++
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("would %s\n", p.Action())
+			continue
+		}
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+
+		fmt.Printf("%s\n", p.Action())
+		if err := syncdb.Repair(ctx, p); err != nil {
+			fmt.Printf("  failed: %s\n", err)
+			failed++
+			continue
+		}
+		repaired++
+	}
+
+	if *dryRun {
+		fmt.Printf("%d problems would be repaired, %d must be fixed manually\n", len(problems)-remaining, remaining)
+		return exitOK
+	}
+	fmt.Printf("%d problems repaired, %d failed, %d must be fixed manually\n", repaired, failed, remaining)
+	if failed > 0 || remaining > 0 {
+		return exitPartial
+	}
+	return exitOK
+}
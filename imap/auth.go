@@ -0,0 +1,74 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// capLoginDisabled is announced by servers that don't accept the LOGIN command
+const capLoginDisabled = "LOGINDISABLED"
+
+// login logs in with the first mechanism in auth_mechanisms that the server supports,
+// or with the LOGIN command if none are configured
+func (h *Handler) login() error {
+	mechanisms := h.mailbox.AuthMechanisms
+	if len(mechanisms) == 0 {
+		mechanisms = []string{"LOGIN"}
+	}
+
+	for _, mechanism := range mechanisms {
+		mechanism = strings.ToUpper(mechanism)
+		switch {
+		case mechanism == "LOGIN":
+			if !h.caps.Has(capLoginDisabled) {
+				return h.client.Login(h.mailbox.Username, h.mailbox.Password)
+			}
+		case h.caps.Has("AUTH=" + mechanism):
+			return h.client.Authenticate(&saslClient{
+				mechanism: mechanism,
+				username:  h.mailbox.Username,
+				password:  h.mailbox.Password,
+			})
+		}
+	}
+	return fmt.Errorf("the server supports none of the authentication mechanisms %s", strings.Join(mechanisms, ", "))
+}
+
+// saslClient implements the SASL mechanisms PLAIN (RFC 4616) and XOAUTH2,
+// which both send everything in the initial response
+type saslClient struct {
+	mechanism string
+	username  string
+	password  string
+}
+
+// Start returns the mechanism and the initial response
+func (c *saslClient) Start() (string, []byte, error) {
+	switch c.mechanism {
+	case "PLAIN":
+		return c.mechanism, []byte("\x00" + c.username + "\x00" + c.password), nil
+	case "XOAUTH2":
+		return c.mechanism, []byte("user=" + c.username + "\x01auth=Bearer " + c.password + "\x01\x01"), nil
+	}
+	return "", nil, fmt.Errorf("unsupported authentication mechanism %s", c.mechanism)
+}
+
+// Next answers a challenge from the server. Neither mechanism expects one,
+// except for the error details XOAUTH2 sends on failure, which must be answered
+// with an empty response.
+func (c *saslClient) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// throttle waits until throttle_delay has passed since the last time it was called
+func (h *Handler) throttle() {
+	delay := h.mailbox.ThrottleDelay
+	if delay <= 0 {
+		return
+	}
+	if wait := time.Until(h.lastTransfer.Add(delay)); wait > 0 {
+		time.Sleep(wait)
+	}
+	h.lastTransfer = time.Now()
+}
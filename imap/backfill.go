@@ -0,0 +1,106 @@
+package imap
+
+import (
+	"context"
+
+	"github.com/emersion/go-imap"
+	"github.com/schollz/progressbar/v3"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// isNewFolder returns true if we have never fetched anything from mailbox
+func (h *Handler) isNewFolder(mailbox string) bool {
+	_, known := h.cfg.LastSeenUID[mailbox]
+	return !known
+}
+
+// isBackfilling returns true if there are older messages left to fetch from mailbox
+func (h *Handler) isBackfilling(mailbox string) bool {
+	_, ok := h.cfg.BackfillUID[mailbox]
+	return ok
+}
+
+// startBackfill marks every message currently in the selected mailbox as
+// not yet fetched. New messages are then fetched as usual, while the existing
+// messages are fetched newest first by backfill.
+func (h *Handler) startBackfill(mbox *imap.MailboxStatus) error {
+	next := mbox.UidNext
+	if next == 0 {
+		// The server didn't tell us, so we have to find the highest UID ourselves
+		uids, err := h.searchUIDs(0)
+		if err != nil {
+			return err
+		}
+		if len(uids) == 0 {
+			return nil
+		}
+		next = uids[len(uids)-1] + 1
+	}
+
+	h.setLastSeenUID(mbox.Name, next-1)
+	h.cfg.BackfillUID[mbox.Name] = next
+	return h.saveState()
+}
+
+// backfillUIDs returns the UIDs of the older messages in the selected mailbox
+// that should be fetched during this run, in ascending order.
+// If 'complete' is set, no older messages remain once these have been fetched.
+func (h *Handler) backfillUIDs(mailbox string) (uids []uint32, complete bool, err error) {
+	lowest, ok := h.cfg.BackfillUID[mailbox]
+	if !ok {
+		return nil, false, nil
+	}
+	return h.olderUIDs(mailbox, lowest)
+}
+
+// olderUIDs returns the UIDs below 'lowest' in the selected mailbox that should be
+// backfilled during this run, in ascending order, like backfillUIDs.
+func (h *Handler) olderUIDs(mailbox string, lowest uint32) (uids []uint32, complete bool, err error) {
+	if lowest <= 1 {
+		return nil, true, nil
+	}
+
+	uids, err = h.searchFiltered(mailbox, 1, lowest-1)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if batch := h.mailbox.BackfillBatch; batch > 0 && len(uids) > batch {
+		return uids[len(uids)-batch:], false, nil
+	}
+	return uids, true, nil
+}
+
+// backfill fetches the older messages in 'uids' newest first, moving the low watermark
+// of the folder down after each window. Once the folder is 'complete', the watermark is removed.
+func (h *Handler) backfill(ctx context.Context, syncdb *sync.DB, mbox *imap.MailboxStatus, uids []uint32, complete bool, progress *progressbar.ProgressBar) error {
+	mailbox := mbox.Name
+	for end := len(uids); end > 0; end -= fetchWindowSize {
+		start := end - fetchWindowSize
+		if start < 0 {
+			start = 0
+		}
+		window := uids[start:end]
+
+		// A failure within the window leaves the low watermark as is,
+		// so that the whole window is retried on the next run
+		err := h.fetchWindow(ctx, syncdb, mbox, window, progress)
+		if err != nil {
+			return err
+		}
+
+		h.cfg.BackfillUID[mailbox] = window[0]
+		err = h.saveState()
+		if err != nil {
+			return err
+		}
+	}
+
+	if complete {
+		delete(h.cfg.BackfillUID, mailbox)
+		h.stats.Backfilled = append(h.stats.Backfilled, mailbox)
+	} else {
+		h.stats.Backfilling = append(h.stats.Backfilling, mailbox)
+	}
+	return h.saveState()
+}
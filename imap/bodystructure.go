@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// cryptoParts are the MIME types of the parts of multipart/signed and multipart/encrypted
+// messages that only carry a signature or encryption control information.
+// notmuch doesn't treat these as attachments.
+var cryptoParts = map[string]bool{
+	"application/pgp-signature":     true,
+	"application/pkcs7-signature":   true,
+	"application/x-pkcs7-signature": true,
+	"application/pgp-encrypted":     true,
+}
+
+// contentTags returns the tags that notmuch derives from the contents of a message,
+// based on the BODYSTRUCTURE returned by the server.
+// Like notmuch, we add "attachment" if any part is an attachment,
+// and "signed" if the message contains a multipart/signed part.
+// These tags are never synchronized back to the server.
+//
+// We always download whole messages, so notmuch normally adds these tags itself
+// while indexing; contentTags makes sure they're present even if the server's view
+// of the structure differs. There's no headers-only mode that depends on it yet.
+func contentTags(bs *imap.BodyStructure) []string {
+	var attachment, signed bool
+	walkStructure(bs, false, &attachment, &signed)
+
+	var tags []string
+	if attachment {
+		tags = append(tags, "attachment")
+	}
+	if signed {
+		tags = append(tags, "signed")
+	}
+	return tags
+}
+
+// walkStructure checks bs and all its parts for attachments and signatures.
+// 'related' is set if bs is a part of a multipart/related message,
+// where non-text parts are usually inline images.
+func walkStructure(bs *imap.BodyStructure, related bool, attachment *bool, signed *bool) {
+	if bs == nil {
+		return
+	}
+
+	mimeType := strings.ToLower(bs.MIMEType)
+	subType := strings.ToLower(bs.MIMESubType)
+
+	if mimeType == "multipart" {
+		if subType == "signed" {
+			*signed = true
+		}
+		// Without decrypting it, notmuch cannot see what's inside an encrypted part
+		if subType == "encrypted" {
+			return
+		}
+		for _, part := range bs.Parts {
+			walkStructure(part, subType == "related", attachment, signed)
+		}
+		return
+	}
+
+	if cryptoParts[mimeType+"/"+subType] {
+		return
+	}
+
+	switch strings.ToLower(bs.Disposition) {
+	case "attachment":
+		*attachment = true
+	case "inline":
+		// Inline parts are only attachments if they're named
+		if bs.DispositionParams["filename"] != "" {
+			*attachment = true
+		}
+	case "":
+		// Without a disposition, we assume that everything but text is an attachment,
+		// except for the inline images of multipart/related
+		if mimeType != "text" && !related {
+			*attachment = true
+		}
+	}
+
+	// Parts of attached messages count as well
+	if mimeType == "message" && bs.BodyStructure != nil {
+		walkStructure(bs.BodyStructure, false, attachment, signed)
+	}
+}
@@ -0,0 +1,122 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// part returns a single-part body structure
+func part(mimeType, subType, disposition, filename string) *imap.BodyStructure {
+	bs := &imap.BodyStructure{
+		MIMEType:    mimeType,
+		MIMESubType: subType,
+		Disposition: disposition,
+	}
+	if filename != "" {
+		bs.DispositionParams = map[string]string{"filename": filename}
+	}
+	return bs
+}
+
+// multipart returns a multipart body structure containing parts
+func multipart(subType string, parts ...*imap.BodyStructure) *imap.BodyStructure {
+	return &imap.BodyStructure{
+		MIMEType:    "multipart",
+		MIMESubType: subType,
+		Parts:       parts,
+	}
+}
+
+func TestContentTags(t *testing.T) {
+	tests := []struct {
+		name string
+		bs   *imap.BodyStructure
+		want []string
+	}{
+		{
+			name: "plain text",
+			bs:   part("text", "plain", "", ""),
+		},
+		{
+			name: "alternative",
+			bs:   multipart("alternative", part("text", "plain", "", ""), part("text", "html", "", "")),
+		},
+		{
+			name: "attachment",
+			bs:   multipart("mixed", part("text", "plain", "", ""), part("application", "pdf", "attachment", "a.pdf")),
+			want: []string{"attachment"},
+		},
+		{
+			name: "non-text part without disposition",
+			bs:   multipart("mixed", part("text", "plain", "", ""), part("image", "png", "", "")),
+			want: []string{"attachment"},
+		},
+		{
+			name: "nested attachment",
+			bs: multipart("mixed",
+				multipart("alternative",
+					part("text", "plain", "", ""),
+					multipart("related", part("text", "html", "", ""), part("image", "png", "", ""))),
+				multipart("mixed", part("text", "x-patch", "attachment", "fix.patch"))),
+			want: []string{"attachment"},
+		},
+		{
+			name: "inline images of multipart/related",
+			bs: multipart("alternative",
+				part("text", "plain", "", ""),
+				multipart("related", part("text", "html", "", ""), part("image", "png", "", ""), part("image", "gif", "", ""))),
+		},
+		{
+			name: "inline only",
+			bs:   multipart("mixed", part("text", "plain", "inline", ""), part("image", "jpeg", "inline", "")),
+		},
+		{
+			name: "named inline part",
+			bs:   multipart("mixed", part("text", "plain", "inline", ""), part("image", "jpeg", "inline", "photo.jpg")),
+			want: []string{"attachment"},
+		},
+		{
+			name: "pgp signed",
+			bs:   multipart("signed", part("text", "plain", "", ""), part("application", "pgp-signature", "", "")),
+			want: []string{"signed"},
+		},
+		{
+			name: "s/mime signed",
+			bs:   multipart("signed", part("text", "plain", "", ""), part("application", "pkcs7-signature", "attachment", "smime.p7s")),
+			want: []string{"signed"},
+		},
+		{
+			name: "signed with attachment",
+			bs: multipart("signed",
+				multipart("mixed", part("text", "plain", "", ""), part("application", "zip", "attachment", "a.zip")),
+				part("application", "pgp-signature", "attachment", "signature.asc")),
+			want: []string{"attachment", "signed"},
+		},
+		{
+			name: "encrypted",
+			bs:   multipart("encrypted", part("application", "pgp-encrypted", "", ""), part("application", "octet-stream", "inline", "encrypted.asc")),
+		},
+		{
+			name: "attached message",
+			bs: multipart("mixed", part("text", "plain", "", ""), &imap.BodyStructure{
+				MIMEType:      "message",
+				MIMESubType:   "rfc822",
+				Disposition:   "inline",
+				BodyStructure: multipart("signed", part("text", "plain", "", ""), part("application", "pgp-signature", "", "")),
+			}),
+			want: []string{"signed"},
+		},
+		{
+			name: "missing structure",
+		},
+	}
+
+	for _, tt := range tests {
+		got := contentTags(tt.bs)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: contentTags() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
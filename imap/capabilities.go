@@ -0,0 +1,81 @@
+package imap
+
+import (
+	"sort"
+)
+
+// Capabilities that change how we talk to the server
+const (
+	CapStartTLS   = "STARTTLS"
+	CapUIDPlus    = "UIDPLUS"
+	CapMove       = "MOVE"
+	CapIdle       = "IDLE"
+	CapCondStore  = "CONDSTORE"
+	CapSpecialUse = "SPECIAL-USE"
+	CapUTF8       = "UTF8=ACCEPT"
+	CapCompress   = "COMPRESS=DEFLATE"
+	CapGmail      = "X-GM-EXT-1"
+	CapObjectID   = "OBJECTID"
+	CapAnnotate   = "ANNOTATE-EXPERIMENT-1"
+	CapMetadata   = "METADATA"
+)
+
+// Capabilities is the set of capabilities announced by the server
+type Capabilities map[string]bool
+
+// Has returns true if the server announced capability 'name'
+func (c Capabilities) Has(name string) bool {
+	return c[name]
+}
+
+// List returns all announced capabilities in sorted order
+func (c Capabilities) List() []string {
+	list := make([]string, 0, len(c))
+	for name, ok := range c {
+		if ok {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Feature describes a capability-dependant part of nm-imap-sync
+type Feature struct {
+	Capability  string
+	Description string // What the capability is used for
+	Fallback    string // What we do if the server doesn't support it
+}
+
+// Features lists all capabilities that affect how we synchronize
+var Features = []Feature{
+	{CapStartTLS, "upgrade plaintext connections when use_starttls is set", "use_starttls cannot be used"},
+	{CapUIDPlus, "record the UID of messages pushed to the server", "pushed messages are found by searching for their message-id"},
+	{CapMove, "move messages between folders", "not used yet"},
+	{CapIdle, "wait for changes on the server", "not used yet"},
+	{CapCondStore, "fetch only messages with changed flags", "not used yet"},
+	{CapSpecialUse, "detect drafts, sent and trash folders", "special folders are taken from special_use_folders"},
+	{CapUTF8, "use UTF-8 folder names", "not used yet"},
+	{CapCompress, "compress traffic", "not used yet"},
+	{CapGmail, "download messages that have several labels only once", "messages are downloaded once per folder"},
+	{CapObjectID, "recognize moved messages and renamed folders by their object ids", "moved messages are downloaded again, and renamed folders are detected from their contents"},
+	{CapAnnotate, "copy message annotations into notmuch properties when sync_metadata is set", "annotations are not copied"},
+	{CapMetadata, "copy folder metadata into the sync database when sync_metadata is set", "folder metadata is not copied"},
+}
+
+// refreshCapabilities fetches the current capability list from the server.
+// This must be done again whenever the list may have changed, e.g. after
+// STARTTLS or after logging in.
+func (h *Handler) refreshCapabilities() error {
+	caps, err := h.client.Capability()
+	if err != nil {
+		return err
+	}
+	h.caps = Capabilities(caps)
+	return nil
+}
+
+// Capabilities returns the cached capabilities of the server
+func (h *Handler) Capabilities() Capabilities {
+	return h.caps
+}
@@ -0,0 +1,94 @@
+package imap
+
+import (
+	"context"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// isDraftsFolder returns true if folder is the configured drafts folder
+func (h *Handler) isDraftsFolder(folder string) bool {
+	return h.mailbox.DraftsFolder != "" && folder == h.mailbox.DraftsFolder
+}
+
+// removeMessages flags the messages with the given UIDs as \Deleted, and expunges them
+// if the server supports UIDPLUS. Without it we would also expunge every other message
+// that is marked as deleted, so in that case the messages are only flagged.
+// The UIDs are removed from the sync database.
+func (h *Handler) removeMessages(ctx context.Context, syncdb *sync.DB, uids []sync.UID) error {
+	for _, uid := range uids {
+		status, err := h.selectMailbox(uid.FolderName, false)
+		if err != nil {
+			return err
+		}
+
+		// A message from before UIDVALIDITY changed doesn't exist anymore
+		if int(status.UidValidity) == uid.UIDValidity {
+			seqSet := new(imap.SeqSet)
+			seqSet.AddNum(uint32(uid.UID))
+
+			err = h.client.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+			if err != nil {
+				return err
+			}
+
+			if h.caps.Has(CapUIDPlus) {
+				err = h.client.UidPlusClient.UidExpunge(seqSet, nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	messageIDs, err := syncdb.RemoveUIDs(ctx, uids)
+	if err != nil {
+		return err
+	}
+	for _, messageID := range messageIDs {
+		err = h.updateLocation(ctx, syncdb, messageID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// draftCreated removes the previous revision of a draft that has just been uploaded,
+// and records the new revision
+func (h *Handler) draftCreated(ctx context.Context, syncdb *sync.DB, msgUpdate sync.Update, modTime time.Time) error {
+	if msgUpdate.DraftID == "" {
+		return nil
+	}
+
+	if len(msgUpdate.Replaces) > 0 {
+		err := h.removeMessages(ctx, syncdb, msgUpdate.Replaces)
+		if err != nil {
+			return err
+		}
+	}
+	return syncdb.SetDraft(ctx, msgUpdate.DraftID, msgUpdate.MessageID, modTime)
+}
+
+// removedDrafts returns the UIDs in the drafts folder of a message which
+// no longer has the draft tag, i.e. because it has been sent
+func (h *Handler) removedDrafts(msgUpdate sync.Update) []sync.UID {
+	removed := false
+	for _, t := range msgUpdate.RemovedTags {
+		if t == "draft" {
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+
+	var uids []sync.UID
+	for _, uid := range msgUpdate.UIDs {
+		if h.isDraftsFolder(uid.FolderName) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
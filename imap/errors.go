@@ -0,0 +1,116 @@
+package imap
+
+import (
+	"errors"
+	"net"
+
+	"github.com/emersion/go-imap"
+)
+
+// Classes of errors that callers may want to handle differently.
+// Errors returned by the Handler are wrapped in an *Error, so they can be checked with errors.Is.
+var (
+	ErrAuthentication     = errors.New("authentication failed")
+	ErrUnreachable        = errors.New("cannot connect to server")
+	ErrUIDValidityChanged = errors.New("UIDVALIDITY has changed")
+	ErrFolderMissing      = errors.New("folder does not exist on server")
+	ErrQuotaExceeded      = errors.New("quota or message size limit exceeded")
+)
+
+// Error is an error of a known class, see the Err* variables
+type Error struct {
+	Class error // One of the Err* variables
+	Err   error // The underlying error
+}
+
+func (e *Error) Error() string {
+	return e.Class.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the class of e
+func (e *Error) Is(target error) bool {
+	return target == e.Class
+}
+
+// Response codes (RFC 5530 and RFC 7889) sent by servers that refuse to store a message
+const (
+	respCodeOverQuota   imap.StatusRespCode = "OVERQUOTA"
+	respCodeLimit       imap.StatusRespCode = "LIMIT"
+	respCodeTooBig      imap.StatusRespCode = "TOOBIG"
+	respCodeNonExistent imap.StatusRespCode = "NONEXISTENT"
+)
+
+// statusCode returns the response code of err, if it's a NO or BAD response from the server
+// returned by execute
+func statusCode(err error) (imap.StatusRespCode, bool) {
+	var statusErr *imap.ErrStatusResp
+	if !errors.As(err, &statusErr) || statusErr.Resp == nil {
+		return "", false
+	}
+	return statusErr.Resp.Code, true
+}
+
+// execute runs cmd, and returns NO and BAD responses as an *imap.ErrStatusResp.
+// The methods of client.Client only return the text of such a response,
+// which loses the response code.
+func (c *Client) execute(cmd imap.Commander) (*imap.StatusResp, error) {
+	status, err := c.Client.Execute(cmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status.Type == imap.StatusRespNo || status.Type == imap.StatusRespBad {
+		return nil, &imap.ErrStatusResp{Resp: status}
+	}
+	return status, nil
+}
+
+// refused returns true if err is a NO or BAD response from the server, rather than a
+// connection problem. Commands that change the state of the client, such as LOGIN and SELECT,
+// can't be run through execute, so their responses are recognized by the connection still being open.
+func (c *Client) refused(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := statusCode(err); ok {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return false
+	}
+	select {
+	case <-c.LoggedOut():
+		return false
+	default:
+		return true
+	}
+}
+
+// appendError classifies an error returned by appendMessage
+func appendError(err error) error {
+	if code, ok := statusCode(err); ok {
+		switch code {
+		case respCodeOverQuota, respCodeLimit, respCodeTooBig:
+			return &Error{Class: ErrQuotaExceeded, Err: err}
+		case respCodeNonExistent:
+			return &Error{Class: ErrFolderMissing, Err: err}
+		}
+	}
+	return err
+}
+
+// selectError classifies an error returned when selecting a mailbox.
+// The response code is lost, see refused, but servers don't always include
+// one either, and refusing to select a mailbox that we know the name of
+// usually means that it's gone.
+func (c *Client) selectError(err error) error {
+	if code, _ := statusCode(err); c.refused(err) && (code == respCodeNonExistent || code == "") {
+		return &Error{Class: ErrFolderMissing, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewAuthenticationFailed(t *testing.T) {
+	s := newFakeServer(t, func(command, args string) ([]string, string) {
+		if command == "LOGIN" {
+			return nil, "NO [AUTHENTICATIONFAILED] invalid credentials"
+		}
+		return nil, ""
+	})
+
+	_, err := New(tempDir(t), s.mailbox())
+	if !errors.Is(err, ErrAuthentication) {
+		t.Errorf("New() = %v, want %v", err, ErrAuthentication)
+	}
+}
+
+func TestNewUnreachable(t *testing.T) {
+	// Nothing listens on the port once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	mailbox := (&fakeServer{t: t, listener: listener}).mailbox()
+
+	_, err = New(tempDir(t), mailbox)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("New() = %v, want %v", err, ErrUnreachable)
+	}
+	if errors.Is(err, ErrAuthentication) {
+		t.Errorf("New() = %v, which must not be an authentication error", err)
+	}
+}
+
+func TestSelectError(t *testing.T) {
+	s := newFakeServer(t, func(command, args string) ([]string, string) {
+		if command == "SELECT" {
+			return nil, "NO [NONEXISTENT] no such mailbox"
+		}
+		return nil, ""
+	})
+	h := s.connect(tempDir(t), s.mailbox())
+
+	_, err := h.selectMailbox("Missing", false)
+	if !errors.Is(err, ErrFolderMissing) {
+		t.Errorf("selectMailbox() = %v, want %v", err, ErrFolderMissing)
+	}
+}
+
+func TestAppendMessage(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          string
+		wantErr         error
+		wantUIDValidity uint32
+		wantUID         uint32
+	}{
+		{
+			name:            "uidplus",
+			status:          "OK [APPENDUID 38505 3955] APPEND completed",
+			wantUIDValidity: 38505,
+			wantUID:         3955,
+		},
+		{
+			name:   "without uidplus",
+			status: "OK APPEND completed",
+		},
+		{
+			name:    "over quota",
+			status:  "NO [OVERQUOTA] quota exceeded",
+			wantErr: ErrQuotaExceeded,
+		},
+		{
+			name:    "too big",
+			status:  "NO [TOOBIG] message too large",
+			wantErr: ErrQuotaExceeded,
+		},
+		{
+			name:    "missing folder",
+			status:  "NO [NONEXISTENT] no such mailbox",
+			wantErr: ErrFolderMissing,
+		},
+	}
+
+	for _, tt := range tests {
+		s := newFakeServer(t, func(command, args string) ([]string, string) {
+			if command == "APPEND" {
+				return nil, tt.status
+			}
+			return nil, ""
+		})
+		h := s.connect(tempDir(t), s.mailbox())
+
+		uidValidity, uid, err := h.client.appendMessage("INBOX", nil, time.Now(), bytes.NewBufferString("Subject: test\r\n\r\n"))
+		if err = appendError(err); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: appendMessage() = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if uidValidity != tt.wantUIDValidity || uid != tt.wantUID {
+			t.Errorf("%s: appendMessage() = UID %d:%d, want %d:%d", tt.name, uidValidity, uid, tt.wantUIDValidity, tt.wantUID)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package imap
+
+import (
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// messageIDIndexThreshold is the number of messages created in a single folder after
+// which we fetch the message ids of all messages in the folder at once,
+// instead of searching for each new message separately
+const messageIDIndexThreshold = 50
+
+// isGeneratedMessageID returns true if messageID was generated by notmuch,
+// because the message doesn't have a Message-ID header. These can't be searched for.
+func isGeneratedMessageID(messageID string) bool {
+	return messageID == "" || strings.HasPrefix(messageID, "notmuch-sha1-")
+}
+
+// findExisting looks for a message with the given message id in folder,
+// and returns its UID, or 0 if no such message exists.
+// This is used to avoid uploading a message again if a previous
+// run appended it, but couldn't record its UID.
+func (h *Handler) findExisting(folder string, messageID string) (uint32, error) {
+	if isGeneratedMessageID(messageID) {
+		return 0, nil
+	}
+
+	if h.createdInFolder == nil {
+		h.createdInFolder = make(map[string]int)
+	}
+	h.createdInFolder[folder]++
+
+	if index, ok := h.messageIDIndex[folder]; ok {
+		uid := index[messageID]
+		if uid != 0 {
+			// Another folder may have been selected since the index was built,
+			// and the caller stores tags on the message
+			_, err := h.selectMailbox(folder, false)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return uid, nil
+	}
+
+	if h.createdInFolder[folder] > messageIDIndexThreshold {
+		index, err := h.indexMessageIDs(folder)
+		if err != nil {
+			return 0, err
+		}
+		return index[messageID], nil
+	}
+
+	return h.searchMessageID(folder, messageID)
+}
+
+// searchMessageID searches folder for a message with the given message id,
+// and returns its UID, or 0 if no such message exists
+func (h *Handler) searchMessageID(folder string, messageID string) (uint32, error) {
+	_, err := h.selectMailbox(folder, false)
+	if err != nil {
+		return 0, err
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header = textproto.MIMEHeader{"Message-Id": {"<" + messageID + ">"}}
+	uids, err := h.client.UidSearch(criteria)
+	if err != nil {
+		return 0, err
+	}
+
+	// If there are several copies, the latest one is used
+	var found uint32
+	for _, uid := range uids {
+		if uid > found {
+			found = uid
+		}
+	}
+	return found, nil
+}
+
+// indexMessageIDs fetches the message id of every message in folder,
+// and keeps them for subsequent calls to findExisting
+func (h *Handler) indexMessageIDs(folder string) (map[string]uint32, error) {
+	_, err := h.selectMailbox(folder, false)
+	if err != nil {
+		return nil, err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+
+	ids, err := h.fetchMessageIDs(seqSet)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]uint32)
+	for uid, messageID := range ids {
+		if uid > index[messageID] {
+			index[messageID] = uid
+		}
+	}
+
+	if h.messageIDIndex == nil {
+		h.messageIDIndex = make(map[string]map[string]uint32)
+	}
+	h.messageIDIndex[folder] = index
+	return index, nil
+}
+
+// fetchMessageIDs returns the message ids of the messages in seqSet in the selected mailbox,
+// by UID. Messages without a Message-ID header are left out.
+func (h *Handler) fetchMessageIDs(seqSet *imap.SeqSet) (map[uint32]string, error) {
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.client.UidFetch(seqSet, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}, messages)
+	}()
+
+	ids := make(map[uint32]string)
+	for msg := range messages {
+		if msg == nil || msg.Envelope == nil {
+			continue
+		}
+		if messageID := envelopeMessageID(msg.Envelope); messageID != "" {
+			ids[msg.Uid] = messageID
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// envelopeMessageID returns the message id in envelope, in the form notmuch uses
+func envelopeMessageID(envelope *imap.Envelope) string {
+	messageID := strings.TrimSpace(envelope.MessageId)
+	return strings.TrimSuffix(strings.TrimPrefix(messageID, "<"), ">")
+}
+
+// recordCreated adds a newly appended message to the message id index of folder
+func (h *Handler) recordCreated(folder string, messageID string, uid uint32) {
+	if index, ok := h.messageIDIndex[folder]; ok && !isGeneratedMessageID(messageID) {
+		index[messageID] = uid
+	}
+}
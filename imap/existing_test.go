@@ -0,0 +1,38 @@
+package imap
+
+import "testing"
+
+func TestFindExistingIndexed(t *testing.T) {
+	store := newFakeStore()
+	store.add("INBOX", fakeMail{uid: 1, messageID: "inbox@example.com"})
+	store.add("Sent", fakeMail{uid: 7, messageID: "sent@example.com"})
+	s := store.server(t)
+	h := s.connect(tempDir(t), s.mailbox())
+
+	// Sent was indexed, and INBOX has been selected since
+	_, err := h.indexMessageIDs("Sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.selectMailbox("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid, err := h.findExisting("Sent", "sent@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != 7 {
+		t.Errorf("findExisting() = %d, want 7", uid)
+	}
+
+	// The caller works on the message in the selected mailbox
+	mbox := h.client.Mailbox()
+	if mbox == nil || mbox.Name != "Sent" {
+		t.Fatalf("selected mailbox is %v after finding a message in Sent", mbox)
+	}
+	if int(mbox.UidValidity) != store.uidValidity("Sent") {
+		t.Errorf("UIDVALIDITY = %d, want %d", mbox.UidValidity, store.uidValidity("Sent"))
+	}
+}
@@ -0,0 +1,519 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/schollz/progressbar/v3"
+	"github.com/yzzyx/nm-imap-sync/config"
+	"github.com/yzzyx/nm-imap-sync/sync"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// fakeHandler answers a command sent to a fakeServer. It returns the untagged
+// responses, including the leading "* ", and the tagged status such as "OK done".
+// An empty status falls back to the default responses, see fakeDefault.
+type fakeHandler func(command, args string) (untagged []string, status string)
+
+// fakeServer is an IMAP server listening on localhost that answers commands
+// with canned responses, so that the Handler can be tested without a real server
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+	handle   fakeHandler
+
+	// commands contains every command that has been received, as "COMMAND args"
+	commands chan string
+}
+
+// newFakeServer starts a fake server, which is stopped when the test ends
+func newFakeServer(t *testing.T, handle fakeHandler) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start fake server: %v", err)
+	}
+	s := &fakeServer{
+		t:        t,
+		listener: listener,
+		handle:   handle,
+		commands: make(chan string, 1000),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// tempDir returns a temporary directory that is removed when the test ends
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "nm-imap-sync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// mailbox returns a configuration that connects to the server
+func (s *fakeServer) mailbox() config.Mailbox {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return config.Mailbox{
+		Server:   addr.IP.String(),
+		Port:     addr.Port,
+		Username: "user",
+		Password: "secret",
+		StateDir: tempDir(s.t),
+	}
+}
+
+// connect returns a Handler that is logged in to the server with the configuration
+// in mailbox, see fakeServer.mailbox
+func (s *fakeServer) connect(maildirPath string, mailbox config.Mailbox) *Handler {
+	s.t.Helper()
+	h, err := New(maildirPath, mailbox)
+	if err != nil {
+		s.t.Fatalf("cannot connect to fake server: %v", err)
+	}
+	s.t.Cleanup(func() { h.client.Logout() })
+	return h
+}
+
+// received returns the commands received so far
+func (s *fakeServer) received() []string {
+	var commands []string
+	for {
+		select {
+		case cmd := <-s.commands:
+			commands = append(commands, cmd)
+		default:
+			return commands
+		}
+	}
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "* OK [CAPABILITY IMAP4rev1] fake server ready\r\n")
+
+	for {
+		line, err := s.readCommand(conn, r)
+		if err != nil {
+			return
+		}
+
+		tag, rest := splitWord(line)
+		command, args := splitWord(rest)
+		command = strings.ToUpper(command)
+		if command == "UID" {
+			var sub string
+			sub, args = splitWord(args)
+			command += " " + strings.ToUpper(sub)
+		}
+		s.commands <- strings.TrimSpace(command + " " + args)
+
+		var untagged []string
+		var status string
+		if s.handle != nil {
+			untagged, status = s.handle(command, args)
+		}
+		if status == "" {
+			untagged, status = fakeDefault(command)
+		}
+		for _, u := range untagged {
+			fmt.Fprintf(conn, "%s\r\n", u)
+		}
+		fmt.Fprintf(conn, "%s %s\r\n", tag, status)
+		if command == "LOGOUT" {
+			return
+		}
+	}
+}
+
+// splitWord splits s at the first space
+func splitWord(s string) (string, string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// readCommand reads a complete command line, including any literals
+func (s *fakeServer) readCommand(conn net.Conn, r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		// A literal is announced with {size} or {size+} at the end of the line
+		size, nonSync, ok := literalSize(line)
+		if !ok {
+			sb.WriteString(line)
+			return sb.String(), nil
+		}
+		sb.WriteString(line[:strings.LastIndexByte(line, '{')])
+		if !nonSync {
+			fmt.Fprintf(conn, "+ go ahead\r\n")
+		}
+		literal := make([]byte, size)
+		if _, err = io.ReadFull(r, literal); err != nil {
+			return "", err
+		}
+		sb.Write(literal)
+	}
+}
+
+// literalSize returns the size of the literal announced at the end of line
+func literalSize(line string) (size int, nonSync bool, ok bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	start := strings.LastIndexByte(line, '{')
+	if start < 0 {
+		return 0, false, false
+	}
+	spec := line[start+1 : len(line)-1]
+	if strings.HasSuffix(spec, "+") {
+		nonSync = true
+		spec = strings.TrimSuffix(spec, "+")
+	}
+	size, err := strconv.Atoi(spec)
+	if err != nil {
+		return 0, false, false
+	}
+	return size, nonSync, true
+}
+
+// fakeDefault returns the responses for commands the test doesn't handle itself
+func fakeDefault(command string) ([]string, string) {
+	switch command {
+	case "CAPABILITY":
+		return []string{"* CAPABILITY IMAP4rev1"}, "OK CAPABILITY completed"
+	case "LOGIN", "NOOP", "CLOSE":
+		return nil, "OK " + command + " completed"
+	case "LOGOUT":
+		return []string{"* BYE logging out"}, "OK LOGOUT completed"
+	}
+	return nil, "BAD unexpected command " + command
+}
+
+// fakeMail is a message stored on a fakeStore
+type fakeMail struct {
+	uid       uint32
+	flags     []string
+	messageID string
+	emailID   string
+}
+
+// body returns the complete message
+func (m fakeMail) body() string {
+	return "Message-ID: <" + m.messageID + ">\r\nSubject: test\r\n\r\nTest message\r\n"
+}
+
+// fakeFolder is a folder on a fakeStore
+type fakeFolder struct {
+	uidValidity uint32
+	uidNext     uint32
+	mailboxID   string
+	attributes  []string // Attributes returned by LIST, i.e. \Noselect
+	mails       []fakeMail
+}
+
+// fakeStore keeps the folders and messages of a fake server, and answers the
+// commands that read them. Other commands are left to the defaults, see fakeDefault.
+// The store may be changed between commands by calling its methods.
+type fakeStore struct {
+	mu       gosync.Mutex
+	caps     []string
+	folders  map[string]*fakeFolder
+	selected string
+}
+
+// newFakeStore returns a store supporting the capabilities caps
+func newFakeStore(caps ...string) *fakeStore {
+	return &fakeStore{
+		caps:    caps,
+		folders: make(map[string]*fakeFolder),
+	}
+}
+
+// add stores mails in folder, which is created if it doesn't exist
+func (s *fakeStore) add(folder string, mails ...fakeMail) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.folders[folder]
+	if !ok {
+		// Every folder gets its own UIDVALIDITY, like on most servers
+		f = &fakeFolder{
+			uidValidity: uint32(1000 + len(s.folders)),
+			uidNext:     1,
+			mailboxID:   "M" + folder,
+		}
+		s.folders[folder] = f
+	}
+	for _, m := range mails {
+		if m.uid >= f.uidNext {
+			f.uidNext = m.uid + 1
+		}
+	}
+	f.mails = append(f.mails, mails...)
+}
+
+// move moves the message with uid from one folder to another, where it gets a new UID
+func (s *fakeStore) move(from string, uid uint32, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src := s.folders[from]
+	for i, m := range src.mails {
+		if m.uid != uid {
+			continue
+		}
+		src.mails = append(src.mails[:i], src.mails[i+1:]...)
+		dst := s.folders[to]
+		m.uid = dst.uidNext
+		dst.uidNext++
+		dst.mails = append(dst.mails, m)
+		return
+	}
+}
+
+// setFlags replaces the flags of the message with uid in folder
+func (s *fakeStore) setFlags(folder string, uid uint32, flags ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.folders[folder]
+	for i := range f.mails {
+		if f.mails[i].uid == uid {
+			f.mails[i].flags = flags
+		}
+	}
+}
+
+// uidValidity returns the UIDVALIDITY of folder
+func (s *fakeStore) uidValidity(folder string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.folders[folder].uidValidity)
+}
+
+// server starts a fake server for the store
+func (s *fakeStore) server(t *testing.T) *fakeServer {
+	return newFakeServer(t, s.handle)
+}
+
+// handle answers a command, or returns an empty status if the command is not handled
+func (s *fakeStore) handle(command, args string) ([]string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch command {
+	case "CAPABILITY":
+		return []string{"* CAPABILITY " + strings.Join(append([]string{"IMAP4rev1"}, s.caps...), " ")}, "OK CAPABILITY completed"
+	case "LIST":
+		var untagged []string
+		for _, name := range s.sortedFolders() {
+			f := s.folders[name]
+			untagged = append(untagged, fmt.Sprintf("* LIST (%s) \"/\" %q", strings.Join(f.attributes, " "), name))
+		}
+		return untagged, "OK LIST completed"
+	case "SELECT", "EXAMINE":
+		name := unquote(args)
+		f, ok := s.folders[name]
+		if !ok {
+			s.selected = ""
+			return nil, "NO [NONEXISTENT] no such mailbox"
+		}
+		for _, attr := range f.attributes {
+			if strings.EqualFold(attr, imap.NoSelectAttr) || strings.EqualFold(attr, "\\NonExistent") {
+				s.selected = ""
+				return nil, "NO [CANNOT] mailbox cannot be selected"
+			}
+		}
+		s.selected = name
+		access := "READ-WRITE"
+		if command == "EXAMINE" {
+			access = "READ-ONLY"
+		}
+		return []string{
+			"* FLAGS (\\Seen \\Answered \\Flagged \\Deleted \\Draft)",
+			fmt.Sprintf("* %d EXISTS", len(f.mails)),
+			"* 0 RECENT",
+			fmt.Sprintf("* OK [UIDVALIDITY %d] UIDs valid", f.uidValidity),
+			fmt.Sprintf("* OK [UIDNEXT %d] predicted next UID", f.uidNext),
+		}, "OK [" + access + "] " + command + " completed"
+	case "STATUS":
+		name, _ := splitQuoted(args)
+		f, ok := s.folders[name]
+		if !ok {
+			return nil, "NO [NONEXISTENT] no such mailbox"
+		}
+		return []string{fmt.Sprintf("* STATUS %q (MESSAGES %d UIDNEXT %d UIDVALIDITY %d MAILBOXID (%s))",
+			name, len(f.mails), f.uidNext, f.uidValidity, f.mailboxID)}, "OK STATUS completed"
+	case "UID SEARCH":
+		return s.search(args)
+	case "UID FETCH":
+		return s.fetch(args)
+	}
+	return nil, ""
+}
+
+// search answers UID SEARCH [CHARSET x] UID <set> [criteria], where criteria is ignored
+func (s *fakeStore) search(args string) ([]string, string) {
+	f, ok := s.folders[s.selected]
+	if !ok {
+		return nil, "BAD no mailbox selected"
+	}
+	fields := strings.Fields(args)
+	var set *imap.SeqSet
+	for i := 0; i < len(fields)-1; i++ {
+		if strings.ToUpper(fields[i]) == "UID" {
+			var err error
+			if set, err = imap.ParseSeqSet(fields[i+1]); err != nil {
+				return nil, "BAD " + err.Error()
+			}
+		}
+	}
+
+	found := "* SEARCH"
+	for _, m := range f.mails {
+		if set == nil || set.Contains(m.uid) {
+			found += fmt.Sprintf(" %d", m.uid)
+		}
+	}
+	return []string{found}, "OK SEARCH completed"
+}
+
+// fetch answers UID FETCH <set> (items)
+func (s *fakeStore) fetch(args string) ([]string, string) {
+	f, ok := s.folders[s.selected]
+	if !ok {
+		return nil, "BAD no mailbox selected"
+	}
+	setArg, items := splitWord(args)
+	set, err := imap.ParseSeqSet(setArg)
+	if err != nil {
+		return nil, "BAD " + err.Error()
+	}
+	items = strings.ToUpper(strings.Trim(items, "()"))
+
+	var untagged []string
+	for i, m := range f.mails {
+		if !set.Contains(m.uid) {
+			continue
+		}
+		values := []string{fmt.Sprintf("UID %d", m.uid)}
+		for _, item := range strings.Fields(items) {
+			switch item {
+			case "FLAGS":
+				values = append(values, "FLAGS ("+strings.Join(m.flags, " ")+")")
+			case "EMAILID":
+				if m.emailID != "" {
+					values = append(values, "EMAILID ("+m.emailID+")")
+				}
+			case "ENVELOPE":
+				values = append(values, fmt.Sprintf("ENVELOPE (NIL \"test\" NIL NIL NIL NIL NIL NIL NIL \"<%s>\")", m.messageID))
+			case "BODYSTRUCTURE":
+				values = append(values, fmt.Sprintf("BODYSTRUCTURE (\"text\" \"plain\" (\"charset\" \"us-ascii\") NIL NIL \"7bit\" %d 1)", len(m.body())))
+			case "BODY.PEEK[]":
+				values = append(values, fmt.Sprintf("BODY[] {%d}\r\n%s", len(m.body()), m.body()))
+			}
+		}
+		untagged = append(untagged, fmt.Sprintf("* %d FETCH (%s)", i+1, strings.Join(values, " ")))
+	}
+	return untagged, "OK FETCH completed"
+}
+
+// sortedFolders returns the names of all folders in alphabetical order
+func (s *fakeStore) sortedFolders() []string {
+	names := make([]string, 0, len(s.folders))
+	for name := range s.folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unquote returns s without surrounding quotes
+func unquote(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// splitQuoted splits s after its first word, which may be quoted
+func splitQuoted(s string) (string, string) {
+	if strings.HasPrefix(s, "\"") {
+		if end := strings.Index(s[1:], "\""); end >= 0 {
+			return s[1 : end+1], strings.TrimSpace(s[end+2:])
+		}
+	}
+	return splitWord(s)
+}
+
+// newTestDB returns a sync database, using a notmuch database in maildirPath
+func newTestDB(t *testing.T, maildirPath string) *sync.DB {
+	t.Helper()
+	syncdb, err := sync.New(context.Background(), maildirPath, filepath.Join(tempDir(t), "sync.db"))
+	if err != nil {
+		t.Fatalf("cannot create sync database: %v", err)
+	}
+	t.Cleanup(syncdb.Close)
+	return syncdb
+}
+
+// storeLocal stores m in folder in the maildir, and adds it to notmuch
+func storeLocal(t *testing.T, syncdb *sync.DB, maildirPath string, folder string, m fakeMail) {
+	t.Helper()
+	dir := filepath.Join(maildirPath, folder, "cur")
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s:2,S", m.messageID))
+	err = ioutil.WriteFile(path, []byte(m.body()), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syncdb.WrapRW(func(db *notmuch.DB) error {
+		msg, err := db.AddMessage(path)
+		if err != nil {
+			return err
+		}
+		return msg.Close()
+	})
+	if err != nil {
+		t.Fatalf("cannot add %s to notmuch: %v", path, err)
+	}
+}
+
+// discardProgress returns a progress bar that isn't shown
+func discardProgress() *progressbar.ProgressBar {
+	return progressbar.NewOptions(0, progressbar.OptionSetWriter(ioutil.Discard))
+}
@@ -9,7 +9,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -18,51 +18,112 @@ import (
 	notmuch "github.com/zenhack/go.notmuch"
 )
 
-// getMessage downloads a message from the server from a mailbox, and stores it in a maildir
-func (h *Handler) getMessage(syncdb *sync.DB, mailbox string, uid uint32) error {
-	// Select INBOX
-	mailboxInfo, err := h.client.Select(mailbox, false)
+// fetchTimeout is the maximum time we wait for a single message fetch to complete
+var fetchTimeout = 10 * time.Minute
+
+// fetchOne runs fetch and expects it to deliver exactly one message.
+// The message channel is always drained, and the result of fetch is always
+// collected, so that a misbehaving server cannot leave the fetch goroutine blocked.
+// If fetch doesn't complete within timeout, an error is returned.
+func fetchOne(fetch func(chan *imap.Message) error, timeout time.Duration) (*imap.Message, error) {
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- fetch(messages)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var msg *imap.Message
+	count := 0
+	for messages != nil {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				messages = nil
+				break
+			}
+			if m == nil {
+				continue
+			}
+			if msg == nil {
+				msg = m
+			}
+			count++
+		case <-timer.C:
+			// Make sure the fetch goroutine doesn't block on a full channel
+			go func(messages chan *imap.Message) {
+				for range messages {
+				}
+			}(messages)
+			return nil, errors.New("timed out waiting for server to return message")
+		}
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-timer.C:
+		return nil, errors.New("timed out waiting for server to complete fetch")
+	}
+
+	if count == 0 {
+		return nil, errors.New("Server didn't return message")
+	}
+	if count > 1 {
+		return nil, fmt.Errorf("server returned %d messages when fetching a single UID", count)
+	}
+	return msg, nil
+}
+
+// getMessage downloads a message from the server from a mailbox, and stores it in a maildir.
+// The path to the new file is returned. If notmuch already has a message with the same
+// message id, the new file is removed again and an empty path is returned, unless
+// keepDuplicate is set.
+func (h *Handler) getMessage(ctx context.Context, syncdb *sync.DB, mailbox string, uid uint32, keepDuplicate bool) (string, error) {
+	mailboxInfo, err := h.selectMailbox(mailbox, true)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Download whole body
 	section := &imap.BodySectionName{
 		Peek: true, // Do not update seen-flags
 	}
-	items := []imap.FetchItem{section.FetchItem(), imap.FetchFlags}
+	items := h.fetchItems(section.FetchItem(), imap.FetchFlags, imap.FetchBodyStructure)
+	if h.syncsAnnotations() {
+		items = append(items, fetchAnnotation)
+	}
 	seqSet := new(imap.SeqSet)
 	seqSet.AddNum(uid)
 
-	messages := make(chan *imap.Message)
-	done := make(chan error)
-	go func() {
-		done <- h.client.UidFetch(seqSet, items, messages)
-	}()
-
-	msg := <-messages
-	if msg == nil {
-		return errors.New("Server didn't return message")
+	h.throttle()
+	msg, err := fetchOne(func(messages chan *imap.Message) error {
+		return h.client.UidFetch(seqSet, items, messages)
+	}, fetchTimeout)
+	if err != nil {
+		return "", err
 	}
 
 	r := msg.GetBody(section)
 	if r == nil {
-		return errors.New("Server didn't return message body")
-	}
-
-	err = <-done
-	if err != nil {
-		return err
+		return "", errors.New("Server didn't return message body")
 	}
 
 	md5hash := md5.New()
 	tmpFilename := fmt.Sprintf("%d_%d.%d.%s,U=%d", time.Now().Unix(), <-h.seqNumChan, h.processID, h.hostname, uid)
-	mailboxPath := filepath.Join(h.maildirPath, mailbox)
+	mailboxPath, err := h.folderPath(ctx, syncdb, mailbox)
+	if err != nil {
+		return "", err
+	}
 	tmpPath := filepath.Join(mailboxPath, "tmp", tmpFilename)
 
 	fd, err := os.Create(tmpPath)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	multiwriter := io.MultiWriter(fd, md5hash)
@@ -71,7 +132,7 @@ func (h *Handler) getMessage(syncdb *sync.DB, mailbox string, uid uint32) error
 		// Perform cleanup
 		_ = fd.Close()
 		_ = os.Remove(tmpPath)
-		return err
+		return "", err
 	}
 	_ = fd.Close()
 
@@ -82,7 +143,7 @@ func (h *Handler) getMessage(syncdb *sync.DB, mailbox string, uid uint32) error
 	if err != nil {
 		// Could not rename file - discard old entry to avoid duplicates
 		_ = os.Remove(tmpPath)
-		return err
+		return "", err
 	}
 
 	/*
@@ -96,10 +157,13 @@ func (h *Handler) getMessage(syncdb *sync.DB, mailbox string, uid uint32) error
 	imapFlags, _ := h.translateFlags(msg.Flags)
 
 	var messageID string
+	var summary sync.Summary
+	var duplicate bool
 	err = syncdb.WrapRW(func(db *notmuch.DB) error {
 		// Add file to index
 		m, err := db.AddMessage(newPath)
-		if err != nil && !errors.Is(err, notmuch.ErrDuplicateMessageID) {
+		duplicate = errors.Is(err, notmuch.ErrDuplicateMessageID)
+		if err != nil && !duplicate {
 			return err
 		}
 		defer m.Close()
@@ -108,8 +172,26 @@ func (h *Handler) getMessage(syncdb *sync.DB, mailbox string, uid uint32) error
 		// we had to generate one
 		messageID = m.ID()
 
-		if errors.Is(err, notmuch.ErrDuplicateMessageID) {
-			// If this is a duplicate message, we return here and update our index
+		if h.mailbox.StoresHeaders() {
+			summary = sync.NewSummary(m.Header("From"), m.Header("Subject"), m.Header("Date"))
+		}
+
+		if tag := h.mailbox.FolderTag(mailbox); tag != "" {
+			err := m.AddTag(tag)
+			if err != nil {
+				return err
+			}
+		}
+
+		if duplicate {
+			// If this is a duplicate message, we return here and update our index.
+			// The new copy is only kept if it's going to replace the old files.
+			if !keepDuplicate {
+				err = db.RemoveMessage(newPath)
+				if err != nil && !errors.Is(err, notmuch.ErrDuplicateMessageID) {
+					return err
+				}
+			}
 			return nil
 		}
 
@@ -120,42 +202,50 @@ func (h *Handler) getMessage(syncdb *sync.DB, mailbox string, uid uint32) error
 			}
 		}
 
-		// Make a copy of our current flag-set,
-		// since we need to store the current state in our sync database,
-		// but still want to keep track of duplicates
-		currentFlags := make(map[string]bool, len(imapFlags))
-		for f, v := range imapFlags {
-			currentFlags[f] = v
+		err = setAnnotations(m, annotations(msg))
+		if err != nil {
+			return err
 		}
 
-		// Add additional tags specified in config file
-		if extraTags, ok := h.mailbox.FolderTags[mailbox]; ok {
-			for _, tag := range strings.Split(extraTags, ",") {
-				tag = strings.TrimSpace(tag)
-				if strings.HasPrefix(tag, "-") {
-					// Only remove tag if we have it
-					tag := tag[1:]
-					if hasFlag := currentFlags[tag]; hasFlag {
-						err = m.RemoveTag(tag)
-						delete(currentFlags, tag)
-					}
-				} else {
-					if hasFlag := currentFlags[tag]; !hasFlag {
-						err = m.AddTag(tag)
-						currentFlags[tag] = true
-					}
-				}
+		// Tags inherited from the thread are recorded as if they were set on
+		// the server, unless thread_tag_push is set
+		err = h.inheritThreadTags(m, imapFlags, func(tag string) (bool, error) {
+			return threadHasTag(db, m, tag)
+		})
+		if err != nil {
+			return err
+		}
 
-				if err != nil {
-					return err
-				}
+		// Content-based tags are normally added by notmuch while indexing,
+		// but we make sure they match what the server reports. They're not
+		// part of the flags stored in the sync-db, and are never pushed to the server.
+		for _, tag := range contentTags(msg.BodyStructure) {
+			err = m.AddTag(tag)
+			if err != nil {
+				return err
 			}
 		}
+
+		// Add additional tags specified in config file
+		err = h.applyFolderTags(m, mailbox)
+		if err != nil {
+			return err
+		}
+
+		h.recordNewMail(m, mailbox)
 		return nil
 	})
 
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if duplicate && !keepDuplicate {
+		err = os.Remove(newPath)
+		if err != nil {
+			return "", err
+		}
+		newPath = ""
 	}
 
 	flagSlice := make([]string, 0, len(imapFlags))
@@ -165,76 +255,329 @@ func (h *Handler) getMessage(syncdb *sync.DB, mailbox string, uid uint32) error
 	// The flags in `imapFlags` already exist on the server,
 	// so we add these to our sync-db. Any additional flags will then
 	// be synchronized to the IMAP server on the next run
-	err = syncdb.AddMessageSyncInfo(sync.MessageInfo{
-		MessageID: messageID,
+	err = syncdb.AddMessageSyncInfo(ctx, sync.MessageInfo{
+		MessageID:      messageID,
+		Summary:        summary,
+		GmailMessageID: gmailMessageID(msg),
+		EmailID:        emailID(msg),
 		UIDs: []sync.UID{{
 			FolderName:  mailboxInfo.Name,
 			UIDValidity: int(mailboxInfo.UidValidity),
 			UID:         int(uid),
 		}},
 	}, flagSlice)
-	return err
+	if err != nil {
+		return "", err
+	}
+	return newPath, h.updateProperties(ctx, syncdb, messageID)
 }
 
-// mailboxFetchMessages checks for any new messages in mailbox
-func (h *Handler) mailboxFetchMessages(ctx context.Context, syncdb *sync.DB, mailbox string, fullSync bool) error {
-	mbox, err := h.client.Select(mailbox, false)
+// fetchWindowSize is the number of messages that are classified and
+// downloaded at a time, before the UID watermark is checkpointed
+const fetchWindowSize = 1000
+
+// mailboxFetchMessages checks for any new messages in mailbox.
+// 'estimate' is the number of messages that was included in the maximum of progress
+// for this mailbox, which is adjusted once the actual number is known.
+func (h *Handler) mailboxFetchMessages(ctx context.Context, syncdb *sync.DB, mailbox string, fullSync bool, progress *progressbar.ProgressBar, estimate int) error {
+	mbox, err := h.selectMailbox(mailbox, true)
 	if err != nil {
 		return err
 	}
 
 	if mbox.Messages == 0 {
+		progress.ChangeMax(progress.GetMax() - estimate)
+		// Every message we knew of in the folder has been moved or removed
+		if h.mailbox.AutoFolderTags {
+			return h.forgetVanished(ctx, syncdb, mailbox, mbox.UidValidity, nil)
+		}
 		return nil
 	}
 
-	// Search for new UID's
-	seqSet := new(imap.SeqSet)
+	// If the UIDs on the server have been reset, the whole folder is checked again
+	recovering := h.uidAnomaly(mbox)
+	if recovering {
+		err = h.startRecovery(ctx, syncdb, mbox)
+		if err != nil {
+			return err
+		}
+		fullSync = true
+	}
+
+	// Folders that we haven't fetched before are fetched newest first
+	if h.isNewFolder(mailbox) {
+		err = h.startBackfill(mbox)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A changed search_filter may match messages that we have already passed
+	first := uint32(1)
+	if !fullSync && !h.filterChanged(mailbox) {
+		first = h.getLastSeenUID(mailbox) + 1
+	}
+
+	// Messages that haven't been backfilled yet are left for the backfill
+	if lowest, ok := h.cfg.BackfillUID[mailbox]; ok && lowest > first {
+		first = lowest
+	}
+
+	older, complete, err := h.backfillUIDs(mailbox)
+	if err != nil {
+		return err
+	}
+
+	// Messages moved to another folder on the server lose the folder tag of this folder,
+	// which requires that we know every UID in the folder. The UIDs below the
+	// ones we search for are only listed, which is cheap compared to fetching them.
+	trackVanished := h.mailbox.AutoFolderTags
+	var onServer []uint32
+	if trackVanished && first > 1 {
+		onServer, err = h.searchUIDRange(1, first-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Search for messages in chunks of UIDs, so that huge folders don't
+	// require a single enormous response from the server
+	found := 0
+	chunkSize := h.mailbox.UIDChunk()
+	for {
+		last := first + chunkSize - 1
+
+		// The last chunk includes any messages that arrived after the mailbox was selected
+		final := mbox.UidNext == 0 || last >= mbox.UidNext-1 || last < first
+		if final {
+			last = math.MaxUint32
+		}
+
+		uids, err := h.searchFiltered(mailbox, first, last)
+		if err != nil {
+			return err
+		}
+		found += len(uids)
+		if trackVanished {
+			// Messages that don't match the search filter are still on the server
+			all := uids
+			if h.mailbox.SearchFilter[mailbox] != "" {
+				all, err = h.searchUIDRange(first, last)
+				if err != nil {
+					return err
+				}
+			}
+			onServer = append(onServer, all...)
+		}
+
+		err = h.fetchUIDs(ctx, syncdb, mbox, uids, progress)
+		if err != nil {
+			return err
+		}
+		if final {
+			break
+		}
+
+		// Every message up to the end of the chunk has been handled, and new
+		// messages get UIDs from UIDNEXT, so we don't have to search this chunk again
+		if last > h.getLastSeenUID(mailbox) {
+			h.setLastSeenUID(mailbox, last)
+			err = h.saveState()
+			if err != nil {
+				return err
+			}
+		}
+		first = last + 1
+	}
+
+	if trackVanished {
+		err = h.forgetVanished(ctx, syncdb, mailbox, mbox.UidValidity, onServer)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = h.saveFilter(mailbox)
+	if err != nil {
+		return err
+	}
+
+	if recovering {
+		h.stats.Recovered = append(h.stats.Recovered, mailbox)
+	}
 
-	lastSeenUID := uint32(0)
-	if !fullSync {
-		lastSeenUID = h.getLastSeenUID(mailbox)
+	// Replace our estimate with the actual number of messages
+	if actual := found + len(older); actual != estimate {
+		progress.ChangeMax(progress.GetMax() - estimate + actual)
 	}
+
+	if h.isBackfilling(mailbox) {
+		return h.backfill(ctx, syncdb, mbox, older, complete, progress)
+	}
+	return nil
+}
+
+// fetchUIDs handles the messages with UIDs in uids in the selected mailbox, which must be in
+// ascending order. The messages are handled in windows, so that we don't have to keep
+// information about every message in memory at once, and so that an interrupted run
+// can continue where it left off.
+func (h *Handler) fetchUIDs(ctx context.Context, syncdb *sync.DB, mbox *imap.MailboxStatus, uids []uint32, progress *progressbar.ProgressBar) error {
+	for start := 0; start < len(uids); start += fetchWindowSize {
+		end := start + fetchWindowSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+		window := uids[start:end]
+
+		err := h.fetchWindow(ctx, syncdb, mbox, window, progress)
+		if err != nil {
+			return err
+		}
+
+		// We never move the watermark backwards, which might otherwise happen during a full sync
+		if highest := window[len(window)-1]; highest > h.getLastSeenUID(mbox.Name) {
+			h.setLastSeenUID(mbox.Name, highest)
+		}
+
+		err = h.saveState()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchUIDs returns all UIDs larger than lastSeenUID in the selected mailbox, in ascending order
+func (h *Handler) searchUIDs(lastSeenUID uint32) ([]uint32, error) {
 	// Note that we search from lastSeenUID to MAX, instead of
 	//   lastSeenUID to '*', because the latter always returns at least one entry
-	seqSet.AddRange(lastSeenUID+1, math.MaxUint32)
+	return h.searchUIDRange(lastSeenUID+1, math.MaxUint32)
+}
+
+// searchUIDRange returns all UIDs from first to last in the selected mailbox, in ascending order
+func (h *Handler) searchUIDRange(first uint32, last uint32) ([]uint32, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(first, last)
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = seqSet
+	found, err := h.client.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+	return sortedRange(found, first, last), nil
+}
+
+// sortedRange returns the UIDs in found from first to last, in ascending order.
+// found is modified.
+func sortedRange(found []uint32, first uint32, last uint32) []uint32 {
+	uids := found[:0]
+	for _, uid := range found {
+		if uid >= first && uid <= last {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+// FetchAction is a change on the server that has to be applied locally
+type FetchAction struct {
+	Folder      string
+	UIDValidity uint32
+	UID         uint32
+
+	// Download is set if the message has to be downloaded,
+	// otherwise only the tags in Info are changed
+	Download bool
+	Info     sync.MessageInfo
+	Identity messageIdentity
+
+	// ServerTags are the tags corresponding to the flags on the server
+	ServerTags []string
+}
+
+// fetchWindow fetches the flags of the messages in 'window', which must be sorted,
+// and downloads or updates them as needed.
+func (h *Handler) fetchWindow(ctx context.Context, syncdb *sync.DB, mbox *imap.MailboxStatus, window []uint32, progress *progressbar.ProgressBar) error {
+	actions, err := h.classifyWindow(ctx, syncdb, mbox, window)
+	if err != nil {
+		return err
+	}
+
+	// Messages without changes are done already
+	progress.Add(len(window) - len(actions))
+	h.beat()
+
+	for _, action := range actions {
+		if err = ctx.Err(); err == nil {
+			progress.Add(1)
+			h.beat()
+			err = h.applyFetch(ctx, syncdb, action)
+		}
+
+		if err != nil {
+			// Everything below this UID has been handled
+			if action.UID-1 > h.getLastSeenUID(mbox.Name) {
+				h.setLastSeenUID(mbox.Name, action.UID-1)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// classifyWindow fetches the flags of the messages in 'window', and compares them with the
+// sync database. The changes that have to be made locally are returned in UID order.
+func (h *Handler) classifyWindow(ctx context.Context, syncdb *sync.DB, mbox *imap.MailboxStatus, window []uint32) ([]FetchAction, error) {
+	mailbox := mbox.Name
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(window...)
 
 	// Fetch envelope information (contains messageid, and UID, which we'll use to fetch the body
-	items := []imap.FetchItem{imap.FetchFlags, imap.FetchUid}
+	items := h.fetchItems(imap.FetchFlags, imap.FetchUid)
 
 	messages := make(chan *imap.Message, 100)
-	errchan := make(chan error, 1)
+	done := make(chan error, 1)
 
 	go func() {
-		if err := h.client.UidFetch(seqSet, items, messages); err != nil {
-			errchan <- err
-		}
+		done <- h.client.UidFetch(seqSet, items, messages)
 	}()
 
-	type Update struct {
-		UID  uint32
-		Seen bool
-		Info sync.MessageInfo
-	}
-
-	var updateList []Update
+	var actions []FetchAction
+	var loopErr error
+	received := 0
+	highestUID := uint32(0)
 	for msg := range messages {
-		if msg == nil {
-			// We're done
-			break
+		// If we've already failed, we still have to drain the channel,
+		// otherwise the fetch goroutine will block forever
+		if msg == nil || loopErr != nil {
+			continue
 		}
+		received++
 
 		if msg.Uid == 0 {
-			return errors.New("server did not return UID")
+			loopErr = errors.New("server did not return UID")
+			continue
 		}
 
-		if msg.Uid > lastSeenUID {
-			lastSeenUID = msg.Uid
+		if msg.Uid > highestUID {
+			highestUID = msg.Uid
 		}
 
 		serverFlagMap, seen := h.translateFlags(msg.Flags)
+		serverFlags := make([]string, 0, len(serverFlagMap))
+		for flag := range serverFlagMap {
+			serverFlags = append(serverFlags, flag)
+		}
 
-		update := Update{
-			UID: msg.Uid,
+		action := FetchAction{
+			Folder:      mailbox,
+			UIDValidity: mbox.UidValidity,
+			UID:         msg.Uid,
+			Identity:    identity(msg),
+			ServerTags:  serverFlags,
 		}
 
 		// The seen-flag means that it's marked as seen by the IMAP server -
@@ -244,16 +587,13 @@ func (h *Handler) mailboxFetchMessages(ctx context.Context, syncdb *sync.DB, mai
 		if seen {
 			// If we've seen this message before, we just compare our flags with the
 			// flags on the server - if they differ, we'll update it later
-			serverFlags := make([]string, 0, len(serverFlagMap))
-			for flag := range serverFlagMap {
-				serverFlags = append(serverFlags, flag)
-			}
-
 			info, err := syncdb.CheckTagsUID(ctx, mailbox, int(mbox.UidValidity), int(msg.Uid), serverFlags)
 			if err != nil {
-				return err
+				loopErr = err
+				continue
 			}
-			update.Info = info
+			h.reconcileLegacyDeleted(&info)
+			action.Info = info
 
 			if !info.Created && len(info.AddedTags) == 0 && len(info.RemovedTags) == 0 {
 				continue
@@ -263,56 +603,126 @@ func (h *Handler) mailboxFetchMessages(ctx context.Context, syncdb *sync.DB, mai
 				seen = false
 			}
 		}
-		update.Seen = seen
-		updateList = append(updateList, update)
+		action.Download = !seen || action.Info.MessageID == ""
+		actions = append(actions, action)
 	}
 
-	// Check if an error occurred while fetching data
-	select {
-	case err := <-errchan:
-		return err
-	default:
+	// The channel is closed when UidFetch returns, so this will not block
+	fetchErr := <-done
+	if fetchErr != nil {
+		// We don't know which parts of the range the server skipped,
+		// so we cannot move our watermark forward at all
+		return nil, &PartialFetchError{
+			Mailbox:    mailbox,
+			Received:   received,
+			HighestUID: highestUID,
+			Err:        fetchErr,
+		}
+	}
+	if loopErr != nil {
+		return nil, loopErr
 	}
 
-	progress := progressbar.NewOptions(len(updateList), progressbar.OptionSetDescription(mailbox))
-	for _, update := range updateList {
-		progress.Add(1)
+	// Process updates in UID order, so that everything below
+	// a failed update is known to be handled
+	sort.Slice(actions, func(i, j int) bool { return actions[i].UID < actions[j].UID })
 
-		if !update.Seen || update.Info.MessageID == "" {
-			// This is the first time we've dealt with this,
-			// so we'll have to download the message and import it into notmuch
-			err = h.getMessage(syncdb, mailbox, update.UID)
-		} else {
-			// Messages that we've already seen before only needs their flags adjusted
-			err = syncdb.WrapRW(func(db *notmuch.DB) error {
-				msg, err := db.FindMessage(update.Info.MessageID)
-				if err != nil {
-					return err
-				}
+	err := h.fetchDownloadMessageIDs(actions)
+	if err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
 
-				for _, tag := range update.Info.AddedTags {
-					err = msg.AddTag(tag)
-					if err != nil {
-						return err
-					}
-				}
+// fetchDownloadMessageIDs fills in the Message-ID of the messages in actions that have to be
+// downloaded, so that messages we already have locally can be recognized before downloading them
+func (h *Handler) fetchDownloadMessageIDs(actions []FetchAction) error {
+	seqSet := new(imap.SeqSet)
+	for _, action := range actions {
+		if action.Download {
+			seqSet.AddNum(action.UID)
+		}
+	}
+	if seqSet.Empty() {
+		return nil
+	}
 
-				for _, tag := range update.Info.RemovedTags {
-					err = msg.RemoveTag(tag)
-					if err != nil {
-						return err
-					}
-				}
+	ids, err := h.fetchMessageIDs(seqSet)
+	if err != nil {
+		return err
+	}
+	for i := range actions {
+		if actions[i].Download {
+			actions[i].Identity.MessageID = ids[actions[i].UID]
+		}
+	}
+	return nil
+}
 
-				err = syncdb.AddMessageSyncInfo(update.Info, update.Info.WantedTags)
-				return err
-			})
+// applyFetch downloads a message, or updates its tags, as described by action
+func (h *Handler) applyFetch(ctx context.Context, syncdb *sync.DB, action FetchAction) error {
+	if action.Download {
+		// This is the first time we've dealt with this,
+		// so we'll have to download the message and import it into notmuch,
+		// unless we've already got it from another folder
+		linked, err := h.linkExistingMessage(ctx, syncdb, action.Folder, action.UIDValidity, action.UID, action.Identity, action.ServerTags)
+		if err != nil || linked {
+			return err
 		}
+		_, err = h.getMessage(ctx, syncdb, action.Folder, action.UID, false)
+		if err == nil {
+			h.stats.Downloaded++
+		}
+		return err
+	}
 
+	// Messages that we've already seen before only needs their flags adjusted
+	info := action.Info
+	return syncdb.WrapRW(func(db *notmuch.DB) error {
+		msg, err := db.FindMessage(info.MessageID)
 		if err != nil {
 			return err
 		}
-	}
-	h.setLastSeenUID(mailbox, lastSeenUID)
-	return nil
+		defer msg.Close()
+
+		// Fill in the headers of messages stored before we kept track of them
+		if h.mailbox.StoresHeaders() {
+			info.Summary = sync.NewSummary(msg.Header("From"), msg.Header("Subject"), msg.Header("Date"))
+		}
+
+		for _, tag := range info.AddedTags {
+			err = msg.AddTag(tag)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, tag := range info.RemovedTags {
+			err = msg.RemoveTag(tag)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = syncdb.AddMessageSyncInfo(ctx, info, info.WantedTags)
+		return err
+	})
+}
+
+// PartialFetchError is returned when the server aborted a fetch midway.
+// Received and HighestUID describe what we got before the fetch failed.
+type PartialFetchError struct {
+	Mailbox    string
+	Received   int
+	HighestUID uint32
+	Err        error
+}
+
+func (e *PartialFetchError) Error() string {
+	return fmt.Sprintf("fetch from %s aborted after %d messages (highest UID %d): %v", e.Mailbox, e.Received, e.HighestUID, e.Err)
+}
+
+// Unwrap returns the underlying fetch error
+func (e *PartialFetchError) Unwrap() error {
+	return e.Err
 }
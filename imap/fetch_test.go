@@ -0,0 +1,215 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// fetchMessages returns a fetch function for fetchOne that sends messages and returns err
+func fetchMessages(err error, messages ...*imap.Message) func(chan *imap.Message) error {
+	return func(ch chan *imap.Message) error {
+		defer close(ch)
+		for _, m := range messages {
+			ch <- m
+		}
+		return err
+	}
+}
+
+func TestFetchOne(t *testing.T) {
+	first := &imap.Message{Uid: 1}
+	second := &imap.Message{Uid: 2}
+	block := make(chan struct{})
+	defer close(block)
+
+	tests := []struct {
+		name    string
+		fetch   func(chan *imap.Message) error
+		want    *imap.Message
+		wantErr string
+	}{
+		{
+			name:    "no messages",
+			fetch:   fetchMessages(nil),
+			wantErr: "didn't return message",
+		},
+		{
+			name:  "one message",
+			fetch: fetchMessages(nil, first),
+			want:  first,
+		},
+		{
+			name:    "two messages",
+			fetch:   fetchMessages(nil, first, second),
+			wantErr: "returned 2 messages",
+		},
+		{
+			name:  "nil messages are skipped",
+			fetch: fetchMessages(nil, nil, first, nil),
+			want:  first,
+		},
+		{
+			name:    "fetch failed",
+			fetch:   fetchMessages(errors.New("connection reset"), first),
+			wantErr: "connection reset",
+		},
+		{
+			name: "timeout",
+			fetch: func(ch chan *imap.Message) error {
+				ch <- first
+				<-block
+				close(ch)
+				return nil
+			},
+			wantErr: "timed out",
+		},
+		{
+			name: "timeout after all messages",
+			fetch: func(ch chan *imap.Message) error {
+				ch <- first
+				close(ch)
+				<-block
+				return nil
+			},
+			wantErr: "timed out",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := fetchOne(tt.fetch, 50*time.Millisecond)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: fetchOne() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFetchOneFromServer(t *testing.T) {
+	store := newFakeStore()
+	store.add("INBOX",
+		fakeMail{uid: 1, messageID: "1@example.com"},
+		fakeMail{uid: 2, messageID: "2@example.com"},
+		// A broken server that has given two messages the same UID
+		fakeMail{uid: 3, messageID: "3a@example.com"},
+		fakeMail{uid: 3, messageID: "3b@example.com"})
+	s := store.server(t)
+	h := s.connect(tempDir(t), s.mailbox())
+	if _, err := h.selectMailbox("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uid     uint32
+		wantErr string
+	}{
+		{uid: 2},
+		{uid: 4, wantErr: "didn't return message"},
+		{uid: 3, wantErr: "returned 2 messages"},
+	}
+
+	for _, tt := range tests {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(tt.uid)
+		msg, err := fetchOne(func(messages chan *imap.Message) error {
+			return h.client.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+		}, fetchTimeout)
+
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("UID %d: error = %v, want %q", tt.uid, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("UID %d: %v", tt.uid, err)
+		} else if msg.Uid != tt.uid {
+			t.Errorf("UID %d: fetchOne() returned UID %d", tt.uid, msg.Uid)
+		}
+	}
+}
+
+// newFetchTest returns a handler for a server with five new messages in INBOX,
+// which has been synchronized before. If abortFetch is set, the server stops
+// after returning two messages when asked for their flags.
+func newFetchTest(t *testing.T, abortFetch bool) (*Handler, *sync.DB) {
+	store := newFakeStore()
+	for uid := uint32(1); uid <= 5; uid++ {
+		store.add("INBOX", fakeMail{uid: uid, messageID: fmt.Sprintf("%d@example.com", uid)})
+	}
+	s := newFakeServer(t, func(command, args string) ([]string, string) {
+		untagged, status := store.handle(command, args)
+		if abortFetch && command == "UID FETCH" && strings.Contains(args, "FLAGS") && len(untagged) > 2 {
+			return untagged[:2], "NO [SERVERBUG] fetch aborted"
+		}
+		return untagged, status
+	})
+
+	maildir := tempDir(t)
+	h := s.connect(maildir, s.mailbox())
+	h.setLastSeenUID("INBOX", 0)
+	return h, newTestDB(t, maildir)
+}
+
+func TestFetchAborted(t *testing.T) {
+	h, syncdb := newFetchTest(t, true)
+
+	err := h.mailboxFetchMessages(context.Background(), syncdb, "INBOX", false, discardProgress(), 5)
+	var partial *PartialFetchError
+	if !errors.As(err, &partial) {
+		t.Fatalf("mailboxFetchMessages() = %v, want a PartialFetchError", err)
+	}
+	if partial.Received != 2 || partial.HighestUID != 2 {
+		t.Errorf("received %d messages up to UID %d, want 2 up to UID 2", partial.Received, partial.HighestUID)
+	}
+
+	// We can't tell which messages the server skipped, so none of them count as seen
+	if uid := h.getLastSeenUID("INBOX"); uid != 0 {
+		t.Errorf("last seen UID = %d after an aborted fetch, want 0", uid)
+	}
+}
+
+func TestFetchInterrupted(t *testing.T) {
+	h, syncdb := newFetchTest(t, false)
+	err := createMailDir(filepath.Join(h.maildirPath, "INBOX"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The run is interrupted while the third message is being handled.
+	// The heartbeat is called once for the whole window, then once for each message.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	beats := 0
+	h.SetHeartbeat(func() {
+		if beats++; beats == 1+3 {
+			cancel()
+		}
+	})
+
+	err = h.mailboxFetchMessages(ctx, syncdb, "INBOX", false, discardProgress(), 5)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("mailboxFetchMessages() = %v, want %v", err, context.Canceled)
+	}
+
+	// Everything below the third message has been handled
+	if uid := h.getLastSeenUID("INBOX"); uid != 2 {
+		t.Errorf("last seen UID = %d after failing at UID 3, want 2", uid)
+	}
+}
@@ -0,0 +1,80 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+// searchFiltered returns the UIDs from first to last in the selected mailbox that match
+// the search_filter configured for it, in ascending order. Without a filter, every UID in
+// the range is returned.
+func (h *Handler) searchFiltered(mailbox string, first uint32, last uint32) ([]uint32, error) {
+	filter := h.mailbox.SearchFilter[mailbox]
+	if filter == "" {
+		return h.searchUIDRange(first, last)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(first, last)
+
+	// The filter is sent as is, since it was validated when the configuration was loaded
+	args := []interface{}{imap.RawString("SEARCH")}
+	if !isASCII(filter) {
+		args = append(args, imap.RawString("CHARSET"), imap.RawString("UTF-8"))
+	}
+	args = append(args, imap.RawString("UID"), seqSet, imap.RawString("("+filter+")"))
+
+	var found []uint32
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok || name != "SEARCH" {
+			return responses.ErrUnhandled
+		}
+		for _, f := range fields {
+			uid, err := imap.ParseNumber(f)
+			if err != nil {
+				// I.e. the (MODSEQ n) that CONDSTORE servers may add
+				continue
+			}
+			found = append(found, uid)
+		}
+		return nil
+	})
+
+	status, err := h.client.Execute(&imap.Command{Name: "UID", Arguments: args}, handler)
+	if err == nil && status != nil && status.Type != imap.StatusRespOk {
+		err = &imap.ErrStatusResp{Resp: status}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sortedRange(found, first, last), nil
+}
+
+// filterChanged returns true if the search_filter of mailbox has changed since it was
+// last searched, in which case messages we have already passed may match it now
+func (h *Handler) filterChanged(mailbox string) bool {
+	return h.cfg.SearchFilters[mailbox] != h.mailbox.SearchFilter[mailbox]
+}
+
+// saveFilter records the search_filter that mailbox has been searched with
+func (h *Handler) saveFilter(mailbox string) error {
+	if !h.filterChanged(mailbox) {
+		return nil
+	}
+	if filter := h.mailbox.SearchFilter[mailbox]; filter != "" {
+		h.cfg.SearchFilters[mailbox] = filter
+	} else {
+		delete(h.cfg.SearchFilters, mailbox)
+	}
+	return h.saveState()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
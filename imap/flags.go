@@ -1,6 +1,15 @@
 package imap
 
-import "github.com/emersion/go-imap"
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// legacyDeletedTag is the tag \Deleted was imported as by earlier versions
+const legacyDeletedTag = "deleted"
 
 func (h *Handler) translateFlags(imapFlags []string) (outputFlags map[string]bool, seen bool) {
 	outputFlags = make(map[string]bool, len(imapFlags))
@@ -14,24 +23,18 @@ func (h *Handler) translateFlags(imapFlags []string) (outputFlags map[string]boo
 			outputFlags["replied"] = true
 		case imap.DeletedFlag:
 			// NOTE - the deleted flag is special in IMAP
-			// usually, all deleted messages will be permanently removed from the server when we close the folder
-			outputFlags["deleted"] = true
+			// usually, all deleted messages will be permanently removed from the server when we close the folder.
+			// We don't use notmuch's "deleted" tag by default, since it's hidden from all searches
+			if tag := h.mailbox.ServerDeletedTag(); tag != "" {
+				outputFlags[tag] = true
+			}
 		case imap.DraftFlag:
 			outputFlags["draft"] = true
 		case imap.FlaggedFlag:
 			outputFlags["flagged"] = true
 		default:
-			// We ignore other builtin flags
-			if flag[0] == '\\' {
-				continue
-			}
-			ignoreTag := false
-			for _, ignore := range h.mailbox.IgnoredTags {
-				if flag == ignore {
-					ignoreTag = true
-				}
-			}
-			if ignoreTag {
+			// We ignore other builtin flags, and keywords excluded by allowed_tags or ignored_tags
+			if flag[0] == '\\' || !h.mailbox.SyncsTag(flag) {
 				continue
 			}
 			outputFlags[flag] = true
@@ -44,3 +47,69 @@ func (h *Handler) translateFlags(imapFlags []string) (outputFlags map[string]boo
 
 	return outputFlags, seen
 }
+
+// tagToFlag returns the IMAP flag that should be stored on the server for tag
+func (h *Handler) tagToFlag(tag string) string {
+	if deletedTag := h.mailbox.ServerDeletedTag(); deletedTag != "" && tag == deletedTag {
+		return imap.DeletedFlag
+	}
+	if tag == "draft" {
+		return imap.DraftFlag
+	}
+	return tag
+}
+
+// reconcileLegacyDeleted handles sync-db entries created when \Deleted was always
+// imported as "deleted". If another tag is used now, that change should not cause
+// the tag to be removed and re-added on every message.
+func (h *Handler) reconcileLegacyDeleted(info *sync.MessageInfo) {
+	deletedTag := h.mailbox.ServerDeletedTag()
+	if deletedTag == legacyDeletedTag {
+		return
+	}
+
+	removed := info.RemovedTags[:0]
+	hadLegacy := false
+	for _, t := range info.RemovedTags {
+		if t == legacyDeletedTag {
+			hadLegacy = true
+			continue
+		}
+		removed = append(removed, t)
+	}
+	info.RemovedTags = removed
+
+	if !hadLegacy || deletedTag == "" {
+		return
+	}
+
+	added := info.AddedTags[:0]
+	for _, t := range info.AddedTags {
+		if t != deletedTag {
+			added = append(added, t)
+		}
+	}
+	info.AddedTags = added
+}
+
+// applyFolderTags adds and removes the tags configured in folder_tags for mailbox on m
+func (h *Handler) applyFolderTags(m *notmuch.Message, mailbox string) error {
+	extraTags, ok := h.mailbox.FolderTags[mailbox]
+	if !ok {
+		return nil
+	}
+
+	for _, tag := range strings.Split(extraTags, ",") {
+		tag = strings.TrimSpace(tag)
+		var err error
+		if strings.HasPrefix(tag, "-") {
+			err = m.RemoveTag(tag[1:])
+		} else if tag != "" {
+			err = m.AddTag(tag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
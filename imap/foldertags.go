@@ -0,0 +1,102 @@
+package imap
+
+import (
+	"context"
+
+	"github.com/yzzyx/nm-imap-sync/sync"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// updateFolderTags makes the automatic folder tags of the message with id messageID
+// match the folders it's stored in on the server, according to the sync database
+func (h *Handler) updateFolderTags(ctx context.Context, syncdb *sync.DB, messageID string) error {
+	if !h.mailbox.AutoFolderTags {
+		return nil
+	}
+
+	uids, err := syncdb.LookupUIDs(ctx, messageID)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		wanted[h.mailbox.FolderTag(uid.FolderName)] = true
+	}
+
+	return syncdb.WrapRW(func(db *notmuch.DB) error {
+		m, err := db.FindMessage(messageID)
+		if err != nil {
+			if err == notmuch.ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		defer m.Close()
+
+		var remove []string
+		tags := m.Tags()
+		tag := &notmuch.Tag{}
+		for tags.Next(&tag) {
+			if !h.mailbox.IsFolderTag(tag.Value) {
+				continue
+			}
+			if wanted[tag.Value] {
+				delete(wanted, tag.Value)
+			} else {
+				remove = append(remove, tag.Value)
+			}
+		}
+		tags.Close()
+
+		for _, t := range remove {
+			if err = m.RemoveTag(t); err != nil {
+				return err
+			}
+		}
+		for t := range wanted {
+			if err = m.AddTag(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forgetVanished removes UIDs in mailbox that are no longer on the server from the sync
+// database, and updates the folder tags and properties of the affected messages. 'onServer' must contain
+// every UID in the mailbox.
+func (h *Handler) forgetVanished(ctx context.Context, syncdb *sync.DB, mailbox string, uidValidity uint32, onServer []uint32) error {
+	known, _, err := syncdb.FolderUIDs(ctx, mailbox, -1)
+	if err != nil {
+		return err
+	}
+
+	exists := make(map[uint32]bool, len(onServer))
+	for _, uid := range onServer {
+		exists[uid] = true
+	}
+
+	var vanished []sync.UID
+	for _, uid := range known {
+		if uid.UIDValidity == int(uidValidity) && !exists[uint32(uid.UID)] {
+			vanished = append(vanished, uid)
+		}
+	}
+	if len(vanished) == 0 {
+		return nil
+	}
+
+	affected, err := syncdb.RemoveUIDs(ctx, vanished)
+	if err != nil {
+		return err
+	}
+
+	for _, messageID := range affected {
+		err = h.updateLocation(ctx, syncdb, messageID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
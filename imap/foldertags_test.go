@@ -0,0 +1,90 @@
+package imap
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+func TestServerSideMove(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string // The order the folders are synchronized in
+	}{
+		{
+			name:  "source folder first",
+			order: []string{"A", "B"},
+		},
+		{
+			name:  "destination folder first",
+			order: []string{"B", "A"},
+		},
+	}
+
+	for _, tt := range tests {
+		ctx := context.Background()
+		maildir := tempDir(t)
+		syncdb := newTestDB(t, maildir)
+
+		mail := fakeMail{uid: 1, flags: []string{imap.SeenFlag}, messageID: "moved@example.com", emailID: "E1"}
+		store := newFakeStore(CapObjectID)
+		store.add("A", mail)
+		store.add("B")
+		s := store.server(t)
+		mailbox := s.mailbox()
+		mailbox.AutoFolderTags = true
+		h := s.connect(maildir, mailbox)
+
+		// The message was downloaded from A during an earlier run
+		storeLocal(t, syncdb, maildir, "A", mail)
+		err := syncdb.AddMessageSyncInfo(ctx, sync.MessageInfo{
+			MessageID: mail.messageID,
+			EmailID:   mail.emailID,
+			UIDs:      []sync.UID{{FolderName: "A", UIDValidity: store.uidValidity("A"), UID: 1}},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.setLastSeenUID("A", 1)
+		h.setLastSeenUID("B", 0)
+
+		// It's then moved to B on the server, and flagged at the same time
+		store.move("A", 1, "B")
+		store.setFlags("B", 1, imap.SeenFlag, imap.FlaggedFlag)
+
+		for _, folder := range tt.order {
+			err = h.mailboxFetchMessages(ctx, syncdb, folder, false, discardProgress(), 0)
+			if err != nil {
+				t.Fatalf("%s: cannot synchronize %s: %v", tt.name, folder, err)
+			}
+		}
+
+		uids, err := syncdb.LookupUIDs(ctx, mail.messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []sync.UID{{FolderName: "B", UIDValidity: store.uidValidity("B"), UID: 1}}
+		if !reflect.DeepEqual(uids, want) {
+			t.Errorf("%s: UIDs = %v, want %v", tt.name, uids, want)
+		}
+
+		// The flag added on the server is now the synchronized state
+		info, err := syncdb.CheckTagsUID(ctx, "B", store.uidValidity("B"), 1, []string{"flagged"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Created || len(info.AddedTags) > 0 || len(info.RemovedTags) > 0 {
+			t.Errorf("%s: synchronized tags differ from the server: added %v, removed %v", tt.name, info.AddedTags, info.RemovedTags)
+		}
+
+		for _, cmd := range s.received() {
+			if strings.Contains(cmd, "BODY.PEEK[]") {
+				t.Errorf("%s: the moved message was downloaded again: %s", tt.name, cmd)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// ForceDirection selects which side is authoritative in ForceTags
+type ForceDirection int
+
+const (
+	// ForcePush makes the flags on the server match the local tags
+	ForcePush ForceDirection = iota
+	// ForcePull makes the local tags match the flags on the server
+	ForcePull
+)
+
+// ForceStats contains the totals of a ForceTags run
+type ForceStats struct {
+	Messages int // Messages that were compared
+	Changed  int // Messages where the other side was changed
+	Added    int // Tags or flags added
+	Removed  int // Tags or flags removed
+}
+
+// ForceTags compares every message on the server that is known to the sync database with
+// its local copy, and makes the other side match the authoritative one exactly, regardless
+// of which side changed since the last run. The synchronized state is rewritten to match.
+// Messages that haven't been synchronized yet are left for the next normal run,
+// and tags of messages matching push_exclude_query are never pushed.
+// If dryRun is set, the changes are only logged.
+func (h *Handler) ForceTags(ctx context.Context, syncdb *sync.DB, direction ForceDirection, dryRun bool) (ForceStats, error) {
+	var stats ForceStats
+
+	mailboxes, err := h.listFolders()
+	if err != nil {
+		return stats, err
+	}
+
+	var excluded map[string]bool
+	if direction == ForcePush {
+		excluded, err = syncdb.PushExcluded(h.mailbox)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	for _, mb := range mailboxes {
+		mbox, err := h.selectMailbox(mb, direction == ForcePull || dryRun)
+		if err != nil {
+			return stats, err
+		}
+		if mbox.Messages == 0 {
+			continue
+		}
+
+		uids, err := h.searchUIDs(0)
+		if err != nil {
+			return stats, err
+		}
+
+		for start := 0; start < len(uids); start += fetchWindowSize {
+			end := start + fetchWindowSize
+			if end > len(uids) {
+				end = len(uids)
+			}
+			err = h.forceWindow(ctx, syncdb, mbox, uids[start:end], direction, excluded, dryRun, &stats)
+			if err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+// forceWindow applies ForceTags to the messages with UIDs in window, except for those in excluded
+func (h *Handler) forceWindow(ctx context.Context, syncdb *sync.DB, mbox *imap.MailboxStatus, window []uint32, direction ForceDirection, excluded map[string]bool, dryRun bool, stats *ForceStats) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(window...)
+
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.client.UidFetch(seqSet, []imap.FetchItem{imap.FetchFlags, imap.FetchUid}, messages)
+	}()
+
+	// Collect the flags first, since we can't store flags while the fetch is running
+	var fetched []*imap.Message
+	for msg := range messages {
+		if msg != nil && msg.Uid != 0 {
+			fetched = append(fetched, msg)
+		}
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+
+	for _, msg := range fetched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		serverMap, _ := h.translateFlags(msg.Flags)
+		serverTags := make([]string, 0, len(serverMap))
+		for tag := range serverMap {
+			serverTags = append(serverTags, tag)
+		}
+		sort.Strings(serverTags)
+
+		info, err := syncdb.CheckTagsUID(ctx, mbox.Name, int(mbox.UidValidity), int(msg.Uid), serverTags)
+		if err != nil {
+			return err
+		}
+		if info.Created || excluded[info.MessageID] {
+			continue
+		}
+
+		localTags, err := syncdb.SyncedTags(h.mailbox, info.MessageID)
+		if errors.Is(err, notmuch.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		stats.Messages++
+
+		var added, removed []string
+		if direction == ForcePush {
+			added, removed = h.tagDifference(localTags, serverTags)
+		} else {
+			added, removed = h.tagDifference(serverTags, localTags)
+		}
+
+		if len(added) > 0 || len(removed) > 0 {
+			stats.Changed++
+			stats.Added += len(added)
+			stats.Removed += len(removed)
+			if dryRun {
+				side := "server"
+				if direction == ForcePull {
+					side = "local"
+				}
+				log.Printf("%s UID %d (%s): %s would add %v, remove %v\n", mbox.Name, msg.Uid, info.MessageID, side, added, removed)
+				continue
+			}
+		}
+		if dryRun {
+			continue
+		}
+
+		if direction == ForcePush {
+			err = h.storeTags(ctx, syncdb, msg.Uid, added, removed)
+			if err != nil {
+				return err
+			}
+			err = syncdb.AddMessageSyncInfo(ctx, info, localTags)
+		} else {
+			err = h.setLocalTags(ctx, syncdb, info, added, removed, serverTags)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagDifference returns the tags to add and remove to turn 'current' into 'wanted'.
+// Tags that aren't synchronized, see config.Mailbox.SyncsTag, are never changed.
+func (h *Handler) tagDifference(wanted []string, current []string) (added []string, removed []string) {
+	currentMap := make(map[string]bool, len(current))
+	for _, t := range current {
+		currentMap[t] = true
+	}
+	wantedMap := make(map[string]bool, len(wanted))
+	for _, t := range wanted {
+		wantedMap[t] = true
+		if !currentMap[t] && h.mailbox.SyncsTag(t) {
+			added = append(added, t)
+		}
+	}
+	for _, t := range current {
+		if !wantedMap[t] && h.mailbox.SyncsTag(t) {
+			removed = append(removed, t)
+		}
+	}
+	return added, removed
+}
+
+// setLocalTags adds and removes tags on the local message, and stores 'synced' as the synchronized state
+func (h *Handler) setLocalTags(ctx context.Context, syncdb *sync.DB, info sync.MessageInfo, added []string, removed []string, synced []string) error {
+	return syncdb.WrapRW(func(db *notmuch.DB) error {
+		msg, err := db.FindMessage(info.MessageID)
+		if err != nil {
+			return err
+		}
+		defer msg.Close()
+
+		for _, tag := range added {
+			err = msg.AddTag(tag)
+			if err != nil {
+				return err
+			}
+		}
+		for _, tag := range removed {
+			err = msg.RemoveTag(tag)
+			if err != nil {
+				return err
+			}
+		}
+		return syncdb.AddMessageSyncInfo(ctx, info, synced)
+	})
+}
@@ -0,0 +1,37 @@
+package imap
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+)
+
+// fetchGmailMessageID is the Gmail extension that returns an id which is
+// the same for a message in all folders (labels) it's in
+const fetchGmailMessageID imap.FetchItem = "X-GM-MSGID"
+
+// gmailMessageID returns the X-GM-MSGID of msg, or 0 if the server didn't return it
+func gmailMessageID(msg *imap.Message) uint64 {
+	v, ok := msg.Items[fetchGmailMessageID]
+	if !ok || v == nil {
+		return 0
+	}
+	id, err := strconv.ParseUint(fmt.Sprint(v), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// fetchItems returns items, together with the ids that identify a message
+// across folders, if the server supports them
+func (h *Handler) fetchItems(items ...imap.FetchItem) []imap.FetchItem {
+	if h.caps.Has(CapGmail) {
+		items = append(items, fetchGmailMessageID)
+	}
+	if h.caps.Has(CapObjectID) {
+		items = append(items, fetchEmailID)
+	}
+	return items
+}
@@ -5,28 +5,23 @@ package imap
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	uidplus "github.com/emersion/go-imap-uidplus"
 	"github.com/emersion/go-imap/client"
+	"github.com/schollz/progressbar/v3"
 	"github.com/yzzyx/nm-imap-sync/config"
 	"github.com/yzzyx/nm-imap-sync/sync"
 	notmuch "github.com/zenhack/go.notmuch"
 )
 
-type mailConfig struct {
-	// Keep track of last seen UID for each mailbox
-	LastSeenUID map[string]uint32
-}
-
 // IndexUpdate is used to signal that a message should be tagged with specific information
 type IndexUpdate struct {
 	Path      string   // Path to file to be updated
@@ -47,6 +42,26 @@ type Handler struct {
 
 	cfg    mailConfig
 	client *Client
+	caps   Capabilities
+
+	stats Stats
+
+	// heartbeat is called whenever a message has been handled
+	heartbeat func()
+
+	// lastTransfer is when the last message was downloaded or uploaded, see throttle
+	lastTransfer time.Time
+
+	// Local paths and hierarchy delimiters of folders, see folderPath
+	localPaths map[string]string
+	delimiters map[string]string
+
+	// Keywords the server refuses to store, by folder, see rejectedKeywords
+	rejected map[string]map[string]bool
+
+	// Used to find messages that were already appended by a previous run
+	messageIDIndex  map[string]map[string]uint32
+	createdInFolder map[string]int
 
 	// Used internally to generate maildir files
 	seqNumChan <-chan int
@@ -57,7 +72,11 @@ type Handler struct {
 // New creates a new Handler for processing IMAP mailboxes
 func New(maildirPath string, mailbox config.Mailbox) (*Handler, error) {
 	var err error
-	h := Handler{}
+	h := Handler{
+		localPaths: make(map[string]string),
+		delimiters: make(map[string]string),
+		rejected:   make(map[string]map[string]bool),
+	}
 	h.hostname, err = os.Hostname()
 	if err != nil {
 		return nil, err
@@ -75,16 +94,12 @@ func New(maildirPath string, mailbox config.Mailbox) (*Handler, error) {
 		return nil, errors.New("imap password not configured")
 	}
 
-	// Set default port
-	if h.mailbox.Port == 0 {
-		h.mailbox.Port = 143
-		if h.mailbox.UseTLS {
-			h.mailbox.Port = 993
-		}
+	connectionString := address(h.mailbox)
+	tlsConfig, err := newTLSConfig(h.mailbox)
+	if err != nil {
+		return nil, err
 	}
 
-	connectionString := fmt.Sprintf("%s:%d", h.mailbox.Server, h.mailbox.Port)
-	tlsConfig := &tls.Config{ServerName: h.mailbox.Server}
 	var c *client.Client
 	if h.mailbox.UseTLS {
 		c, err = client.DialTLS(connectionString, tlsConfig)
@@ -93,6 +108,10 @@ func New(maildirPath string, mailbox config.Mailbox) (*Handler, error) {
 	}
 
 	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return nil, &Error{Class: ErrUnreachable, Err: err}
+		}
 		return nil, err
 	}
 
@@ -101,14 +120,37 @@ func New(maildirPath string, mailbox config.Mailbox) (*Handler, error) {
 		uidplus.NewClient(c),
 	}
 
+	err = h.refreshCapabilities()
+	if err != nil {
+		return nil, err
+	}
+
 	// Start a TLS session
 	if h.mailbox.UseStartTLS {
+		if !h.caps.Has(CapStartTLS) {
+			return nil, errors.New("server does not support STARTTLS")
+		}
 		if err = h.client.StartTLS(tlsConfig); err != nil {
 			return nil, err
 		}
+
+		// Capabilities announced before STARTTLS cannot be trusted
+		err = h.refreshCapabilities()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err = h.client.Login(h.mailbox.Username, h.mailbox.Password)
+	err = h.login()
+	if err != nil {
+		if h.client.refused(err) {
+			return nil, &Error{Class: ErrAuthentication, Err: err}
+		}
+		return nil, err
+	}
+
+	// Servers may announce additional capabilities after login
+	err = h.refreshCapabilities()
 	if err != nil {
 		return nil, err
 	}
@@ -126,41 +168,92 @@ func New(maildirPath string, mailbox config.Mailbox) (*Handler, error) {
 	h.processID = os.Getpid()
 	h.maildirPath = maildirPath
 
-	h.cfg.LastSeenUID = make(map[string]uint32)
-	// Get list of timestamps etc.
-	data, err := ioutil.ReadFile(filepath.Join(maildirPath, ".imap-uids"))
+	h.cfg, err = loadState(h.mailbox.StateDir)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
-		}
-	} else {
-		err = json.Unmarshal(data, &h.cfg)
-		if err != nil {
-			return nil, err
-		}
+		return nil, err
 	}
 	return &h, nil
 }
 
+// Stats contains the number of changes made while synchronizing
+type Stats struct {
+	Downloaded int // Messages downloaded from the server
+	Pushed     int // Local changes pushed to the server
+
+	Backfilled  []string // Folders where all older messages were fetched during this run
+	Backfilling []string // Folders that still have older messages left to fetch
+	Locked      []string // Folders that were skipped since the notmuch database was locked
+
+	Anomalies []string // Folders where the last seen UID was beyond UIDNEXT, see uidAnomaly
+	Recovered []string // Folders in Anomalies that have been checked again completely
+
+	Rejected []string // Keywords the server refused to store, as "keyword in folder"
+
+	NewMail NewMail // Downloaded messages that should be notified about
+}
+
+// Stats returns the number of changes made so far
+func (h *Handler) Stats() Stats {
+	return h.stats
+}
+
+// SetHeartbeat makes fn be called each time a message has been handled,
+// which can be used to tell that the synchronization is making progress
+func (h *Handler) SetHeartbeat(fn func()) {
+	h.heartbeat = fn
+}
+
+// beat calls the heartbeat function, if one has been set
+func (h *Handler) beat() {
+	if h.heartbeat != nil {
+		h.heartbeat()
+	}
+}
+
+// saveState writes the current state, i.e. the last seen UIDs, to disk
+func (h *Handler) saveState() error {
+	return h.cfg.save(h.mailbox.StateDir)
+}
+
 // Close closes all open handles, flushes channels and saves configuration data
 func (h *Handler) Close() error {
-	data, err := json.Marshal(h.cfg)
+	err := h.saveState()
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(h.maildirPath, ".imap-uids"), data, 0700)
-	if err != nil {
-		return err
+	// Closing is only possible if we've selected a mailbox
+	if h.client.Mailbox() != nil {
+		err = h.client.Close()
+		if err != nil {
+			return err
+		}
 	}
 
-	err = h.client.Close()
+	err = h.client.Logout()
+	return err
+}
+
+// selectMailbox selects mailbox on the server, unless it's already selected.
+// If readOnly is set, the mailbox is opened with EXAMINE, which guarantees that
+// we don't modify it. A mailbox that is currently opened read-only will be
+// reselected if write access is requested.
+func (h *Handler) selectMailbox(mailbox string, readOnly bool) (*imap.MailboxStatus, error) {
+	if current := h.client.Mailbox(); current != nil && current.Name == mailbox {
+		if readOnly || !current.ReadOnly {
+			return current, nil
+		}
+	}
+	status, err := h.client.Select(mailbox, readOnly)
 	if err != nil {
-		return err
+		return nil, h.client.selectError(err)
 	}
+	return status, nil
+}
 
-	err = h.client.Logout()
-	return err
+// Logout disconnects from the server without saving any state
+func (h *Handler) Logout() error {
+	return h.client.Logout()
 }
 
 // GetLastFetched returns the timestamp when we last checked this mailbox
@@ -205,6 +298,46 @@ func (h *Handler) seenMessage(nmdb *sync.DB, messageID string) (bool, error) {
 	return retval, err
 }
 
+// listMailboxes returns all mailboxes on the server
+func (h *Handler) listMailboxes() ([]*imap.MailboxInfo, error) {
+	mboxChan := make(chan *imap.MailboxInfo, 10)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- h.client.List("", "*", mboxChan)
+	}()
+
+	var mailboxes []*imap.MailboxInfo
+	for mb := range mboxChan {
+		if mb != nil {
+			mailboxes = append(mailboxes, mb)
+			h.delimiters[mb.Name] = mb.Delimiter
+		}
+	}
+
+	// The channel is closed when List returns, so this will not block
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+	return mailboxes, nil
+}
+
+// nonExistentAttr marks a mailbox that is listed without existing, i.e. as the parent
+// of another mailbox, see RFC 5258. It's not defined by go-imap.
+const nonExistentAttr = "\\NonExistent"
+
+// selectable returns false if mb only exists as part of the hierarchy, such as namespace roots,
+// and cannot be selected. Its children are listed as separate mailboxes.
+func selectable(mb *imap.MailboxInfo) bool {
+	for _, attr := range mb.Attributes {
+		if strings.EqualFold(attr, imap.NoSelectAttr) || strings.EqualFold(attr, nonExistentAttr) {
+			return false
+		}
+	}
+	return true
+}
+
+// listFolders returns the folders on the server that should be synchronized.
+// Mailboxes that cannot be selected are skipped.
 func (h *Handler) listFolders() ([]string, error) {
 
 	includeAll := false
@@ -225,26 +358,26 @@ func (h *Handler) listFolders() ([]string, error) {
 		excludedFolders[folder] = true
 	}
 
-	mboxChan := make(chan *imap.MailboxInfo, 10)
-	errChan := make(chan error, 1)
-	go func() {
-		if err := h.client.List("", "*", mboxChan); err != nil {
-			errChan <- err
-		}
-	}()
+	mailboxes, err := h.listMailboxes()
+	if err != nil {
+		return nil, err
+	}
 
 	var folderNames []string
-	for mb := range mboxChan {
-		if mb == nil {
-			// We're done
-			break
-		}
-
+	for _, mb := range mailboxes {
 		// Check if this mailbox should be excluded
 		if _, ok := excludedFolders[mb.Name]; ok {
 			continue
 		}
 
+		if !selectable(mb) {
+			if _, ok := includedFolders[mb.Name]; ok {
+				return nil, fmt.Errorf("folder %s cannot be selected on the server (%s), it only contains other folders",
+					mb.Name, strings.Join(mb.Attributes, " "))
+			}
+			continue
+		}
+
 		if !includeAll {
 			if _, ok := includedFolders[mb.Name]; !ok {
 				continue
@@ -255,13 +388,6 @@ func (h *Handler) listFolders() ([]string, error) {
 		folderNames = append(folderNames, mb.Name)
 	}
 
-	// Check if an error occurred while fetching data
-	select {
-	case err := <-errChan:
-		return nil, err
-	default:
-	}
-
 	// Check if any of the specified folders were missing on the server
 	for folder, seen := range includedFolders {
 		if !seen {
@@ -274,8 +400,10 @@ func (h *Handler) listFolders() ([]string, error) {
 
 // CheckMessages checks for new/unindexed messages on the server
 // If 'fullScan' is set to true, we will iterate through all messages, and check for
-// any updated flags that doesn't match our current set
-func (h *Handler) CheckMessages(ctx context.Context, syncdb *sync.DB, fullScan bool) error {
+// any updated flags that doesn't match our current set.
+// Folders that have been renamed on the server are detected, and 'renames' can be
+// used to specify renames that cannot be detected automatically.
+func (h *Handler) CheckMessages(ctx context.Context, syncdb *sync.DB, fullScan bool, renames map[string]string) error {
 	var err error
 
 	mailboxes, err := h.listFolders()
@@ -283,20 +411,124 @@ func (h *Handler) CheckMessages(ctx context.Context, syncdb *sync.DB, fullScan b
 		return err
 	}
 
+	err = h.handleRenames(ctx, syncdb, mailboxes, renames)
+	if err != nil {
+		return err
+	}
+
+	estimates := make(map[string]int, len(mailboxes))
+	total := 0
 	for _, mb := range mailboxes {
-		err = createMailDir(filepath.Join(h.maildirPath, mb))
+		estimates[mb], err = h.estimateNewMessages(mb, fullScan)
 		if err != nil {
 			return err
 		}
+		total += estimates[mb]
+	}
 
-		err = h.mailboxFetchMessages(ctx, syncdb, mb, fullScan)
+	progress := progressbar.NewOptions(total, progressbar.OptionSetDescription("checking messages"))
+	for _, mb := range mailboxes {
+		mailboxPath, err := h.folderPath(ctx, syncdb, mb)
+		if err != nil {
+			return err
+		}
+		err = createMailDir(mailboxPath)
+		if err != nil {
+			return err
+		}
+
+		err = h.updateFolderMetadata(ctx, syncdb, mb)
+		if err != nil {
+			return err
+		}
+
+		progress.Describe(mb)
+		err = h.mailboxFetchMessages(ctx, syncdb, mb, fullScan, progress, estimates[mb])
+		if errors.Is(err, sync.ErrLocked) {
+			// The rest of the folder is fetched on the next run.
+			// Other folders are still tried, since the lock may be released at any time.
+			h.stats.Locked = append(h.stats.Locked, mb)
+			continue
+		}
 		if err != nil {
 			return err
 		}
 	}
+	progress.Finish()
 	return nil
 }
 
+// estimateNewMessages returns the number of messages in mailbox that we will have to check,
+// based on the number of messages in it, and the UIDs we've already seen.
+// UIDs may have been skipped, so the actual number can be lower.
+func (h *Handler) estimateNewMessages(mailbox string, fullScan bool) (int, error) {
+	items := []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext}
+	if h.caps.Has(CapObjectID) {
+		items = append(items, statusMailboxID)
+	}
+	status, err := h.client.Status(mailbox, items)
+	if err != nil {
+		return 0, err
+	}
+
+	// Remember the id of the mailbox, so that we can recognize it if it's renamed
+	if id := objectID(status.Items[statusMailboxID]); id != "" {
+		h.cfg.MailboxIDs[mailbox] = id
+	}
+
+	messages := int(status.Messages)
+	estimate := messages
+	if !fullScan && status.UidNext != 0 {
+		lastSeenUID := h.getLastSeenUID(mailbox)
+		estimate = 0
+		if status.UidNext > lastSeenUID+1 {
+			estimate = int(status.UidNext - 1 - lastSeenUID)
+		}
+	}
+
+	// At most one batch of older messages is fetched from folders that are being backfilled
+	if h.isNewFolder(mailbox) || h.isBackfilling(mailbox) {
+		if batch := h.mailbox.BackfillBatch; batch > 0 {
+			if h.isNewFolder(mailbox) {
+				estimate = batch
+			} else {
+				estimate += batch
+			}
+		} else {
+			estimate = messages
+		}
+	}
+
+	if estimate > messages {
+		return messages, nil
+	}
+	return estimate, nil
+}
+
+// folderPath returns the local path of folder. Folder names are escaped when stored locally,
+// and the mapping is kept in the sync database, see sync.DB.FolderPath
+func (h *Handler) folderPath(ctx context.Context, syncdb *sync.DB, folder string) (string, error) {
+	if path, ok := h.localPaths[folder]; ok {
+		return path, nil
+	}
+
+	// We need the hierarchy delimiter of the folder
+	if _, ok := h.delimiters[folder]; !ok {
+		_, err := h.listMailboxes()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	rel, err := syncdb.FolderPath(ctx, h.maildirPath, folder, h.delimiters[folder])
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(h.maildirPath, rel)
+	h.localPaths[folder] = path
+	return path, nil
+}
+
 // createMailDir creates new directories to store maildir entries in
 // with the correct subfolders and permissions
 func createMailDir(mailboxPath string) error {
@@ -0,0 +1,95 @@
+package imap
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// noselectStore returns a store where Archive and Shared only contain other folders
+func noselectStore() *fakeStore {
+	store := newFakeStore()
+	for _, name := range []string{"INBOX", "Archive", "Archive/2023", "Archive/2024", "Shared", "Shared/Team", "Trash"} {
+		store.add(name)
+	}
+	store.folders["Archive"].attributes = []string{`\Noselect`, `\HasChildren`}
+	store.folders["Archive/2023"].attributes = []string{`\HasNoChildren`}
+	store.folders["Shared"].attributes = []string{`\NONEXISTENT`, `\HasChildren`}
+	return store
+}
+
+func TestListFoldersNoselect(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "all folders",
+			want: []string{"Archive/2023", "Archive/2024", "INBOX", "Shared/Team", "Trash"},
+		},
+		{
+			name:    "children of a \\Noselect folder",
+			include: []string{"Archive/2024", "Shared/Team"},
+			want:    []string{"Archive/2024", "Shared/Team"},
+		},
+		{
+			name:    "included \\Noselect folder",
+			include: []string{"INBOX", "Archive"},
+			wantErr: `folder Archive cannot be selected on the server (\Noselect \HasChildren)`,
+		},
+	}
+
+	s := noselectStore().server(t)
+	for _, tt := range tests {
+		mailbox := s.mailbox()
+		mailbox.Folders.Include = tt.include
+		h := s.connect(tempDir(t), mailbox)
+
+		got, err := h.listFolders()
+		if tt.wantErr != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("%s: listFolders() = %v, want error %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: listFolders() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMessagesNoselect(t *testing.T) {
+	maildir := tempDir(t)
+	syncdb := newTestDB(t, maildir)
+	s := noselectStore().server(t)
+	h := s.connect(maildir, s.mailbox())
+
+	err := h.CheckMessages(context.Background(), syncdb, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected := map[string]bool{}
+	for _, cmd := range s.received() {
+		command, args := splitWord(cmd)
+		if command == "SELECT" || command == "EXAMINE" {
+			selected[unquote(args)] = true
+		}
+	}
+	for _, name := range []string{"Archive", "Shared"} {
+		if selected[name] {
+			t.Errorf("%s was selected", name)
+		}
+	}
+	for _, name := range []string{"INBOX", "Archive/2023", "Archive/2024", "Shared/Team", "Trash"} {
+		if !selected[name] {
+			t.Errorf("%s was not selected", name)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package imap
 
-import "os"
+import (
+	"bufio"
+	"io"
+	"os"
+)
 
 // FileLiteral wraps a file in order to support the imap.Literal interface
 type FileLiteral struct {
@@ -16,3 +20,93 @@ func (l *FileLiteral) Len() int {
 
 	return int(stat.Size())
 }
+
+// CRLFLiteral wraps a file in order to support the imap.Literal interface,
+// converting bare LF line endings to CRLF as required by IMAP.
+// Existing CRLF line endings are left as is.
+type CRLFLiteral struct {
+	r      *bufio.Reader
+	length int
+
+	prevCR    bool // The last byte read from the file was CR
+	pendingLF bool // We've returned a CR, and still have to return the LF
+}
+
+// NewCRLFLiteral creates a CRLFLiteral reading from f.
+// The file is read once to find the length after conversion, and is then rewound.
+func NewCRLFLiteral(f *os.File) (*CRLFLiteral, error) {
+	length, err := crlfLength(f)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CRLFLiteral{r: bufio.NewReader(f), length: length}, nil
+}
+
+// crlfLength returns the number of bytes in r once bare LFs have been converted to CRLF
+func crlfLength(r io.Reader) (int, error) {
+	buf := make([]byte, 32*1024)
+	length := 0
+	prevCR := false
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' && !prevCR {
+				length++
+			}
+			prevCR = b == '\r'
+		}
+		length += n
+
+		if err == io.EOF {
+			return length, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Len returns the size after conversion
+func (l *CRLFLiteral) Len() int {
+	return l.length
+}
+
+// Read reads converted data into p
+func (l *CRLFLiteral) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if l.pendingLF {
+			p[n] = '\n'
+			n++
+			l.pendingLF = false
+			continue
+		}
+
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				return n, nil
+			}
+			return n, err
+		}
+
+		if b == '\n' && !l.prevCR {
+			p[n] = '\r'
+			n++
+			l.pendingLF = true
+			l.prevCR = false
+			continue
+		}
+
+		p[n] = b
+		n++
+		l.prevCR = b == '\r'
+	}
+	return n, nil
+}
@@ -0,0 +1,137 @@
+package imap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// toCRLF converts bare LFs in s to CRLF, one byte at a time
+func toCRLF(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' && (i == 0 || s[i-1] != '\r') {
+			sb.WriteByte('\r')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// largeMessage returns a message of at least size bytes with mixed line endings,
+// where a CRLF is split across every multiple of 4096 bytes, the smallest
+// buffer used when reading
+func largeMessage(size int) string {
+	var sb strings.Builder
+	sb.WriteString("Subject: large\n\n")
+	for i := 0; sb.Len() < size; i++ {
+		if next := (sb.Len()/4096 + 1) * 4096; next-sb.Len() < 100 {
+			sb.WriteString(strings.Repeat("x", next-sb.Len()-1))
+			sb.WriteString("\r\n")
+			continue
+		}
+		if i%2 == 0 {
+			sb.WriteString("a line ending with LF\n")
+		} else {
+			sb.WriteString("a line ending with CRLF\r\n")
+		}
+	}
+	return sb.String()
+}
+
+func TestCRLFLiteral(t *testing.T) {
+	large := largeMessage(200 * 1024)
+	for _, size := range []int{4096, 32 * 1024} {
+		if large[size-1] != '\r' || large[size] != '\n' {
+			t.Fatalf("the large message doesn't split a CRLF at offset %d", size)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{
+			name:    "LF",
+			message: "Subject: test\n\nLine 1\nLine 2\n",
+			want:    "Subject: test\r\n\r\nLine 1\r\nLine 2\r\n",
+		},
+		{
+			name:    "CRLF",
+			message: "Subject: test\r\n\r\nLine 1\r\nLine 2\r\n",
+			want:    "Subject: test\r\n\r\nLine 1\r\nLine 2\r\n",
+		},
+		{
+			name:    "mixed",
+			message: "Subject: test\r\n\nLine 1\nLine 2\r\nLine 3",
+			want:    "Subject: test\r\n\r\nLine 1\r\nLine 2\r\nLine 3",
+		},
+		{
+			name:    "bare CR",
+			message: "Line 1\rLine 2\r\r\n\n",
+			want:    "Line 1\rLine 2\r\r\n\r\n",
+		},
+		{
+			name:    "leading LF",
+			message: "\n\nLine 1",
+			want:    "\r\n\r\nLine 1",
+		},
+		{
+			name: "empty",
+		},
+		{
+			name:    "larger than the buffers",
+			message: large,
+		},
+	}
+
+	dir := tempDir(t)
+	for _, tt := range tests {
+		if tt.want == "" {
+			tt.want = toCRLF(tt.message)
+		}
+		path := filepath.Join(dir, tt.name)
+		err := ioutil.WriteFile(path, []byte(tt.message), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Read it both with large buffers, and one byte at a time
+		for _, oneByte := range []bool{false, true} {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := NewCRLFLiteral(f)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+
+			var got []byte
+			if oneByte {
+				got, err = ioutil.ReadAll(iotest.OneByteReader(l))
+			} else {
+				got, err = ioutil.ReadAll(l)
+			}
+			f.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+
+			if !bytes.Equal(got, []byte(tt.want)) {
+				t.Errorf("%s (one byte at a time: %v): converted message differs, got %d bytes, want %d", tt.name, oneByte, len(got), len(tt.want))
+				if len(tt.want) < 100 {
+					t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+				}
+			}
+			if l.Len() != len(tt.want) {
+				t.Errorf("%s: Len() = %d, want %d", tt.name, l.Len(), len(tt.want))
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/yzzyx/nm-imap-sync/sync"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// Annotations of messages, as defined in RFC 5257
+const (
+	// fetchAnnotation requests the private and shared values of all annotations
+	fetchAnnotation imap.FetchItem = "ANNOTATION (/* (value.priv value.shared))"
+	// annotationItem is the name of the annotations in FETCH responses
+	annotationItem imap.FetchItem = "ANNOTATION"
+)
+
+// annotationProperty is the prefix of the notmuch properties that annotations are stored in
+const annotationProperty = "imap.annotation."
+
+// syncsAnnotations returns true if annotations of new messages should be fetched
+func (h *Handler) syncsAnnotations() bool {
+	return h.mailbox.SyncMetadata && h.caps.Has(CapAnnotate)
+}
+
+// annotations returns the annotations of msg by entry. The private value of an
+// entry is used if it's set, since it's the one the user has written.
+func annotations(msg *imap.Message) map[string]string {
+	fields, ok := msg.Items[annotationItem].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	result := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		entry, err := imap.ParseString(fields[i])
+		if err != nil {
+			continue
+		}
+		attribs, _ := fields[i+1].([]interface{})
+
+		var private, shared string
+		for j := 0; j+1 < len(attribs); j += 2 {
+			name, _ := imap.ParseString(attribs[j])
+			// Values are NIL if they're not set
+			value, _ := imap.ParseString(attribs[j+1])
+			switch strings.ToLower(name) {
+			case "value.priv":
+				private = value
+			case "value.shared":
+				shared = value
+			}
+		}
+
+		if private != "" {
+			result[entry] = private
+		} else if shared != "" {
+			result[entry] = shared
+		}
+	}
+	return result
+}
+
+// setAnnotations stores annotations as properties of m, named after annotationProperty
+// and the entry, i.e. imap.annotation.comment for /comment
+func setAnnotations(m *notmuch.Message, annotations map[string]string) error {
+	for entry, value := range annotations {
+		key := annotationProperty + strings.TrimPrefix(entry, "/")
+		err := sync.RemoveMessageProperties(m, key)
+		if err != nil {
+			return err
+		}
+		err = sync.AddMessageProperty(m, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateFolderMetadata fetches the configured METADATA entries of mailbox into the sync
+// database, as defined in RFC 5464. Nothing is done if the server doesn't support it.
+// Metadata is never written back to the server.
+func (h *Handler) updateFolderMetadata(ctx context.Context, syncdb *sync.DB, mailbox string) error {
+	if !h.mailbox.SyncMetadata || !h.caps.Has(CapMetadata) {
+		return nil
+	}
+
+	entries, err := h.getMetadata(mailbox, h.mailbox.FolderMetadataEntries())
+	if err != nil {
+		// Metadata is only informational, so it doesn't stop the synchronization
+		log.Printf("%s: cannot fetch folder metadata: %v\n", mailbox, err)
+		return nil
+	}
+	return syncdb.SetFolderMetadata(ctx, h.maildirPath, mailbox, entries)
+}
+
+// getMetadata runs the GETMETADATA command for entries on mailbox.
+// Entries that are not set on the server are not included in the result.
+func (h *Handler) getMetadata(mailbox string, entries []string) (map[string]string, error) {
+	encoded, err := utf7.Encoding.NewEncoder().String(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+
+	result := make(map[string]string)
+	var parseErr error
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok || name != CapMetadata {
+			return responses.ErrUnhandled
+		}
+		if len(fields) < 2 {
+			parseErr = fmt.Errorf("invalid METADATA response: %v", fields)
+			return nil
+		}
+
+		values, _ := fields[1].([]interface{})
+		for i := 0; i+1 < len(values); i += 2 {
+			entry, err := imap.ParseString(values[i])
+			if err != nil {
+				parseErr = fmt.Errorf("invalid METADATA entry: %v", values[i])
+				return nil
+			}
+			// Entries that are not set are NIL
+			value, _ := imap.ParseString(values[i+1])
+			result[entry] = value
+		}
+		return nil
+	})
+
+	cmd := &imap.Command{
+		Name:      "GETMETADATA",
+		Arguments: []interface{}{imap.FormatMailboxName(encoded), list},
+	}
+	status, err := h.client.Execute(cmd, handler)
+	if err == nil && status != nil && status.Type != imap.StatusRespOk {
+		err = &imap.ErrStatusResp{Resp: status}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, parseErr
+}
@@ -0,0 +1,52 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yzzyx/nm-imap-sync/sync"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+func TestSetAnnotations(t *testing.T) {
+	maildir := tempDir(t)
+	syncdb := newTestDB(t, maildir)
+	storeLocal(t, syncdb, maildir, "INBOX", fakeMail{messageID: "1@example.com"})
+
+	// Annotations fetched again replace the earlier values of the same entry
+	updates := []map[string]string{
+		{"/comment": "call back", "/altsubject": "Invoice"},
+		{"/comment": "done"},
+	}
+	var got map[string]string
+	for _, annotations := range updates {
+		err := syncdb.WrapRW(func(db *notmuch.DB) error {
+			m, err := db.FindMessage("1@example.com")
+			if err != nil {
+				return err
+			}
+			defer m.Close()
+
+			err = setAnnotations(m, annotations)
+			if err != nil {
+				return err
+			}
+			got = make(map[string]string)
+			for _, prop := range sync.MessageProperties(m, annotationProperty) {
+				got[prop.Key] = prop.Value
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		"imap.annotation.comment":    "done",
+		"imap.annotation.altsubject": "Invoice",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("properties = %v, want %v", got, want)
+	}
+}
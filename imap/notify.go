@@ -0,0 +1,64 @@
+package imap
+
+import (
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// MaxNewMailSamples is the number of new messages that are described in NewMail
+const MaxNewMailSamples = 5
+
+// NewMessage describes a message that was downloaded
+type NewMessage struct {
+	Folder  string
+	From    string
+	Subject string
+}
+
+// NewMail contains the messages downloaded into folders that notify is enabled for.
+// See config.Mailbox.NotifiesFolder.
+type NewMail struct {
+	Count   map[string]int // Number of new messages by folder
+	Samples []NewMessage   // The first new messages, up to MaxNewMailSamples
+}
+
+// Total returns the number of new messages in all folders
+func (n NewMail) Total() int {
+	total := 0
+	for _, count := range n.Count {
+		total += count
+	}
+	return total
+}
+
+// recordNewMail adds m, which was just downloaded into mailbox, to the new mail in
+// the stats, unless the folder doesn't notify or m has a tag that mustn't notify
+func (h *Handler) recordNewMail(m *notmuch.Message, mailbox string) {
+	if !h.mailbox.NotifiesFolder(mailbox) {
+		return
+	}
+
+	ignored := false
+	tags := m.Tags()
+	tag := &notmuch.Tag{}
+	for tags.Next(&tag) {
+		if h.mailbox.NotifyIgnoresTag(tag.Value) {
+			ignored = true
+		}
+	}
+	tags.Close()
+	if ignored {
+		return
+	}
+
+	if h.stats.NewMail.Count == nil {
+		h.stats.NewMail.Count = make(map[string]int)
+	}
+	h.stats.NewMail.Count[mailbox]++
+	if len(h.stats.NewMail.Samples) < MaxNewMailSamples {
+		h.stats.NewMail.Samples = append(h.stats.NewMail.Samples, NewMessage{
+			Folder:  mailbox,
+			From:    m.Header("From"),
+			Subject: m.Header("Subject"),
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// Object ids defined in RFC 8474
+const (
+	fetchEmailID    imap.FetchItem  = "EMAILID"
+	statusMailboxID imap.StatusItem = "MAILBOXID"
+)
+
+// objectID returns the object id in v, which is either
+// an atom, or a parenthesized list containing a single atom
+func objectID(v interface{}) string {
+	switch id := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		if len(id) == 0 {
+			return ""
+		}
+		return fmt.Sprint(id[0])
+	default:
+		return fmt.Sprint(id)
+	}
+}
+
+// emailID returns the EMAILID of msg, or an empty string if the server didn't return it
+func emailID(msg *imap.Message) string {
+	return objectID(msg.Items[fetchEmailID])
+}
+
+// messageIdentity contains the ids a server may give a message, which are the same in all folders
+type messageIdentity struct {
+	GmailMessageID uint64
+	EmailID        string
+
+	// MessageID is the Message-ID header from the envelope of the message.
+	// It's only filled in for messages that would otherwise be downloaded.
+	MessageID string
+}
+
+// identity returns the server-wide ids of msg
+func identity(msg *imap.Message) messageIdentity {
+	return messageIdentity{
+		GmailMessageID: gmailMessageID(msg),
+		EmailID:        emailID(msg),
+	}
+}
+
+// lookup returns the message id of a message we may already have with the same identity.
+// Messages that are only matched by their Message-ID header might not exist locally.
+func (id messageIdentity) lookup(ctx context.Context, syncdb *sync.DB) (string, error) {
+	if id.EmailID != "" {
+		messageID, err := syncdb.LookupEmailID(ctx, id.EmailID)
+		if err != nil || messageID != "" {
+			return messageID, err
+		}
+	}
+	if id.GmailMessageID != 0 {
+		messageID, err := syncdb.LookupGmailMessage(ctx, id.GmailMessageID)
+		if err != nil || messageID != "" {
+			return messageID, err
+		}
+	}
+	if !isGeneratedMessageID(id.MessageID) {
+		return id.MessageID, nil
+	}
+	return "", nil
+}
+
+// linkExistingMessage checks if the message with uid in mailbox is a message we've already
+// downloaded from another folder, i.e. another Gmail label, or before it was moved,
+// or a message with the same Message-ID that notmuch already has.
+// If so, the UID is added to the message, and the folder tags for mailbox are applied,
+// so that we don't have to download it again. serverTags are the tags
+// corresponding to the flags of the message on the server.
+func (h *Handler) linkExistingMessage(ctx context.Context, syncdb *sync.DB, mailbox string, uidValidity uint32, uid uint32, id messageIdentity, serverTags []string) (bool, error) {
+	messageID, err := id.lookup(ctx, syncdb)
+	if err != nil || messageID == "" {
+		return false, err
+	}
+
+	// The flags may have been changed on the server when the message was moved or copied,
+	// so they're compared with the tags we synchronized before
+	info, err := syncdb.CheckTagsMessage(ctx, messageID, serverTags)
+	if err != nil {
+		return false, err
+	}
+	info.UIDs = append(info.UIDs, sync.UID{
+		FolderName:  mailbox,
+		UIDValidity: int(uidValidity),
+		UID:         int(uid),
+	})
+	info.GmailMessageID = id.GmailMessageID
+	info.EmailID = id.EmailID
+
+	err = syncdb.WrapRW(func(db *notmuch.DB) error {
+		m, err := db.FindMessage(messageID)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+
+		if tag := h.mailbox.FolderTag(mailbox); tag != "" {
+			err = m.AddTag(tag)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Messages that notmuch has, but that we haven't synchronized before,
+		// keep their tags, and use the flags on the server as their synchronized state
+		if !info.Created {
+			for _, tag := range info.AddedTags {
+				err = m.AddTag(tag)
+				if err != nil {
+					return err
+				}
+			}
+			for _, tag := range info.RemovedTags {
+				err = m.RemoveTag(tag)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return h.applyFolderTags(m, mailbox)
+	})
+	if err == notmuch.ErrNotFound {
+		// The message has been removed locally, so we have to download it again
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = syncdb.AddMessageSyncInfo(ctx, info, serverTags)
+	if err != nil {
+		return false, err
+	}
+	return true, h.updateLocation(ctx, syncdb, messageID)
+}
+
+// mailboxID returns the MAILBOXID of mailbox, or an empty string if the server doesn't support it
+func (h *Handler) mailboxID(mailbox string) (string, error) {
+	if !h.caps.Has(CapObjectID) {
+		return "", nil
+	}
+	status, err := h.client.Status(mailbox, []imap.StatusItem{statusMailboxID})
+	if err != nil {
+		return "", err
+	}
+	return objectID(status.Items[statusMailboxID]), nil
+}
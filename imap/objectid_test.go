@@ -0,0 +1,173 @@
+package imap
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+func TestObjectID(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{name: "missing", v: nil, want: ""},
+		{name: "atom", v: "M6d99ac3275bb4e", want: "M6d99ac3275bb4e"},
+		{name: "list", v: []interface{}{"M6d99ac3275bb4e"}, want: "M6d99ac3275bb4e"},
+		{name: "empty list", v: []interface{}{}, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := objectID(tt.v); got != tt.want {
+			t.Errorf("%s: objectID(%v) = %q, want %q", tt.name, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestEmailIDCopy(t *testing.T) {
+	tests := []struct {
+		name   string
+		caps   []string
+		linked bool // Whether the copy is recognized as the message we have
+	}{
+		{
+			name:   "OBJECTID",
+			caps:   []string{CapObjectID},
+			linked: true,
+		},
+		{
+			name: "no OBJECTID",
+		},
+	}
+
+	for _, tt := range tests {
+		ctx := context.Background()
+		maildir := tempDir(t)
+		syncdb := newTestDB(t, maildir)
+
+		// The Message-ID of the copy differs, so that only the EMAILID can match it
+		mail := fakeMail{uid: 1, flags: []string{imap.SeenFlag}, messageID: "original@example.com", emailID: "E1"}
+		copied := fakeMail{uid: 1, flags: []string{imap.SeenFlag}, messageID: "copy@example.com", emailID: "E1"}
+		store := newFakeStore(tt.caps...)
+		store.add("A", mail)
+		store.add("B", copied)
+		s := store.server(t)
+		h := s.connect(maildir, s.mailbox())
+
+		// The message was downloaded from A during an earlier run
+		storeLocal(t, syncdb, maildir, "A", mail)
+		err := createMailDir(filepath.Join(maildir, "B"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = syncdb.AddMessageSyncInfo(ctx, sync.MessageInfo{
+			MessageID: mail.messageID,
+			EmailID:   mail.emailID,
+			UIDs:      []sync.UID{{FolderName: "A", UIDValidity: store.uidValidity("A"), UID: 1}},
+		}, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.setLastSeenUID("A", 1)
+		h.setLastSeenUID("B", 0)
+
+		err = h.mailboxFetchMessages(ctx, syncdb, "B", false, discardProgress(), 0)
+		if err != nil {
+			t.Fatalf("%s: cannot synchronize B: %v", tt.name, err)
+		}
+
+		// EMAILID is only requested from servers supporting it
+		requested := false
+		for _, cmd := range s.received() {
+			if strings.HasPrefix(cmd, "UID FETCH") && strings.Contains(cmd, "EMAILID") {
+				requested = true
+			}
+		}
+		if requested != tt.linked {
+			t.Errorf("%s: EMAILID requested = %v, want %v", tt.name, requested, tt.linked)
+		}
+
+		uids, err := syncdb.LookupUIDs(ctx, mail.messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []sync.UID{{FolderName: "A", UIDValidity: store.uidValidity("A"), UID: 1}}
+		if tt.linked {
+			want = append(want, sync.UID{FolderName: "B", UIDValidity: store.uidValidity("B"), UID: 1})
+		}
+		if !reflect.DeepEqual(uids, want) {
+			t.Errorf("%s: UIDs = %v, want %v", tt.name, uids, want)
+		}
+	}
+}
+
+func TestRenameByMailboxID(t *testing.T) {
+	ctx := context.Background()
+	maildir := tempDir(t)
+	syncdb := newTestDB(t, maildir)
+
+	mail := fakeMail{uid: 1, messageID: "renamed@example.com", emailID: "E1"}
+	store := newFakeStore(CapObjectID)
+	store.add("Old", mail)
+	s := store.server(t)
+	h := s.connect(maildir, s.mailbox())
+
+	// The MAILBOXID of Old is stored when it's synchronized
+	_, err := h.estimateNewMessages("Old", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.cfg.MailboxIDs["Old"] != "MOld" {
+		t.Fatalf("MAILBOXID of Old = %q, want MOld", h.cfg.MailboxIDs["Old"])
+	}
+	storeLocal(t, syncdb, maildir, "Old", mail)
+	err = syncdb.AddMessageSyncInfo(ctx, sync.MessageInfo{
+		MessageID: mail.messageID,
+		UIDs:      []sync.UID{{FolderName: "Old", UIDValidity: store.uidValidity("Old"), UID: 1}},
+	}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.setLastSeenUID("Old", 1)
+
+	// Old is renamed to New on the server, while a copy of it is created as Copy.
+	// Both contain the same messages, so only the MAILBOXID tells them apart.
+	store.add("Copy", mail)
+	store.add("New", mail)
+	store.mu.Lock()
+	store.folders["New"].mailboxID = "MOld"
+	store.folders["New"].uidValidity = store.folders["Old"].uidValidity
+	store.folders["Copy"].uidValidity = store.folders["Old"].uidValidity
+	delete(store.folders, "Old")
+	store.mu.Unlock()
+
+	err = h.handleRenames(ctx, syncdb, []string{"Copy", "New"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := h.cfg.LastSeenUID["New"]; !ok {
+		t.Errorf("Old was not renamed to New")
+	}
+	if _, ok := h.cfg.LastSeenUID["Old"]; ok {
+		t.Errorf("Old is still known")
+	}
+	if h.cfg.MailboxIDs["New"] != "MOld" {
+		t.Errorf("MAILBOXID of New = %q, want MOld", h.cfg.MailboxIDs["New"])
+	}
+
+	uids, err := syncdb.LookupUIDs(ctx, mail.messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sync.UID{{FolderName: "New", UIDValidity: store.uidValidity("New"), UID: 1}}
+	if !reflect.DeepEqual(uids, want) {
+		t.Errorf("UIDs = %v, want %v", uids, want)
+	}
+}
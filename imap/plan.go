@@ -0,0 +1,298 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// FolderState describes a folder on the server when a plan was made
+type FolderState struct {
+	Name        string
+	UIDValidity uint32
+	// LastSeenUID is our watermark when the plan was made
+	LastSeenUID uint32
+	// HighestUID is the highest UID that was checked, which becomes
+	// the new watermark once the plan has been applied
+	HighestUID uint32
+	// BackfillUID is the low watermark of a folder that was being backfilled
+	// when the plan was made, or 0
+	BackfillUID uint32
+	// LowestUID is the low watermark once the plan has been applied,
+	// or 0 if no older messages remain to be backfilled
+	LowestUID uint32
+}
+
+// PlanFetch checks all folders for new messages and changed flags, like CheckMessages,
+// but instead of making any changes, the changes that are needed are returned
+func (h *Handler) PlanFetch(ctx context.Context, syncdb *sync.DB) ([]FolderState, []FetchAction, error) {
+	mailboxes, err := h.listFolders()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var folders []FolderState
+	var actions []FetchAction
+	for _, mb := range mailboxes {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		mbox, err := h.selectMailbox(mb, true)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		state := FolderState{
+			Name:        mb,
+			UIDValidity: mbox.UidValidity,
+			LastSeenUID: h.getLastSeenUID(mb),
+			BackfillUID: h.cfg.BackfillUID[mb],
+		}
+		state.HighestUID = state.LastSeenUID
+		state.LowestUID = state.BackfillUID
+
+		if mbox.Messages > 0 {
+			folderActions, err := h.planFolder(ctx, syncdb, mbox, &state)
+			if err != nil {
+				return nil, nil, err
+			}
+			actions = append(actions, folderActions...)
+		}
+		folders = append(folders, state)
+	}
+	return folders, actions, nil
+}
+
+// planFolder returns the changes needed in the selected mailbox, in the order
+// mailboxFetchMessages would make them: new messages in ascending UID order, searched
+// in chunks with the folder's search_filter, followed by the older messages
+// that are backfilled during this run, newest first.
+// The watermarks in state are updated to what they'll be once the changes are applied.
+func (h *Handler) planFolder(ctx context.Context, syncdb *sync.DB, mbox *imap.MailboxStatus, state *FolderState) ([]FetchAction, error) {
+	mailbox := mbox.Name
+
+	// Folders that we haven't fetched before are fetched newest first
+	if h.isNewFolder(mailbox) {
+		next := mbox.UidNext
+		if next == 0 {
+			uids, err := h.searchUIDs(0)
+			if err != nil {
+				return nil, err
+			}
+			if len(uids) == 0 {
+				return nil, nil
+			}
+			next = uids[len(uids)-1] + 1
+		}
+		state.HighestUID = next - 1
+		state.LowestUID = next
+	}
+
+	// A changed search_filter may match messages that we have already passed
+	first := uint32(1)
+	if !h.filterChanged(mailbox) {
+		first = state.HighestUID + 1
+	}
+	if state.LowestUID > first {
+		first = state.LowestUID
+	}
+
+	var actions []FetchAction
+	classify := func(window []uint32) error {
+		windowActions, err := h.classifyWindow(ctx, syncdb, mbox, window)
+		if err != nil {
+			return err
+		}
+		actions = append(actions, windowActions...)
+		return nil
+	}
+
+	chunkSize := h.mailbox.UIDChunk()
+	for {
+		last := first + chunkSize - 1
+		final := mbox.UidNext == 0 || last >= mbox.UidNext-1 || last < first
+		if final {
+			last = math.MaxUint32
+		}
+
+		uids, err := h.searchFiltered(mailbox, first, last)
+		if err != nil {
+			return nil, err
+		}
+		for start := 0; start < len(uids); start += fetchWindowSize {
+			end := start + fetchWindowSize
+			if end > len(uids) {
+				end = len(uids)
+			}
+			err = classify(uids[start:end])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(uids) > 0 && uids[len(uids)-1] > state.HighestUID {
+			state.HighestUID = uids[len(uids)-1]
+		}
+		if final {
+			break
+		}
+		if last > state.HighestUID {
+			state.HighestUID = last
+		}
+		first = last + 1
+	}
+
+	if state.LowestUID == 0 {
+		return actions, nil
+	}
+
+	older, complete, err := h.olderUIDs(mailbox, state.LowestUID)
+	if err != nil {
+		return nil, err
+	}
+	for end := len(older); end > 0; end -= fetchWindowSize {
+		start := end - fetchWindowSize
+		if start < 0 {
+			start = 0
+		}
+		err = classify(older[start:end])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if complete {
+		state.LowestUID = 0
+	} else if len(older) > 0 {
+		state.LowestUID = older[0]
+	}
+	return actions, nil
+}
+
+// CheckDrift returns an error if a folder has changed in a way that makes
+// a plan made when it was in state 'planned' invalid
+func (h *Handler) CheckDrift(planned FolderState) error {
+	if lastSeen := h.getLastSeenUID(planned.Name); lastSeen != planned.LastSeenUID {
+		return fmt.Errorf("%s has been synchronized since the plan was made (last seen UID %d, was %d)",
+			planned.Name, lastSeen, planned.LastSeenUID)
+	}
+	if lowest := h.cfg.BackfillUID[planned.Name]; lowest != planned.BackfillUID {
+		return fmt.Errorf("%s has been backfilled since the plan was made (lowest UID %d, was %d)",
+			planned.Name, lowest, planned.BackfillUID)
+	}
+
+	mbox, err := h.selectMailbox(planned.Name, true)
+	if err != nil {
+		return err
+	}
+	if mbox.UidValidity != planned.UIDValidity {
+		return &Error{Class: ErrUIDValidityChanged, Err: fmt.Errorf("%s is now %d, was %d", planned.Name, mbox.UidValidity, planned.UIDValidity)}
+	}
+	return nil
+}
+
+// ErrPlanOutdated is returned by ApplyFetch if a message has changed on the server since the plan was made
+var ErrPlanOutdated = errors.New("the plan is out of date")
+
+// ApplyFetch applies a single change from a plan made by PlanFetch.
+// The message must still exist on the server, with the flags it had when the plan
+// was made, otherwise ErrPlanOutdated is returned and nothing is changed.
+// If the message has been changed since the plan was made, i.e. because local changes to it
+// were pushed to the server, 'recheck' must be set. The flags on the server are then compared
+// with our current state again, in the same way as during a normal synchronization.
+func (h *Handler) ApplyFetch(ctx context.Context, syncdb *sync.DB, action FetchAction, recheck bool) error {
+	mbox, err := h.selectMailbox(action.Folder, true)
+	if err != nil {
+		return err
+	}
+
+	tags, found, err := h.serverTags(action.UID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: the message no longer exists", ErrPlanOutdated)
+	}
+
+	if recheck && !action.Download {
+		actions, err := h.classifyWindow(ctx, syncdb, mbox, []uint32{action.UID})
+		if err != nil {
+			return err
+		}
+		for _, a := range actions {
+			err = h.applyFetch(ctx, syncdb, a)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !sameTags(tags, action.ServerTags) {
+		return fmt.Errorf("%w: the flags of the message have changed", ErrPlanOutdated)
+	}
+	return h.applyFetch(ctx, syncdb, action)
+}
+
+// serverTags returns the tags corresponding to the current flags of the message
+// with uid in the selected mailbox. found is false if the message doesn't exist.
+func (h *Handler) serverTags(uid uint32) (tags []string, found bool, err error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.client.UidFetch(seqSet, []imap.FetchItem{imap.FetchFlags, imap.FetchUid}, messages)
+	}()
+
+	for msg := range messages {
+		if msg == nil || msg.Uid != uid {
+			continue
+		}
+		found = true
+		flags, _ := h.translateFlags(msg.Flags)
+		for flag := range flags {
+			tags = append(tags, flag)
+		}
+	}
+	return tags, found, <-done
+}
+
+// sameTags returns true if a and b contain the same tags, in any order
+func sameTags(a []string, b []string) bool {
+	set := make(map[string]bool, len(a))
+	for _, tag := range a {
+		set[tag] = true
+	}
+	for _, tag := range b {
+		if !set[tag] {
+			return false
+		}
+		delete(set, tag)
+	}
+	return len(set) == 0
+}
+
+// CompleteFolder moves the watermarks of a folder once all changes
+// planned for it have been applied
+func (h *Handler) CompleteFolder(planned FolderState) error {
+	if planned.HighestUID > h.getLastSeenUID(planned.Name) {
+		h.setLastSeenUID(planned.Name, planned.HighestUID)
+	}
+	if planned.LowestUID != 0 {
+		h.cfg.BackfillUID[planned.Name] = planned.LowestUID
+	} else {
+		delete(h.cfg.BackfillUID, planned.Name)
+	}
+	err := h.saveFilter(planned.Name)
+	if err != nil {
+		return err
+	}
+	return h.saveState()
+}
@@ -0,0 +1,222 @@
+package imap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/yzzyx/nm-imap-sync/config"
+)
+
+// capNamespace is the capability for the NAMESPACE command, RFC 2342
+const capNamespace = "NAMESPACE"
+
+// specialUseAttributes are the RFC 6154 attributes that mark special folders.
+// They're not defined by go-imap v1.0.
+var specialUseAttributes = config.SpecialUseAttributes
+
+// Namespace is a prefix under which folders are stored, RFC 2342
+type Namespace struct {
+	Prefix    string
+	Delimiter string
+}
+
+// Namespaces lists the personal, other users' and shared namespaces of the server
+type Namespaces struct {
+	Personal []Namespace
+	Other    []Namespace
+	Shared   []Namespace
+}
+
+// ProbeFeature describes if a feature will be used against the server
+type ProbeFeature struct {
+	Capability  string
+	Available   bool
+	Description string // What the capability is used for, or what we do without it
+}
+
+// ProbeFolder describes a folder on the server
+type ProbeFolder struct {
+	Name         string
+	SpecialUse   string `json:",omitempty"`
+	Synchronized bool
+	Messages     uint32
+	Unseen       uint32
+	UIDNext      uint32
+	UIDValidity  uint32
+	Error        string `json:",omitempty"`
+}
+
+// ProbeResult describes how the server behaves, and how we will use it
+type ProbeResult struct {
+	Server       string
+	Capabilities []string
+	Features     []ProbeFeature
+	Namespaces   *Namespaces `json:",omitempty"`
+	Delimiter    string
+
+	// SpecialUse maps special-use attributes, i.e. \Sent, to folders
+	SpecialUse map[string]string
+
+	// AppendLimit is the largest message the server accepts, or 0 if not announced
+	AppendLimit uint64
+
+	Folders []ProbeFolder
+}
+
+// Probe inspects the server without changing anything, neither on the server nor locally.
+// The status is included for INBOX and all special-use folders.
+func (h *Handler) Probe() (*ProbeResult, error) {
+	result := &ProbeResult{
+		Server:       address(h.mailbox),
+		Capabilities: h.caps.List(),
+		SpecialUse:   make(map[string]string),
+	}
+
+	for _, f := range Features {
+		feature := ProbeFeature{Capability: f.Capability, Available: h.caps.Has(f.Capability), Description: f.Fallback}
+		if feature.Available {
+			feature.Description = f.Description
+		}
+		result.Features = append(result.Features, feature)
+	}
+
+	for _, c := range result.Capabilities {
+		if strings.HasPrefix(c, "APPENDLIMIT=") {
+			result.AppendLimit, _ = strconv.ParseUint(strings.TrimPrefix(c, "APPENDLIMIT="), 10, 64)
+		}
+	}
+
+	if h.caps.Has(capNamespace) {
+		ns, err := h.namespaces()
+		if err != nil {
+			return nil, err
+		}
+		result.Namespaces = ns
+	}
+
+	mailboxes, err := h.listMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	keyFolders := []string{"INBOX"}
+	for _, mb := range mailboxes {
+		if result.Delimiter == "" {
+			result.Delimiter = mb.Delimiter
+		}
+		for _, attr := range mb.Attributes {
+			for _, special := range specialUseAttributes {
+				if strings.EqualFold(attr, special) {
+					result.SpecialUse[special] = mb.Name
+					keyFolders = append(keyFolders, mb.Name)
+				}
+			}
+		}
+	}
+
+	// Folders that the server doesn't mark are taken from special_use_folders, if they exist
+	for _, special := range specialUseAttributes {
+		name, ok := h.mailbox.SpecialUseFolders[special]
+		if _, found := result.SpecialUse[special]; found || !ok {
+			continue
+		}
+		for _, mb := range mailboxes {
+			if mb.Name == name {
+				result.SpecialUse[special] = name
+				keyFolders = append(keyFolders, name)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range keyFolders {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		folder := ProbeFolder{Name: name, Synchronized: h.mailbox.IncludesFolder(name)}
+		for attr, special := range result.SpecialUse {
+			if special == name {
+				folder.SpecialUse = attr
+			}
+		}
+
+		status, err := h.client.Status(name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen, imap.StatusUidNext, imap.StatusUidValidity})
+		if err != nil {
+			folder.Error = err.Error()
+		} else {
+			folder.Messages = status.Messages
+			folder.Unseen = status.Unseen
+			folder.UIDNext = status.UidNext
+			folder.UIDValidity = status.UidValidity
+		}
+		result.Folders = append(result.Folders, folder)
+	}
+	return result, nil
+}
+
+// namespaces runs the NAMESPACE command
+func (h *Handler) namespaces() (*Namespaces, error) {
+	var ns *Namespaces
+	var parseErr error
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok || name != capNamespace {
+			return responses.ErrUnhandled
+		}
+		if len(fields) < 3 {
+			parseErr = fmt.Errorf("invalid NAMESPACE response: %v", fields)
+			return nil
+		}
+
+		ns = &Namespaces{}
+		for i, list := range []*[]Namespace{&ns.Personal, &ns.Other, &ns.Shared} {
+			*list, parseErr = parseNamespaces(fields[i])
+			if parseErr != nil {
+				return nil
+			}
+		}
+		return nil
+	})
+
+	status, err := h.client.Execute(&imap.Command{Name: capNamespace}, handler)
+	if err == nil && status != nil && status.Type != imap.StatusRespOk {
+		err = &imap.ErrStatusResp{Resp: status}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ns, parseErr
+}
+
+// parseNamespaces parses one of the namespace lists in a NAMESPACE response,
+// which is either NIL, or a list of (prefix delimiter) pairs
+func parseNamespaces(field interface{}) ([]Namespace, error) {
+	if field == nil {
+		return nil, nil
+	}
+	list, ok := field.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid namespace list: %v", field)
+	}
+
+	var namespaces []Namespace
+	for _, item := range list {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) < 2 {
+			return nil, fmt.Errorf("invalid namespace: %v", item)
+		}
+		prefix, err := imap.ParseString(pair[0])
+		if err != nil {
+			return nil, err
+		}
+		// The delimiter is NIL if the namespace is flat
+		delimiter, _ := imap.ParseString(pair[1])
+		namespaces = append(namespaces, Namespace{Prefix: prefix, Delimiter: delimiter})
+	}
+	return namespaces, nil
+}
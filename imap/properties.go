@@ -0,0 +1,32 @@
+package imap
+
+import (
+	"context"
+
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// updateLocation updates everything that describes which folders the message with
+// id messageID is stored in, after its UIDs in the sync database have changed
+func (h *Handler) updateLocation(ctx context.Context, syncdb *sync.DB, messageID string) error {
+	err := h.updateFolderTags(ctx, syncdb, messageID)
+	if err != nil {
+		return err
+	}
+	return h.updateProperties(ctx, syncdb, messageID)
+}
+
+// updateProperties makes the location properties of the message with id messageID
+// match its UIDs in the sync database, if store_properties is set.
+// See sync.DB.SetLocationProperties.
+func (h *Handler) updateProperties(ctx context.Context, syncdb *sync.DB, messageID string) error {
+	if !h.mailbox.StoreProperties {
+		return nil
+	}
+
+	uids, err := syncdb.LookupUIDs(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	return syncdb.SetLocationProperties(messageID, uids)
+}
@@ -0,0 +1,40 @@
+package imap
+
+import (
+	"context"
+	"log"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// uidAnomaly returns true if the last seen UID of the selected mailbox is not below its
+// UIDNEXT, even though UIDVALIDITY hasn't changed. This happens when a server has been
+// migrated or repaired without assigning a new UIDVALIDITY, and means that new messages
+// get UIDs that we believe we have already seen.
+func (h *Handler) uidAnomaly(mbox *imap.MailboxStatus) bool {
+	if mbox.UidNext == 0 || h.isNewFolder(mbox.Name) {
+		return false
+	}
+	return h.getLastSeenUID(mbox.Name) >= mbox.UidNext
+}
+
+// startRecovery forgets what we know about the UIDs in the selected mailbox, so that
+// every message in it is fetched again. Messages that we already have are recognized
+// by their Message-ID header (or EMAILID or X-GM-MSGID), and are linked to the new
+// UIDs instead of being downloaded again, keeping their tags.
+func (h *Handler) startRecovery(ctx context.Context, syncdb *sync.DB, mbox *imap.MailboxStatus) error {
+	log.Printf("WARNING: %s: the last seen UID %d is not below UIDNEXT %d on the server, "+
+		"the folder has probably been restored or migrated. All messages in it will be checked again.\n",
+		mbox.Name, h.getLastSeenUID(mbox.Name), mbox.UidNext)
+	h.stats.Anomalies = append(h.stats.Anomalies, mbox.Name)
+
+	_, _, err := syncdb.ResetFolder(ctx, mbox.Name, false)
+	if err != nil {
+		return err
+	}
+
+	h.setLastSeenUID(mbox.Name, 0)
+	delete(h.cfg.BackfillUID, mbox.Name)
+	return h.saveState()
+}
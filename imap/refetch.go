@@ -0,0 +1,88 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// ErrMessageNotFound is returned when a message does not exist on the server
+var ErrMessageNotFound = errors.New("message not found on server")
+
+// Refetch downloads the message with 'uid' in 'folder' again, and replaces
+// any existing local copies in that folder with the new one.
+// If uidValidity is not 0, it must match the current UIDVALIDITY of the folder.
+// ErrMessageNotFound is returned if the message does not exist on the server.
+func (h *Handler) Refetch(ctx context.Context, syncdb *sync.DB, folder string, uidValidity uint32, uid uint32) error {
+	exists, err := h.folderExists(folder)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: folder %s does not exist", ErrMessageNotFound, folder)
+	}
+
+	mbox, err := h.selectMailbox(folder, true)
+	if err != nil {
+		return err
+	}
+
+	if uidValidity != 0 && mbox.UidValidity != uidValidity {
+		return fmt.Errorf("%w: folder %s has a new UIDVALIDITY", ErrMessageNotFound, folder)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = seqSet
+	found, err := h.client.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 || found[0] != uid {
+		return fmt.Errorf("%w: UID %d in %s", ErrMessageNotFound, uid, folder)
+	}
+
+	mailboxPath, err := h.folderPath(ctx, syncdb, folder)
+	if err != nil {
+		return err
+	}
+
+	err = createMailDir(mailboxPath)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := h.getMessage(ctx, syncdb, folder, uid, true)
+	if err != nil {
+		return err
+	}
+
+	messageID, err := syncdb.MessageIDByFilename(newPath)
+	if err != nil {
+		return err
+	}
+
+	return syncdb.ReplaceFiles(messageID, newPath, filepath.Join(mailboxPath, "cur"), filepath.Join(mailboxPath, "new"))
+}
+
+// folderExists returns true if folder exists on the server
+func (h *Handler) folderExists(folder string) (bool, error) {
+	mboxChan := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.client.List("", folder, mboxChan)
+	}()
+
+	exists := false
+	for mb := range mboxChan {
+		if mb != nil && mb.Name == folder {
+			exists = true
+		}
+	}
+	return exists, <-done
+}
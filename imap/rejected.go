@@ -0,0 +1,97 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// rejectedKeywords returns the keywords the server refuses to store in folder
+func (h *Handler) rejectedKeywords(ctx context.Context, syncdb *sync.DB, folder string) (map[string]bool, error) {
+	if rejected, ok := h.rejected[folder]; ok {
+		return rejected, nil
+	}
+
+	keywords, err := syncdb.RejectedKeywords(ctx, folder)
+	if err != nil {
+		return nil, err
+	}
+	rejected := make(map[string]bool, len(keywords))
+	for _, keyword := range keywords {
+		rejected[keyword] = true
+	}
+	h.rejected[folder] = rejected
+	return rejected, nil
+}
+
+// skipRejected returns the flags that the server hasn't refused to store in folder.
+// Skipped keywords are reported in Stats.
+func (h *Handler) skipRejected(ctx context.Context, syncdb *sync.DB, folder string, flags []interface{}) ([]interface{}, error) {
+	rejected, err := h.rejectedKeywords(ctx, syncdb, folder)
+	if err != nil || len(rejected) == 0 {
+		return flags, err
+	}
+
+	kept := flags[:0]
+	for _, flag := range flags {
+		if keyword, ok := flag.(string); ok && rejected[keyword] {
+			h.reportRejected(folder, keyword)
+			continue
+		}
+		kept = append(kept, flag)
+	}
+	return kept, nil
+}
+
+// addEach adds the flags to the message with uid in the selected mailbox one at a time,
+// after the server has refused to add them all at once. Keywords that the server
+// refuses are recorded, so that they're not sent again.
+func (h *Handler) addEach(ctx context.Context, syncdb *sync.DB, uid uint32, flags []interface{}) error {
+	folder := h.client.Mailbox().Name
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	for _, flag := range flags {
+		err := h.client.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{flag}, nil)
+		if err == nil {
+			continue
+		}
+
+		keyword, ok := flag.(string)
+		if !h.client.refused(err) || !ok || isSystemFlag(keyword) {
+			return err
+		}
+
+		log.Printf("%s: the server refused to store the keyword %s, it will not be sent again: %v\n", folder, keyword, err)
+		err = syncdb.RejectKeyword(ctx, folder, keyword)
+		if err != nil {
+			return err
+		}
+		if _, known := h.rejected[folder]; known {
+			h.rejected[folder][keyword] = true
+		}
+		h.reportRejected(folder, keyword)
+	}
+	return nil
+}
+
+// reportRejected adds keyword in folder to Stats.Rejected, unless it's already there
+func (h *Handler) reportRejected(folder string, keyword string) {
+	entry := fmt.Sprintf("%s in %s", keyword, folder)
+	i := sort.SearchStrings(h.stats.Rejected, entry)
+	if i < len(h.stats.Rejected) && h.stats.Rejected[i] == entry {
+		return
+	}
+	h.stats.Rejected = append(h.stats.Rejected, "")
+	copy(h.stats.Rejected[i+1:], h.stats.Rejected[i:])
+	h.stats.Rejected[i] = entry
+}
+
+// isSystemFlag returns true if flag is an IMAP system flag, such as \Seen
+func isSystemFlag(flag string) bool {
+	return len(flag) > 0 && flag[0] == '\\'
+}
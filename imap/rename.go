@@ -0,0 +1,226 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// renameSampleSize is the number of known messages from a disappeared folder
+// that are looked up in a new folder, to decide if it's the same folder
+const renameSampleSize = 20
+
+// ParseRenames parses a list of OLD=NEW folder mappings
+func ParseRenames(values []string) (map[string]string, error) {
+	renames := make(map[string]string, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid rename %q, expected OLD=NEW", v)
+		}
+		renames[parts[0]] = parts[1]
+	}
+	return renames, nil
+}
+
+// handleRenames looks for folders that we've synchronized before, but which no longer
+// exist on the server, and checks if one of the new folders in 'folders' is the same folder
+// under a new name. If so, the local folder is renamed, so that we can continue where we
+// left off, instead of downloading everything again.
+// Folders in 'assumed' are renamed without checking, if they exist in this account.
+func (h *Handler) handleRenames(ctx context.Context, syncdb *sync.DB, folders []string, assumed map[string]string) error {
+	onServer := make(map[string]bool, len(folders))
+	var appeared []string
+	for _, f := range folders {
+		onServer[f] = true
+		if _, known := h.cfg.LastSeenUID[f]; !known {
+			appeared = append(appeared, f)
+		}
+	}
+
+	var disappeared []string
+	for f := range h.cfg.LastSeenUID {
+		if !onServer[f] && h.mailbox.IncludesFolder(f) {
+			disappeared = append(disappeared, f)
+		}
+	}
+	sort.Strings(disappeared)
+
+	// Renames of folders we don't know about may be meant for another account
+	for oldName, newName := range assumed {
+		if _, known := h.cfg.LastSeenUID[oldName]; !known {
+			continue
+		}
+		if !onServer[newName] {
+			return fmt.Errorf("cannot rename %s: %s does not exist on the server", oldName, newName)
+		}
+	}
+
+	// With OBJECTID, the server tells us which folder is which
+	byMailboxID := make(map[string]string)
+	if h.caps.Has(CapObjectID) && len(disappeared) > 0 {
+		for _, newName := range appeared {
+			id, err := h.mailboxID(newName)
+			if err != nil {
+				return err
+			}
+			if id != "" {
+				byMailboxID[id] = newName
+			}
+		}
+	}
+
+	// Find candidates for each disappeared folder
+	renames := make(map[string]string)
+	claimed := make(map[string][]string)
+	for _, oldName := range disappeared {
+		if newName, ok := assumed[oldName]; ok {
+			renames[oldName] = newName
+			claimed[newName] = append(claimed[newName], oldName)
+			continue
+		}
+
+		if id := h.cfg.MailboxIDs[oldName]; id != "" && len(byMailboxID) > 0 {
+			if newName, ok := byMailboxID[id]; ok {
+				renames[oldName] = newName
+				claimed[newName] = append(claimed[newName], oldName)
+			} else {
+				log.Printf("%s no longer exists on the server\n", oldName)
+			}
+			continue
+		}
+
+		var candidates []string
+		for _, newName := range appeared {
+			same, err := h.sameFolder(ctx, syncdb, oldName, newName)
+			if err != nil {
+				return err
+			}
+			if same {
+				candidates = append(candidates, newName)
+			}
+		}
+
+		switch len(candidates) {
+		case 0:
+			log.Printf("%s no longer exists on the server\n", oldName)
+		case 1:
+			renames[oldName] = candidates[0]
+			claimed[candidates[0]] = append(claimed[candidates[0]], oldName)
+		default:
+			log.Printf("%s may have been renamed to any of %s - treating them as new folders, use --assume-renamed to choose one\n",
+				oldName, strings.Join(candidates, ", "))
+		}
+	}
+
+	for oldName, newName := range renames {
+		if len(claimed[newName]) > 1 {
+			log.Printf("%s may have been renamed to %s, but so may %s - treating it as a new folder, use --assume-renamed to choose one\n",
+				oldName, newName, strings.Join(claimed[newName], ", "))
+			continue
+		}
+
+		log.Printf("%s has been renamed to %s\n", oldName, newName)
+		oldPath, err := h.folderPath(ctx, syncdb, oldName)
+		if err != nil {
+			return err
+		}
+		newPath, err := h.folderPath(ctx, syncdb, newName)
+		if err != nil {
+			return err
+		}
+		err = syncdb.RenameFolder(ctx, oldName, newName, oldPath, newPath)
+		if err != nil {
+			return err
+		}
+		err = syncdb.ForgetFolderPath(ctx, h.maildirPath, oldName)
+		if err != nil {
+			return err
+		}
+		delete(h.localPaths, oldName)
+
+		if h.mailbox.AutoFolderTags {
+			_, messageIDs, err := syncdb.FolderUIDs(ctx, newName, -1)
+			if err != nil {
+				return err
+			}
+			for _, messageID := range messageIDs {
+				err = h.updateLocation(ctx, syncdb, messageID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		h.cfg.LastSeenUID[newName] = h.cfg.LastSeenUID[oldName]
+		delete(h.cfg.LastSeenUID, oldName)
+		if uid, ok := h.cfg.BackfillUID[oldName]; ok {
+			h.cfg.BackfillUID[newName] = uid
+			delete(h.cfg.BackfillUID, oldName)
+		}
+		if filter, ok := h.cfg.SearchFilters[oldName]; ok {
+			h.cfg.SearchFilters[newName] = filter
+			delete(h.cfg.SearchFilters, oldName)
+		}
+		if id, ok := h.cfg.MailboxIDs[oldName]; ok {
+			h.cfg.MailboxIDs[newName] = id
+			delete(h.cfg.MailboxIDs, oldName)
+		}
+		err = h.saveState()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameFolder returns true if newName on the server has the same UIDVALIDITY as we've
+// stored for oldName, and at least half of a sample of known messages from oldName
+// are found with the same UIDs and message ids in newName.
+func (h *Handler) sameFolder(ctx context.Context, syncdb *sync.DB, oldName string, newName string) (bool, error) {
+	uids, messageIDs, err := syncdb.FolderUIDs(ctx, oldName, renameSampleSize)
+	if err != nil || len(uids) == 0 {
+		return false, err
+	}
+
+	status, err := h.client.Status(newName, []imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return false, err
+	}
+
+	expected := make(map[uint32]string, len(uids))
+	seqSet := new(imap.SeqSet)
+	for i, uid := range uids {
+		if uid.UIDValidity != int(status.UidValidity) {
+			continue
+		}
+		expected[uint32(uid.UID)] = messageIDs[i]
+		seqSet.AddNum(uint32(uid.UID))
+	}
+	if len(expected) == 0 {
+		return false, nil
+	}
+
+	_, err = h.selectMailbox(newName, true)
+	if err != nil {
+		return false, err
+	}
+
+	ids, err := h.fetchMessageIDs(seqSet)
+	if err != nil {
+		return false, err
+	}
+
+	matches := 0
+	for uid, messageID := range ids {
+		if expected[uid] == messageID {
+			matches++
+		}
+	}
+	return matches*2 >= len(uids), nil
+}
@@ -0,0 +1,85 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+func TestSameFolder(t *testing.T) {
+	store := newFakeStore()
+	for i := uint32(1); i <= 4; i++ {
+		store.add("Projects", fakeMail{uid: i, messageID: fmt.Sprintf("%d@example.com", i)})
+	}
+	// A message without a Message-ID header has no envelope message id
+	store.add("Projects", fakeMail{uid: 5})
+	validity := store.uidValidity("Projects")
+
+	// known returns the sync info of the message with uid in folder, as it was in Projects
+	known := func(folder string, uidValidity int, uid int, messageID string) sync.MessageInfo {
+		return sync.MessageInfo{
+			MessageID: messageID,
+			UIDs:      []sync.UID{{FolderName: folder, UIDValidity: uidValidity, UID: uid}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		oldName  string
+		messages []sync.MessageInfo
+		want     bool
+	}{
+		{
+			name:    "renamed",
+			oldName: "Work",
+			messages: []sync.MessageInfo{
+				known("Work", validity, 1, "1@example.com"),
+				known("Work", validity, 2, "2@example.com"),
+				known("Work", validity, 3, "3@example.com"),
+				known("Work", validity, 5, "5@example.com"),
+			},
+			want: true,
+		},
+		{
+			name:    "other UIDVALIDITY",
+			oldName: "Old",
+			messages: []sync.MessageInfo{
+				known("Old", validity+1, 1, "1@example.com"),
+				known("Old", validity+1, 2, "2@example.com"),
+			},
+		},
+		{
+			name:    "other messages",
+			oldName: "Other",
+			messages: []sync.MessageInfo{
+				known("Other", validity, 1, "1@example.com"),
+				known("Other", validity, 2, "other-2@example.com"),
+				known("Other", validity, 3, "other-3@example.com"),
+			},
+		},
+	}
+
+	ctx := context.Background()
+	maildir := tempDir(t)
+	syncdb := newTestDB(t, maildir)
+	s := store.server(t)
+	h := s.connect(maildir, s.mailbox())
+	for _, tt := range tests {
+		for _, info := range tt.messages {
+			err := syncdb.AddMessageSyncInfo(ctx, info, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+
+		got, err := h.sameFolder(ctx, syncdb, tt.oldName, "Projects")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: sameFolder() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
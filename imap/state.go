@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stateFile is the name of the file in the state directory where mailConfig is stored
+const stateFile = "imap-uids"
+
+type mailConfig struct {
+	// Keep track of last seen UID for each mailbox
+	LastSeenUID map[string]uint32
+
+	// BackfillUID is the lowest UID fetched from folders whose older messages are still
+	// being fetched, newest first. Every message from this UID up to LastSeenUID has been handled.
+	BackfillUID map[string]uint32 `json:",omitempty"`
+
+	// SearchFilters contains the search_filter each mailbox was last searched with
+	SearchFilters map[string]string `json:",omitempty"`
+
+	// MailboxIDs contains the RFC 8474 MAILBOXID of each mailbox, if the server supports it
+	MailboxIDs map[string]string `json:",omitempty"`
+}
+
+// loadState reads the state stored in stateDir.
+// If no state has been saved yet, an empty state is returned.
+func loadState(stateDir string) (mailConfig, error) {
+	cfg := mailConfig{
+		LastSeenUID:   make(map[string]uint32),
+		BackfillUID:   make(map[string]uint32),
+		SearchFilters: make(map[string]string),
+		MailboxIDs:    make(map[string]string),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(stateDir, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+
+	err = json.Unmarshal(data, &cfg)
+	if cfg.BackfillUID == nil {
+		cfg.BackfillUID = make(map[string]uint32)
+	}
+	if cfg.SearchFilters == nil {
+		cfg.SearchFilters = make(map[string]string)
+	}
+	if cfg.MailboxIDs == nil {
+		cfg.MailboxIDs = make(map[string]string)
+	}
+	return cfg, err
+}
+
+// save writes the state to stateDir
+func (cfg mailConfig) save(stateDir string) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(stateDir, stateFile), data, 0600)
+}
+
+// ClearFolderState removes the state of folder from stateDir,
+// so that the next run will check all messages in the folder.
+// The previously stored last seen UID is returned, or 0 if there was none.
+func ClearFolderState(stateDir string, folder string) (uint32, error) {
+	cfg, err := loadState(stateDir)
+	if err != nil {
+		return 0, err
+	}
+
+	// The entries are independent, i.e. a folder that is still being backfilled
+	// may not have a last seen UID yet
+	lastSeen := cfg.LastSeenUID[folder]
+	delete(cfg.LastSeenUID, folder)
+	delete(cfg.BackfillUID, folder)
+	delete(cfg.SearchFilters, folder)
+	delete(cfg.MailboxIDs, folder)
+	return lastSeen, cfg.save(stateDir)
+}
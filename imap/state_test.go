@@ -0,0 +1,57 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClearFolderState(t *testing.T) {
+	stateDir := tempDir(t)
+	cfg, err := loadState(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.LastSeenUID["INBOX"] = 10
+	cfg.LastSeenUID["Archive"] = 20
+	// Archive is being backfilled, and was never fully fetched
+	cfg.BackfillUID["Archive"] = 5
+	cfg.BackfillUID["Old"] = 3
+	cfg.SearchFilters["Old"] = "SINCE 1-Jan-2020"
+	cfg.MailboxIDs["INBOX"] = "M1"
+	cfg.MailboxIDs["Old"] = "M2"
+	err = cfg.save(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		folder   string
+		lastSeen uint32
+	}{
+		{folder: "Old", lastSeen: 0},
+		{folder: "Archive", lastSeen: 20},
+	}
+	for _, tt := range tests {
+		lastSeen, err := ClearFolderState(stateDir, tt.folder)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.folder, err)
+		}
+		if lastSeen != tt.lastSeen {
+			t.Errorf("%s: ClearFolderState() = %d, want %d", tt.folder, lastSeen, tt.lastSeen)
+		}
+	}
+
+	got, err := loadState(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mailConfig{
+		LastSeenUID:   map[string]uint32{"INBOX": 10},
+		BackfillUID:   map[string]uint32{},
+		SearchFilters: map[string]string{},
+		MailboxIDs:    map[string]string{"INBOX": "M1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("state after clearing = %+v, want %+v", got, want)
+	}
+}
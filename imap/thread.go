@@ -0,0 +1,64 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// threadMessage is the part of a notmuch message that inheritThreadTags uses
+type threadMessage interface {
+	AddTag(tag string) error
+	RemoveTag(tag string) error
+}
+
+// inheritThreadTags adds the tags in thread_tag_inherit that are set on other messages in
+// the thread of m to m, and marks it as read if thread_tag_mark_read is set.
+// threadHasTag reports if another message in the thread of m has a tag.
+// Notmuch has already placed m in its thread when it was indexed.
+//
+// baseline holds the tags that are recorded as the state of m on the server. Unless
+// thread_tag_push is set, the changes are made to it as well, so they aren't pushed.
+func (h *Handler) inheritThreadTags(m threadMessage, baseline map[string]bool, threadHasTag func(tag string) (bool, error)) error {
+	inherited := false
+	for _, tag := range h.mailbox.ThreadTagInherit {
+		found, err := threadHasTag(tag)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		err = m.AddTag(tag)
+		if err != nil {
+			return err
+		}
+		if !h.mailbox.ThreadTagPush && h.mailbox.SyncsTag(tag) {
+			baseline[tag] = true
+		}
+		inherited = true
+	}
+
+	if inherited && h.mailbox.ThreadTagMarkRead {
+		if !h.mailbox.ThreadTagPush {
+			delete(baseline, "unread")
+		}
+		return m.RemoveTag("unread")
+	}
+	return nil
+}
+
+// threadHasTag returns true if any other message in the thread of m has tag
+func threadHasTag(db *notmuch.DB, m *notmuch.Message, tag string) (bool, error) {
+	q := db.NewQuery(fmt.Sprintf("thread:%s and tag:%s and not id:%s",
+		quoteTerm(m.ThreadID()), quoteTerm(tag), quoteTerm(m.ID())))
+	defer q.Close()
+
+	return q.CountMessages() > 0, nil
+}
+
+// quoteTerm quotes s for use as the value of a prefixed term in a notmuch query
+func quoteTerm(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
@@ -0,0 +1,124 @@
+package imap
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+)
+
+// fakeMessage keeps track of the tags of a message
+type fakeMessage map[string]bool
+
+func (m fakeMessage) AddTag(tag string) error {
+	m[tag] = true
+	return nil
+}
+
+func (m fakeMessage) RemoveTag(tag string) error {
+	delete(m, tag)
+	return nil
+}
+
+func (m fakeMessage) tags() []string {
+	var tags []string
+	for tag := range m {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// fakeThread returns a threadHasTag function for a thread where the other messages have tags
+func fakeThread(tags ...string) func(string) (bool, error) {
+	return func(tag string) (bool, error) {
+		for _, t := range tags {
+			if t == tag {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+func TestInheritThreadTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		inherit  []string
+		markRead bool
+		push     bool
+		thread   []string
+		want     []string
+		// wantBaseline is the tags recorded as the state on the server
+		wantBaseline []string
+	}{
+		{
+			name:         "muted parent",
+			inherit:      []string{"muted"},
+			markRead:     true,
+			thread:       []string{"muted", "inbox"},
+			want:         []string{"inbox", "muted"},
+			wantBaseline: []string{"muted"},
+		},
+		{
+			name:         "muted parent, pushed to the server",
+			inherit:      []string{"muted"},
+			markRead:     true,
+			push:         true,
+			thread:       []string{"muted", "inbox"},
+			want:         []string{"inbox", "muted"},
+			wantBaseline: []string{"unread"},
+		},
+		{
+			name:         "muted parent without marking as read",
+			inherit:      []string{"muted"},
+			thread:       []string{"muted"},
+			want:         []string{"inbox", "muted", "unread"},
+			wantBaseline: []string{"muted", "unread"},
+		},
+		{
+			name:         "parent not muted",
+			inherit:      []string{"muted"},
+			markRead:     true,
+			thread:       []string{"inbox"},
+			want:         []string{"inbox", "unread"},
+			wantBaseline: []string{"unread"},
+		},
+		{
+			name:         "nothing inherited",
+			thread:       []string{"muted"},
+			want:         []string{"inbox", "unread"},
+			wantBaseline: []string{"unread"},
+		},
+		{
+			name:         "several tags",
+			inherit:      []string{"muted", "killed", "work"},
+			markRead:     true,
+			thread:       []string{"killed", "work"},
+			want:         []string{"inbox", "killed", "work"},
+			wantBaseline: []string{"killed", "work"},
+		},
+	}
+
+	for _, tt := range tests {
+		h := &Handler{mailbox: config.Mailbox{
+			ThreadTagInherit:  tt.inherit,
+			ThreadTagMarkRead: tt.markRead,
+			ThreadTagPush:     tt.push,
+		}}
+		// The new message is unread on the server, and inbox is set locally
+		m := fakeMessage{"inbox": true, "unread": true}
+		baseline := fakeMessage{"unread": true}
+		err := h.inheritThreadTags(m, baseline, fakeThread(tt.thread...))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := m.tags(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: tags = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := baseline.tags(); !reflect.DeepEqual(got, tt.wantBaseline) {
+			t.Errorf("%s: baseline = %v, want %v", tt.name, got, tt.wantBaseline)
+		}
+	}
+}
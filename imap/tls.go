@@ -0,0 +1,115 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package imap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/yzzyx/nm-imap-sync/config"
+)
+
+// FormatFingerprint formats a SHA-256 fingerprint as colon-separated hex
+func FormatFingerprint(fingerprint []byte) string {
+	parts := make([]string, len(fingerprint))
+	for i, b := range fingerprint {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.ToUpper(strings.Join(parts, ":"))
+}
+
+// newTLSConfig returns the TLS configuration used to connect to the server of mailbox.
+// If a fingerprint is configured, the leaf certificate must match it, and the
+// normal verification against the system CAs is skipped.
+func newTLSConfig(mailbox config.Mailbox) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: mailbox.Server}
+	if mailbox.TLSFingerprint == "" {
+		return cfg, nil
+	}
+
+	expected, err := config.ParseFingerprint(mailbox.TLSFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server did not present a certificate")
+		}
+		presented := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(presented[:], expected) {
+			return fmt.Errorf("certificate fingerprint mismatch: expected %s, server presented %s",
+				FormatFingerprint(expected), FormatFingerprint(presented[:]))
+		}
+		return nil
+	}
+	return cfg, nil
+}
+
+// address returns the host:port to connect to for mailbox
+func address(mailbox config.Mailbox) string {
+	port := mailbox.Port
+	if port == 0 {
+		port = 143
+		if mailbox.UseTLS {
+			port = 993
+		}
+	}
+	return fmt.Sprintf("%s:%d", mailbox.Server, port)
+}
+
+// Fingerprint connects to the server of mailbox and returns the SHA-256
+// fingerprint of the certificate it presents, without verifying it.
+// It's used to find the value to use for tls_fingerprint.
+func Fingerprint(mailbox config.Mailbox) ([]byte, error) {
+	if !mailbox.UseTLS && !mailbox.UseStartTLS {
+		return nil, errors.New("neither use_tls nor use_starttls is set")
+	}
+
+	var fingerprint []byte
+	cfg := &tls.Config{
+		ServerName:         mailbox.Server,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server did not present a certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			fingerprint = sum[:]
+			return nil
+		},
+	}
+
+	var c *client.Client
+	var err error
+	if mailbox.UseTLS {
+		c, err = client.DialTLS(address(mailbox), cfg)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c, err = client.Dial(address(mailbox))
+		if err != nil {
+			return nil, err
+		}
+		if err = c.StartTLS(cfg); err != nil {
+			c.Logout()
+			return nil, err
+		}
+	}
+	c.Logout()
+
+	if fingerprint == nil {
+		return nil, errors.New("no certificate received")
+	}
+	return fingerprint, nil
+}
@@ -1,19 +1,29 @@
 package imap
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
 	"github.com/yzzyx/nm-imap-sync/sync"
 )
 
 // Update will add or remove flags to messages according to msgUpdate
-func (h *Handler) Update(syncdb *sync.DB, msgUpdate sync.Update) error {
+func (h *Handler) Update(ctx context.Context, syncdb *sync.DB, msgUpdate sync.Update) error {
+	h.beat()
+	err := h.update(ctx, syncdb, msgUpdate)
+	if err == nil {
+		h.stats.Pushed++
+	}
+	return err
+}
+
+func (h *Handler) update(ctx context.Context, syncdb *sync.DB, msgUpdate sync.Update) error {
 	if msgUpdate.Created {
-		return h.createMessage(syncdb, msgUpdate, msgUpdate.UIDs[0])
+		return h.createMessage(ctx, syncdb, msgUpdate, msgUpdate.UIDs[0])
 	}
 
 	// Check if we actually have to do anything
@@ -21,71 +31,60 @@ func (h *Handler) Update(syncdb *sync.DB, msgUpdate sync.Update) error {
 		return nil
 	}
 
-	// Update all UID's in list
+	// Drafts that are no longer drafts are removed from the server
+	drafts := h.removedDrafts(msgUpdate)
+	if len(drafts) > 0 {
+		err := h.removeMessages(ctx, syncdb, drafts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Update all UID's in list, except in folders that are no longer synchronized
+	updated := false
 	for _, uid := range msgUpdate.UIDs {
-		err := h.updateUID(syncdb, msgUpdate, uid)
+		if len(drafts) > 0 && h.isDraftsFolder(uid.FolderName) {
+			continue
+		}
+		if !h.mailbox.IncludesFolder(uid.FolderName) {
+			continue
+		}
+		err := h.updateUID(ctx, syncdb, msgUpdate, uid)
 		if err != nil {
 			return err
 		}
+		updated = true
+	}
+
+	// If the message is only stored in such folders, there's nothing to update on the server,
+	// but we record the change so that it's not found again during the next run
+	if !updated && len(drafts) == 0 {
+		return syncdb.AddMessageSyncInfo(ctx, msgUpdate.MessageInfo, msgUpdate.WantedTags)
 	}
 	return nil
 }
 
-func (h *Handler) updateUID(syncdb *sync.DB, msgUpdate sync.Update, uid sync.UID) error {
-	status, err := h.client.Select(uid.FolderName, false)
+func (h *Handler) updateUID(ctx context.Context, syncdb *sync.DB, msgUpdate sync.Update, uid sync.UID) error {
+	status, err := h.selectMailbox(uid.FolderName, false)
 	if err != nil {
 		return err
 	}
 
 	if int(status.UidValidity) != uid.UIDValidity {
-		return fmt.Errorf("mailbox %s has new UIDValidity - currently unsupported", uid.FolderName)
+		return &Error{Class: ErrUIDValidityChanged, Err: fmt.Errorf("mailbox %s (currently unsupported)", uid.FolderName)}
 	}
 
-	updateList := []struct {
-		item imap.StoreItem
-		tags []string
-	}{
-		{item: imap.FormatFlagsOp(imap.AddFlags, true), tags: msgUpdate.AddedTags},
-		{item: imap.FormatFlagsOp(imap.RemoveFlags, true), tags: msgUpdate.RemovedTags},
-	}
-
-	for _, update := range updateList {
-		// UidStore / Store expects a list of interface{}, it can't handle []string
-		tags := make([]interface{}, 0, len(update.tags))
-		for _, v := range update.tags {
-
-			// Ignored tags will not be added or removed from the server
-			ignoreTag := false
-			for _, ignore := range h.mailbox.IgnoredTags {
-				if v == ignore {
-					ignoreTag = true
-				}
-			}
-			if ignoreTag {
-				continue
-			}
-
-			tags = append(tags, v)
-		}
-
-		if len(tags) == 0 {
-			continue
-		}
-		seqSet := new(imap.SeqSet)
-		seqSet.AddNum(uint32(uid.UID))
-
-		err := h.client.UidStore(seqSet, update.item, tags, nil)
-		if err != nil {
-			return err
-		}
+	err = h.storeTags(ctx, syncdb, uint32(uid.UID), msgUpdate.AddedTags, msgUpdate.RemovedTags)
+	if err != nil {
+		return err
 	}
 
 	// Write updated info back to database
-	err = syncdb.AddMessageSyncInfo(msgUpdate.MessageInfo, msgUpdate.WantedTags)
+	err = syncdb.AddMessageSyncInfo(ctx, msgUpdate.MessageInfo, msgUpdate.WantedTags)
 	return err
 }
 
-func (h *Handler) createMessage(syncdb *sync.DB, msgUpdate sync.Update, uidInfo sync.UID) error {
+func (h *Handler) createMessage(ctx context.Context, syncdb *sync.DB, msgUpdate sync.Update, uidInfo sync.UID) error {
 
 	fd, err := os.Open(msgUpdate.Filename)
 	if err != nil {
@@ -93,32 +92,166 @@ func (h *Handler) createMessage(syncdb *sync.DB, msgUpdate sync.Update, uidInfo
 	}
 	defer fd.Close()
 
-	hasUIDPlus, err := h.client.SupportUidPlus()
+	st, err := fd.Stat()
 	if err != nil {
 		return err
 	}
 
-	if !hasUIDPlus {
-		return errors.New("server does not support UIDPLUS, which is currently required for pushing new messages to server")
+	// A previous run may have uploaded the message without being able to record its UID.
+	// A new revision of a draft may have the same message id as the one it replaces,
+	// so we don't look for those.
+	if len(msgUpdate.Replaces) == 0 {
+		existing, err := h.findExisting(uidInfo.FolderName, msgUpdate.MessageID)
+		if err != nil {
+			return err
+		}
+		if existing != 0 {
+			err = h.storeTags(ctx, syncdb, existing, msgUpdate.AddedTags, nil)
+			if err != nil {
+				return err
+			}
+			err = h.recordUID(ctx, syncdb, msgUpdate, uidInfo, h.client.Mailbox().UidValidity, existing)
+			if err != nil {
+				return err
+			}
+			return h.draftCreated(ctx, syncdb, msgUpdate, st.ModTime())
+		}
+	}
+
+	flags := make([]string, 0, len(msgUpdate.AddedTags))
+	for _, t := range msgUpdate.AddedTags {
+		flags = append(flags, h.tagToFlag(t))
 	}
 
-	uidValidity, uid, err := h.client.UidPlusClient.Append(uidInfo.FolderName, msgUpdate.AddedTags, time.Now(), &FileLiteral{fd})
+	// Local delivery agents write bare LF line endings, but IMAP requires CRLF
+	literal, err := NewCRLFLiteral(fd)
 	if err != nil {
 		return err
 	}
 
-	// Servers are not forced to return UID.
-	// If we didn't get it, we won't add the message back to our db,
+	h.throttle()
+
+	uidValidity, uid, err := h.client.appendMessage(uidInfo.FolderName, flags, time.Now(), literal)
+	if err != nil {
+		return appendError(err)
+	}
+
+	// Without UIDPLUS we don't get to know the UID of the new message, and servers
+	// supporting it are not forced to return it either, so we search for it by its message id.
+	if (uidValidity == 0 || uid == 0) && !isGeneratedMessageID(msgUpdate.MessageID) {
+		uid, err = h.searchMessageID(uidInfo.FolderName, msgUpdate.MessageID)
+		if err != nil {
+			return err
+		}
+		uidValidity = h.client.Mailbox().UidValidity
+	}
+
+	// If we still don't have it, we won't add the message back to our db,
 	// and pick it up when we sync back.
-	// Note that this requires that we have a message id to match on.
 	if uidValidity == 0 || uid == 0 {
-		return nil
+		return h.draftCreated(ctx, syncdb, msgUpdate, st.ModTime())
 	}
 
-	// Write updated info back to database
+	h.recordCreated(uidInfo.FolderName, msgUpdate.MessageID, uid)
+	err = h.recordUID(ctx, syncdb, msgUpdate, uidInfo, uidValidity, uid)
+	if err != nil {
+		return err
+	}
+	return h.draftCreated(ctx, syncdb, msgUpdate, st.ModTime())
+}
+
+// respCodeAppendUID is sent in response to APPEND by servers supporting UIDPLUS (RFC 4315)
+const respCodeAppendUID imap.StatusRespCode = "APPENDUID"
+
+// appendMessage appends msg to mbox. Servers supporting UIDPLUS may return the UIDVALIDITY
+// of the mailbox and the UID of the new message, otherwise they are 0.
+func (c *Client) appendMessage(mbox string, flags []string, date time.Time, msg imap.Literal) (uidValidity uint32, uid uint32, err error) {
+	status, err := c.execute(&commands.Append{
+		Mailbox: mbox,
+		Flags:   flags,
+		Date:    date,
+		Message: msg,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The response code is APPENDUID <uidvalidity> <uid>
+	if status.Code != respCodeAppendUID || len(status.Arguments) < 2 {
+		return 0, 0, nil
+	}
+	uidValidity, err = imap.ParseNumber(status.Arguments[0])
+	if err != nil {
+		return 0, 0, nil
+	}
+	uid, err = imap.ParseNumber(status.Arguments[1])
+	if err != nil {
+		return 0, 0, nil
+	}
+	return uidValidity, uid, nil
+}
+
+// recordUID writes the UID of a message created on the server back to the database
+func (h *Handler) recordUID(ctx context.Context, syncdb *sync.DB, msgUpdate sync.Update, uidInfo sync.UID, uidValidity uint32, uid uint32) error {
 	uidInfo.UIDValidity = int(uidValidity)
 	uidInfo.UID = int(uid)
 	msgUpdate.MessageInfo.UIDs = []sync.UID{uidInfo}
-	err = syncdb.AddMessageSyncInfo(msgUpdate.MessageInfo, msgUpdate.AddedTags)
-	return err
+	err := syncdb.AddMessageSyncInfo(ctx, msgUpdate.MessageInfo, msgUpdate.AddedTags)
+	if err != nil {
+		return err
+	}
+	return h.updateLocation(ctx, syncdb, msgUpdate.MessageID)
+}
+
+// storeTags adds and removes the flags corresponding to tags on the message with uid
+// in the currently selected mailbox. Keywords that the server has refused to store
+// before are not added, see addEach.
+func (h *Handler) storeTags(ctx context.Context, syncdb *sync.DB, uid uint32, added []string, removed []string) error {
+	updateList := []struct {
+		item imap.StoreItem
+		tags []string
+		add  bool
+	}{
+		{item: imap.FormatFlagsOp(imap.AddFlags, true), tags: added, add: true},
+		{item: imap.FormatFlagsOp(imap.RemoveFlags, true), tags: removed},
+	}
+
+	for _, update := range updateList {
+		// UidStore / Store expects a list of interface{}, it can't handle []string
+		tags := make([]interface{}, 0, len(update.tags))
+		for _, v := range update.tags {
+
+			// Ignored tags will not be added or removed from the server
+			if !h.mailbox.SyncsTag(v) {
+				continue
+			}
+
+			tags = append(tags, h.tagToFlag(v))
+		}
+
+		if update.add {
+			var err error
+			tags, err = h.skipRejected(ctx, syncdb, h.client.Mailbox().Name, tags)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(tags) == 0 {
+			continue
+		}
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+
+		err := h.client.UidStore(seqSet, update.item, tags, nil)
+		if h.client.refused(err) && update.add {
+			// Find out which of the keywords the server doesn't accept
+			err = h.addEach(ctx, syncdb, uid, tags)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
@@ -9,16 +9,16 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/schollz/progressbar/v3"
 	"github.com/yzzyx/nm-imap-sync/config"
 	"github.com/yzzyx/nm-imap-sync/imap"
 	"github.com/yzzyx/nm-imap-sync/sync"
@@ -84,17 +84,23 @@ func userHomeDir() string {
 	return os.Getenv("HOME")
 }
 
+// parsePathFlag converts a path given on the command line to an absolute path,
+// expanding $NAME and ${NAME} the way the shell would if it was quoted
+func parsePathFlag(inPath string) string {
+	return parsePathSetting(os.ExpandEnv(inPath))
+}
+
+// parsePathSetting converts a path from the configuration to an absolute path.
+// Environment variables have already been expanded when the configuration was loaded
+// (see config.Expand), so we only have to handle "~". Paths given on the command line
+// should use parsePathFlag instead.
 func parsePathSetting(inPath string) string {
-	if strings.HasPrefix(inPath, "$HOME") {
-		inPath = userHomeDir() + inPath[5:]
+	if inPath == "~" {
+		inPath = userHomeDir()
 	} else if strings.HasPrefix(inPath, "~/") {
 		inPath = userHomeDir() + inPath[1:]
 	}
 
-	if strings.HasPrefix(inPath, "$") {
-		end := strings.Index(inPath, string(os.PathSeparator))
-		inPath = os.Getenv(inPath[1:end]) + inPath[end:]
-	}
 	if filepath.IsAbs(inPath) {
 		return filepath.Clean(inPath)
 	}
@@ -106,101 +112,256 @@ func parsePathSetting(inPath string) string {
 	return ""
 }
 
+// printCapabilities connects to the server of mailbox, and
+// lists its capabilities together with the features they enable
+func printCapabilities(name string, folderPath string, mailbox config.Mailbox) error {
+	h, err := imap.New(folderPath, mailbox)
+	if err != nil {
+		return err
+	}
+	defer h.Logout()
+
+	caps := h.Capabilities()
+	fmt.Printf("%s: %s\n", name, strings.Join(caps.List(), " "))
+	for _, f := range imap.Features {
+		if caps.Has(f.Capability) {
+			fmt.Printf("  %-16s enabled: %s\n", f.Capability, f.Description)
+		} else {
+			fmt.Printf("  %-16s disabled: %s\n", f.Capability, f.Fallback)
+		}
+	}
+	return nil
+}
+
+// commands lists the available subcommands
+var commands = map[string]func(ctx context.Context, args []string) int{
+	"apply":             applyCmd,
+	"empty-local-trash": emptyLocalTrashCmd,
+	"fsck":              fsckCmd,
+	"plan":              planCmd,
+	"probe":             probeCmd,
+	"reset-folder":      resetFolderCmd,
+	"watch":             watchCmd,
+	"where":             whereCmd,
+}
+
 func main() {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	cfgDir, err := os.UserConfigDir()
-	if err != nil {
-		cfgDir = filepath.Join(userHomeDir(), ".config")
+	// Stop processing as soon as possible if we're interrupted
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(ctx, os.Args[2:]))
+		}
 	}
-	configPath := filepath.Join(cfgDir, "nm-imap-sync", "config.yml")
 
 	fullScan := flag.Bool("full-scan", false, "Scan all messages on server for changes")
-	configFile := flag.String("config", configPath, "Use specific configuration file")
-	//dryRun := flag.Bool("dry-run", false, "Do not download any mail, only show which actions would be performed")
+	configFile := flag.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration, print the effective settings and exit")
+	showCapabilities := flag.Bool("capabilities", false, "Print the capabilities of each server, and which features will be used, then exit")
+	printFingerprint := flag.Bool("print-fingerprint", false, "Print the certificate fingerprint of each server, for use with tls_fingerprint, then exit")
+	failFast := flag.Bool("fail-fast", false, "Stop at the first error instead of continuing with the next message or account")
+	var refetch stringList
+	flag.Var(&refetch, "refetch", "Download a message again, specified as a message id, a notmuch query or uid:FOLDER:UID (may be repeated)")
+	metricsFile := flag.String("metrics-file", "", "Write Prometheus metrics for node_exporter's textfile collector to this file (overrides metrics_file)")
+	var assumeRenamed stringList
+	flag.Var(&assumeRenamed, "assume-renamed", "Treat folder OLD as renamed to NEW on the server, specified as OLD=NEW (may be repeated)")
+	forcePush := flag.String("force-push-tags", "", "Overwrite the flags on the server with the local tags of every message in ACCOUNT, then exit")
+	forcePull := flag.String("force-pull-tags", "", "Overwrite the local tags of every message in ACCOUNT with the flags on the server, then exit")
+	dryRun := flag.Bool("dry-run", false, "Only show which tags and flags would be changed by -force-push-tags or -force-pull-tags")
+	purgeUnconfigured := flag.Bool("purge-unconfigured", false, "Remove the state of folders that are no longer synchronized, after asking for confirmation")
+	retryRejected := flag.Bool("retry-rejected", false, "Try again to store keywords that the server has refused before")
+	notify := flag.Bool("notify", false, "Show a desktop notification for new messages in accounts where notify is enabled")
+	nonInteractive := flag.Bool("non-interactive", false, "Never prompt for passwords that are not configured")
 	flag.Parse()
 
-	cfgData, err := ioutil.ReadFile(*configFile)
+	if *forcePush != "" && *forcePull != "" {
+		fmt.Printf("-force-push-tags cannot be combined with -force-pull-tags\n")
+		os.Exit(exitConfigError)
+	}
+	if *dryRun && *forcePush == "" && *forcePull == "" {
+		fmt.Printf("-dry-run requires -force-push-tags or -force-pull-tags\n")
+		os.Exit(exitConfigError)
+	}
+
+	renames, err := imap.ParseRenames(assumeRenamed)
 	if err != nil {
-		fmt.Printf("Cannot read config file '%s': %s\n", configPath, err)
-		os.Exit(1)
+		fmt.Printf("%s\n", err)
+		os.Exit(exitConfigError)
 	}
 
-	cfg := config.Config{}
-	err = yaml.Unmarshal(cfgData, &cfg)
+	opts := runOptions{
+		fullScan: *fullScan,
+		failFast: *failFast,
+		renames:  renames,
+	}
+
+	env, err := loadEnvironment(*configFile)
 	if err != nil {
-		fmt.Printf("Cannot parse config file '%s': %s\n", configPath, err)
-		os.Exit(1)
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		os.Exit(exitConfigError)
 	}
+	env.nonInteractive = *nonInteractive
 
-	if cfg.Maildir == "" {
-		cfg.Maildir = "~/.mail"
+	if *checkConfig {
+		data, err := yaml.Marshal(env.cfg.Masked())
+		if err != nil {
+			fmt.Printf("Cannot print configuration: %s\n", err)
+			os.Exit(exitConfigError)
+		}
+		fmt.Printf("Configuration is valid\n\n%s", data)
+		return
 	}
 
-	maildirPath := parsePathSetting(cfg.Maildir)
+	if *showCapabilities {
+		err = env.askPasswords(ctx, env.accountNames())
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(exitConfigError)
+		}
+		for _, name := range env.accountNames() {
+			mailbox, folderPath, _ := env.mailbox(name)
+			err = printCapabilities(name, folderPath, mailbox)
+			if err != nil {
+				fmt.Printf("%s: %s\n", name, err)
+				os.Exit(exitConfigError)
+			}
+		}
+		return
+	}
 
-	syncdb, err := sync.New(ctx, maildirPath)
-	if err != nil {
-		fmt.Printf("Cannot initialize sync database: %s\n", err)
-		os.Exit(1)
+	if *printFingerprint {
+		for _, name := range env.accountNames() {
+			mailbox, _, _ := env.mailbox(name)
+			fingerprint, err := imap.Fingerprint(mailbox)
+			if err != nil {
+				fmt.Printf("%s: %s\n", name, err)
+				os.Exit(exitConfigError)
+			}
+			fmt.Printf("%s: %s\n", name, imap.FormatFingerprint(fingerprint))
+		}
+		return
 	}
-	defer syncdb.Close()
 
-	// Create maildir if it doesnt exist
-	err = os.MkdirAll(maildirPath, 0700)
+	// Ask for any missing passwords up front, so that we don't stop halfway through the accounts
+	accounts := env.accountNames()
+	switch {
+	case *forcePush != "":
+		accounts = []string{*forcePush}
+	case *forcePull != "":
+		accounts = []string{*forcePull}
+	}
+	err = env.askPasswords(ctx, accounts)
 	if err != nil {
-		panic(err)
+		fmt.Printf("%s\n", err)
+		os.Exit(exitConfigError)
 	}
 
-	// Create a IMAP setup for each mailbox
-	for name, mailbox := range cfg.Mailboxes {
-		mailbox.DBPath = maildirPath
-		folderPath := filepath.Join(maildirPath, name)
-		err = os.MkdirAll(folderPath, 0700)
+	if *forcePush != "" {
+		os.Exit(forceTags(ctx, env, *forcePush, imap.ForcePush, *dryRun))
+	}
+	if *forcePull != "" {
+		os.Exit(forceTags(ctx, env, *forcePull, imap.ForcePull, *dryRun))
+	}
+
+	// Tell systemd what we're doing, if we're running as a Type=notify service
+	dog := startWatchdog(ctx)
+	opts.heartbeat = dog.heartbeat
+
+	// Each mailbox uses the sync database (and notmuch database) it's configured with
+	dbs := newSyncDBs(env)
+
+	var refetchTargets map[*sync.DB][]*refetchTarget
+	if len(refetch) > 0 {
+		refetchTargets, err = resolveRefetchTargets(ctx, env, dbs, refetch)
 		if err != nil {
-			panic(err)
+			fmt.Printf("Cannot refetch: %s\n", err)
+			dbs.close()
+			os.Exit(exitConfigError)
 		}
+	}
 
-		imapQueue := make(chan sync.Update, 10000)
+	// Create a IMAP setup for each mailbox
+	var results []accountResult
+	cleared := make(map[*sync.DB]bool)
+	names := env.accountNames()
+	for i, name := range names {
+		mailbox, folderPath, _ := env.mailbox(name)
 
-		go func() {
-			err = syncdb.CheckFolders(ctx, mailbox, folderPath, imapQueue)
-			if err != nil {
-				log.Printf("cannot check folders for new tags: %v\n", err)
-				return
-			}
-			close(imapQueue)
-		}()
+		_ = sdNotify("STATUS=synchronizing " + name)
+		dog.heartbeat()
 
-		h, err := imap.New(folderPath, mailbox)
+		accountDB, err := dbs.get(ctx, name)
 		if err != nil {
-			log.Printf("cannot initalize new imap connection: %v\n", err)
-			return
+			results = append(results, accountResult{Name: name, Err: err})
+			continue
 		}
 
-		progress := progressbar.NewOptions(-1, progressbar.OptionSetDescription("updating server flags"))
-		for msgUpdate := range imapQueue {
-			progress.Add(1)
-			err = h.Update(syncdb, msgUpdate)
+		// Accounts may share a sync database, and it must only be cleared once
+		if *retryRejected && !cleared[accountDB] {
+			count, err := accountDB.ClearRejectedKeywords(ctx)
 			if err != nil {
-				log.Printf("cannot update message on server: %v\n", err)
-				return
+				log.Printf("%s: cannot clear rejected keywords: %v\n", name, err)
+			} else if count > 0 {
+				fmt.Printf("%s: %d rejected keywords will be sent again\n", name, count)
 			}
+			cleared[accountDB] = true
 		}
-		progress.Finish()
 
-		err = h.CheckMessages(ctx, syncdb, *fullScan)
+		// Folders that have been removed from the configuration are reported once per run
+		err = checkUnconfigured(ctx, accountDB, name, mailbox, folderPath, *purgeUnconfigured)
 		if err != nil {
-			log.Printf("cannot check for new messages on server: %v\n", err)
-			return
+			log.Printf("%s: %v\n", name, err)
 		}
 
-		err = h.Close()
-		if err != nil {
-			log.Printf("Cannot close imap handler: %v", err)
-			return
+		var result accountResult
+		if len(refetch) > 0 {
+			result = refetchAccount(ctx, accountDB, name, mailbox, folderPath, refetchTargets[accountDB])
+		} else {
+			result = syncAccount(ctx, accountDB, name, mailbox, folderPath, opts)
 		}
+		results = append(results, result)
+		if ctx.Err() != nil || (result.Err != nil && opts.failFast) {
+			for _, skipped := range names[i+1:] {
+				results = append(results, accountResult{Name: skipped, Err: errNotSynchronized})
+			}
+			break
+		}
+	}
+
+	// Messages that couldn't be refetched from any account are counted as skipped
+	missing := missingRefetchTargets(refetchTargets)
+	for _, description := range missing {
+		fmt.Printf("%s no longer exists on the server\n", description)
+	}
+
+	if *notify && len(refetch) == 0 {
+		notifyNewMail(ctx, results)
 	}
 
-	return
+	code := summarize(ctx, results, len(missing))
+	// A single run is never ready to serve anything, so only the status is reported
+	_ = sdNotify("STATUS=synchronization complete")
+	if *metricsFile != "" {
+		*metricsFile = parsePathFlag(*metricsFile)
+	} else if env.cfg.MetricsFile != "" {
+		*metricsFile = parsePathSetting(env.cfg.MetricsFile)
+	}
+	if *metricsFile != "" {
+		err = writeMetrics(*metricsFile, results, time.Now())
+		if err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+	_ = sdNotify("STOPPING=1")
+	dbs.close()
+	os.Exit(code)
 }
@@ -0,0 +1,93 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metric describes a single metric in the Prometheus text format
+type metric struct {
+	name  string
+	kind  string // gauge or counter
+	help  string
+	value func(r accountResult) float64
+}
+
+var metrics = []metric{
+	{"nmimapsync_last_run_success", "gauge", "Whether the last run synchronized the account without errors",
+		func(r accountResult) float64 {
+			if r.Err == nil && r.Skipped == 0 {
+				return 1
+			}
+			return 0
+		}},
+	{"nmimapsync_messages_downloaded_total", "counter", "Messages downloaded from the server during the last run",
+		func(r accountResult) float64 { return float64(r.Stats.Downloaded) }},
+	{"nmimapsync_flag_updates_pushed_total", "counter", "Local changes pushed to the server during the last run",
+		func(r accountResult) float64 { return float64(r.Stats.Pushed) }},
+	{"nmimapsync_errors_total", "counter", "Errors during the last run, including skipped messages",
+		func(r accountResult) float64 {
+			errors := r.Skipped
+			if r.Err != nil {
+				errors++
+			}
+			return float64(errors)
+		}},
+}
+
+// escapeLabel escapes a label value for the Prometheus text format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeMetrics writes the results of a run to path, in the format read by the
+// textfile collector of node_exporter. The file is replaced atomically, so that
+// the collector never reads a partially written file.
+func writeMetrics(path string, results []accountResult, finished time.Time) error {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# HELP nmimapsync_last_run_timestamp Time the last run finished, in seconds since the epoch\n")
+	fmt.Fprintf(&buf, "# TYPE nmimapsync_last_run_timestamp gauge\n")
+	for _, r := range results {
+		fmt.Fprintf(&buf, "nmimapsync_last_run_timestamp{account=\"%s\"} %d\n", escapeLabel(r.Name), finished.Unix())
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", m.name, m.kind)
+		for _, r := range results {
+			fmt.Fprintf(&buf, "%s{account=\"%s\"} %g\n", m.name, escapeLabel(r.Name), m.value(r))
+		}
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// node_exporter must be able to read the file
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write metrics to %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/yzzyx/nm-imap-sync/imap"
+)
+
+// notifyNewMail shows a desktop notification for each account in results
+// that downloaded messages into folders that notify is enabled for
+func notifyNewMail(ctx context.Context, results []accountResult) {
+	for _, r := range results {
+		total := r.Stats.NewMail.Total()
+		if total == 0 {
+			continue
+		}
+
+		summary, body := describeNewMail(r.Name, r.Stats.NewMail, total)
+		err := sendNotification(ctx, summary, body)
+		if err != nil {
+			log.Printf("%s: cannot show notification: %v\n", r.Name, err)
+		}
+	}
+}
+
+// describeNewMail returns the summary and body of the notification for newMail
+func describeNewMail(account string, newMail imap.NewMail, total int) (string, string) {
+	folders := make([]string, 0, len(newMail.Count))
+	for folder := range newMail.Count {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+
+	noun := "messages"
+	if total == 1 {
+		noun = "message"
+	}
+	summary := fmt.Sprintf("%d new %s in %s (%s)", total, noun, strings.Join(folders, ", "), account)
+
+	var lines []string
+	for _, msg := range newMail.Samples {
+		lines = append(lines, fmt.Sprintf("%s: %s", msg.From, msg.Subject))
+	}
+	if more := total - len(newMail.Samples); more > 0 {
+		lines = append(lines, fmt.Sprintf("and %d more", more))
+	}
+	return summary, strings.Join(lines, "\n")
+}
+
+// sendNotification shows a notification through org.freedesktop.Notifications on the
+// D-Bus session bus. If it can't be reached with gdbus, notify-send is tried instead.
+func sendNotification(ctx context.Context, summary string, body string) error {
+	err := exec.CommandContext(ctx, "gdbus", "call", "--session",
+		"--dest", "org.freedesktop.Notifications",
+		"--object-path", "/org/freedesktop/Notifications",
+		"--method", "org.freedesktop.Notifications.Notify",
+		gvariantString("nm-imap-sync"), "0", gvariantString("mail-unread"),
+		gvariantString(summary), gvariantString(body), "[]", "{}", "int32 -1").Run()
+	if err == nil {
+		return nil
+	}
+
+	fallbackErr := exec.CommandContext(ctx, "notify-send", "--app-name=nm-imap-sync", "--icon=mail-unread", "--", summary, body).Run()
+	if fallbackErr != nil {
+		return fmt.Errorf("gdbus: %v, notify-send: %w", err, fallbackErr)
+	}
+	return nil
+}
+
+// gvariantString returns s in the GVariant text format used for gdbus arguments
+func gvariantString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`).Replace(s) + "'"
+}
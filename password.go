@@ -0,0 +1,44 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// askPasswords prompts on the terminal for the password of each account in names that
+// doesn't have one configured. The passwords are only kept in memory for this run.
+// If we're not running interactively, an error is returned for the first such account.
+func (env *environment) askPasswords(ctx context.Context, names []string) error {
+	for _, name := range names {
+		mailbox, ok := env.cfg.Mailboxes[name]
+		if !ok || mailbox.Password != "" {
+			continue
+		}
+
+		if env.nonInteractive || !isTerminal(os.Stdin) {
+			return fmt.Errorf("%s: no password configured, set password in the configuration, "+
+				"or run interactively to be asked for it", name)
+		}
+
+		// Print the prompt on stderr, so that it isn't mixed up with any output that is redirected
+		fmt.Fprintf(os.Stderr, "Password for %s@%s (%s): ", mailbox.Username, mailbox.Server, name)
+		password, err := readPassword(ctx, os.Stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return fmt.Errorf("%s: cannot read password: %w", name, err)
+		}
+
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return fmt.Errorf("%s: no password entered", name)
+		}
+		mailbox.Password = password
+		env.cfg.Mailboxes[name] = mailbox
+	}
+	return nil
+}
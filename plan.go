@@ -0,0 +1,326 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/yzzyx/nm-imap-sync/imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// planVersion is increased whenever the plan format changes incompatibly
+const planVersion = 2
+
+// plan contains all changes needed to synchronize an account, as computed by 'plan',
+// together with the state they were computed from, so that 'apply' can detect drift
+type plan struct {
+	Version int
+	Account string
+	Created time.Time
+
+	Folders []imap.FolderState
+	Push    []plannedPush
+	Fetch   []imap.FetchAction
+}
+
+// plannedPush is a local change that will be pushed to the server
+type plannedPush struct {
+	Update sync.Update
+	// SHA256 is the hash of the local file when the plan was made
+	SHA256 string
+}
+
+// hashFile returns the SHA-256 of the file at path, as hex
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// printSummary prints a human readable summary of p
+func (p *plan) printSummary() {
+	uploads, pushes := 0, 0
+	for _, push := range p.Push {
+		if push.Update.Created {
+			uploads++
+		} else {
+			pushes++
+		}
+	}
+
+	downloads, pulls := 0, 0
+	for _, f := range p.Fetch {
+		if f.Download {
+			downloads++
+		} else {
+			pulls++
+		}
+	}
+
+	fmt.Printf("Plan for %s, made %s:\n", p.Account, p.Created.Format(time.RFC1123))
+	fmt.Printf("  %d messages will be uploaded to the server\n", uploads)
+	fmt.Printf("  %d messages will have their flags changed on the server\n", pushes)
+	fmt.Printf("  %d messages will be downloaded\n", downloads)
+	fmt.Printf("  %d messages will have their tags changed locally\n", pulls)
+}
+
+// planCmd computes the changes needed to synchronize an account, and writes them to a file
+func planCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	account := fs.String("account", "", "Account to plan the synchronization of")
+	output := fs.String("o", "plan.json", "File to write the plan to")
+	fs.Parse(args)
+
+	if *account == "" {
+		fmt.Println("--account must be specified")
+		return exitConfigError
+	}
+
+	env, err := loadEnvironment(*configFile)
+	if err != nil {
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		return exitConfigError
+	}
+
+	err = env.askPasswords(ctx, []string{*account})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	mailbox, folderPath, err := env.mailbox(*account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	syncdb, err := env.openSyncDB(ctx, *account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+	defer syncdb.Close()
+
+	err = os.MkdirAll(folderPath, 0700)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	h, err := imap.New(folderPath, mailbox)
+	if err != nil {
+		fmt.Printf("Cannot connect to %s: %s\n", *account, err)
+		return exitAccountsFailed
+	}
+	// Nothing is changed, so there's no state to save
+	defer h.Logout()
+
+	p := plan{
+		Version: planVersion,
+		Account: *account,
+		Created: time.Now(),
+	}
+
+	queue := make(chan sync.Update, 10000)
+	checkErr := make(chan error, 1)
+	go func() {
+		defer close(queue)
+		checkErr <- syncdb.CheckFolders(ctx, mailbox, folderPath, queue)
+	}()
+	for update := range queue {
+		p.Push = append(p.Push, plannedPush{Update: update})
+	}
+	if err = <-checkErr; err != nil {
+		fmt.Printf("Cannot check local folders: %s\n", err)
+		return exitAccountsFailed
+	}
+
+	for i := range p.Push {
+		p.Push[i].SHA256, err = hashFile(p.Push[i].Update.Filename)
+		if err != nil {
+			fmt.Printf("Cannot read local message: %s\n", err)
+			return exitAccountsFailed
+		}
+	}
+
+	p.Folders, p.Fetch, err = h.PlanFetch(ctx, syncdb)
+	if err != nil {
+		fmt.Printf("Cannot check %s: %s\n", *account, err)
+		return exitAccountsFailed
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		fmt.Printf("Cannot encode plan: %s\n", err)
+		return exitAccountsFailed
+	}
+	err = ioutil.WriteFile(*output, data, 0600)
+	if err != nil {
+		fmt.Printf("Cannot write plan: %s\n", err)
+		return exitAccountsFailed
+	}
+
+	p.printSummary()
+	fmt.Printf("Plan written to %s, run 'nm-imap-sync apply %s' to execute it\n", *output, *output)
+	return exitOK
+}
+
+// applyCmd executes a plan written by planCmd, unless the account has changed since
+func applyCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("usage: nm-imap-sync apply [--config file] plan.json")
+		return exitConfigError
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Cannot read plan: %s\n", err)
+		return exitConfigError
+	}
+
+	var p plan
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		fmt.Printf("Cannot read plan: %s\n", err)
+		return exitConfigError
+	}
+	if p.Version != planVersion {
+		fmt.Printf("The plan was made by an incompatible version (%d, expected %d)\n", p.Version, planVersion)
+		return exitConfigError
+	}
+
+	env, err := loadEnvironment(*configFile)
+	if err != nil {
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		return exitConfigError
+	}
+
+	err = env.askPasswords(ctx, []string{p.Account})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	mailbox, folderPath, err := env.mailbox(p.Account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	syncdb, err := env.openSyncDB(ctx, p.Account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+	defer syncdb.Close()
+
+	h, err := imap.New(folderPath, mailbox)
+	if err != nil {
+		fmt.Printf("Cannot connect to %s: %s\n", p.Account, err)
+		return exitAccountsFailed
+	}
+	defer h.Close()
+
+	// Refuse to do anything if the plan is out of date
+	var drift []error
+	for _, f := range p.Folders {
+		if err := h.CheckDrift(f); err != nil {
+			drift = append(drift, err)
+		}
+	}
+	for _, push := range p.Push {
+		sum, err := hashFile(push.Update.Filename)
+		if err != nil {
+			drift = append(drift, err)
+		} else if sum != push.SHA256 {
+			drift = append(drift, fmt.Errorf("%s has been modified", push.Update.Filename))
+		}
+	}
+	if len(drift) > 0 {
+		fmt.Println("The account has changed since the plan was made, run 'plan' again:")
+		for _, err := range drift {
+			fmt.Printf("  %s\n", err)
+		}
+		return exitConfigError
+	}
+
+	p.printSummary()
+
+	failed := 0
+	pushed := make(map[string]bool, len(p.Push))
+	for _, push := range p.Push {
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		err = h.Update(ctx, syncdb, push.Update)
+		if err != nil {
+			fmt.Printf("Cannot update %s on the server: %s\n", push.Update.MessageID, err)
+			failed++
+			continue
+		}
+		pushed[push.Update.MessageID] = true
+	}
+
+	// Folders where something failed keep their watermark, so that the next run checks them again
+	incomplete := make(map[string]bool)
+	for _, action := range p.Fetch {
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		err = h.ApplyFetch(ctx, syncdb, action, pushed[action.Info.MessageID])
+		if err != nil {
+			var partial *imap.PartialFetchError
+			if errors.As(err, &partial) || ctx.Err() != nil {
+				fmt.Printf("%s\n", err)
+				return exitAccountsFailed
+			}
+			fmt.Printf("Cannot fetch UID %d from %s: %s\n", action.UID, action.Folder, err)
+			incomplete[action.Folder] = true
+			failed++
+		}
+	}
+
+	for _, f := range p.Folders {
+		if incomplete[f.Name] {
+			continue
+		}
+		err = h.CompleteFolder(f)
+		if err != nil {
+			fmt.Printf("Cannot save state: %s\n", err)
+			return exitAccountsFailed
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("Plan applied, %d changes failed\n", failed)
+		return exitPartial
+	}
+	fmt.Println("Plan applied")
+	return exitOK
+}
@@ -0,0 +1,126 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/yzzyx/nm-imap-sync/imap"
+)
+
+// probeCmd connects to the server of an account, and reports what it supports
+// and how we will use it, without changing any state
+func probeCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	account := fs.String("account", "", "Account to probe")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	fs.Parse(args)
+
+	if *account == "" {
+		fmt.Println("--account must be specified")
+		return exitConfigError
+	}
+
+	env, err := loadEnvironment(*configFile)
+	if err != nil {
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		return exitConfigError
+	}
+
+	err = env.askPasswords(ctx, []string{*account})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	mailbox, folderPath, err := env.mailbox(*account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	h, err := imap.New(folderPath, mailbox)
+	if err != nil {
+		fmt.Printf("Cannot connect to %s: %s\n", *account, err)
+		return exitAccountsFailed
+	}
+	defer h.Logout()
+
+	result, err := h.Probe()
+	if err != nil {
+		fmt.Printf("Cannot probe %s: %s\n", *account, err)
+		return exitAccountsFailed
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			return exitAccountsFailed
+		}
+		fmt.Println(string(data))
+		return exitOK
+	}
+
+	printProbe(*account, result)
+	return exitOK
+}
+
+// printProbe prints the result of a probe in human readable form
+func printProbe(account string, r *imap.ProbeResult) {
+	fmt.Printf("%s (%s)\n", account, r.Server)
+	fmt.Printf("Capabilities: %s\n\n", strings.Join(r.Capabilities, " "))
+
+	fmt.Println("Features:")
+	for _, f := range r.Features {
+		state := "no "
+		if f.Available {
+			state = "yes"
+		}
+		fmt.Printf("  %-16s %s  %s\n", f.Capability, state, f.Description)
+	}
+
+	fmt.Println()
+	if r.Namespaces != nil {
+		for _, ns := range []struct {
+			name string
+			list []imap.Namespace
+		}{{"personal", r.Namespaces.Personal}, {"other users", r.Namespaces.Other}, {"shared", r.Namespaces.Shared}} {
+			for _, n := range ns.list {
+				fmt.Printf("Namespace (%s): %q, delimiter %q\n", ns.name, n.Prefix, n.Delimiter)
+			}
+		}
+	} else {
+		fmt.Println("Namespace: not supported")
+	}
+	fmt.Printf("Hierarchy delimiter: %q\n", r.Delimiter)
+	if r.AppendLimit > 0 {
+		fmt.Printf("Append limit: %d bytes\n", r.AppendLimit)
+	} else {
+		fmt.Println("Append limit: not announced")
+	}
+
+	fmt.Println("\nFolders:")
+	for _, f := range r.Folders {
+		synced := ""
+		if !f.Synchronized {
+			synced = ", not synchronized"
+		}
+		special := ""
+		if f.SpecialUse != "" {
+			special = " " + f.SpecialUse
+		}
+		if f.Error != "" {
+			fmt.Printf("  %s%s: %s\n", f.Name, special, f.Error)
+			continue
+		}
+		fmt.Printf("  %s%s: %d messages, %d unseen, UIDNEXT %d, UIDVALIDITY %d%s\n",
+			f.Name, special, f.Messages, f.Unseen, f.UIDNext, f.UIDValidity, synced)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+	"github.com/yzzyx/nm-imap-sync/imap"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// stringList is a flag that can be specified multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// refetchTarget is a message that should be downloaded again
+type refetchTarget struct {
+	Description string // What the user asked for
+	UIDs        []sync.UID
+	found       bool
+}
+
+// refetchUIDPrefix starts a value given to -refetch that specifies a folder and UID,
+// as uid:FOLDER:UID. notmuch has no prefix with this name, so it can't be mistaken for a query.
+const refetchUIDPrefix = "uid:"
+
+// parseRefetchTarget interprets 'value' as either uid:FOLDER:UID,
+// a message id, or a notmuch query, and looks up the corresponding UIDs
+func parseRefetchTarget(ctx context.Context, syncdb *sync.DB, value string) ([]*refetchTarget, error) {
+	if strings.HasPrefix(value, refetchUIDPrefix) {
+		location := value[len(refetchUIDPrefix):]
+		idx := strings.LastIndex(location, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("%s is not of the form uid:FOLDER:UID", value)
+		}
+		uid, err := strconv.ParseUint(location[idx+1:], 10, 32)
+		if err != nil || uid == 0 {
+			return nil, fmt.Errorf("%s is not of the form uid:FOLDER:UID", value)
+		}
+		return []*refetchTarget{{
+			Description: value,
+			UIDs:        []sync.UID{{FolderName: location[:idx], UID: int(uid)}},
+		}}, nil
+	}
+
+	var messageIDs []string
+	if strings.HasPrefix(value, "<") && strings.HasSuffix(value, ">") {
+		messageIDs = []string{value[1 : len(value)-1]}
+	} else if strings.Contains(value, "@") && !strings.ContainsAny(value, ": \t") {
+		messageIDs = []string{value}
+	} else {
+		var err error
+		messageIDs, err = syncdb.QueryMessageIDs(value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot search for %s: %w", value, err)
+		}
+		if len(messageIDs) == 0 {
+			return nil, fmt.Errorf("no messages match %s", value)
+		}
+	}
+
+	var targets []*refetchTarget
+	for _, id := range messageIDs {
+		uids, err := syncdb.LookupUIDs(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if len(uids) == 0 {
+			return nil, fmt.Errorf("message %s is not known to be on any server", id)
+		}
+		targets = append(targets, &refetchTarget{Description: id, UIDs: uids})
+	}
+	return targets, nil
+}
+
+// resolveRefetchTargets looks up the values given to -refetch in the sync database of every account.
+// A value only has to match in one of the databases.
+func resolveRefetchTargets(ctx context.Context, env *environment, dbs *syncDBs, values []string) (map[*sync.DB][]*refetchTarget, error) {
+	targets := make(map[*sync.DB][]*refetchTarget)
+	for _, value := range values {
+		var lastErr error
+		found := false
+		checked := make(map[*sync.DB]bool)
+		for _, name := range env.accountNames() {
+			syncdb, err := dbs.get(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			if checked[syncdb] {
+				continue
+			}
+			checked[syncdb] = true
+
+			t, err := parseRefetchTarget(ctx, syncdb, value)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			targets[syncdb] = append(targets[syncdb], t...)
+			found = true
+		}
+		if !found {
+			return nil, lastErr
+		}
+	}
+	return targets, nil
+}
+
+// missingRefetchTargets returns the targets that weren't found on any server.
+// The same target may have been looked up in several sync databases.
+func missingRefetchTargets(targets map[*sync.DB][]*refetchTarget) []string {
+	found := make(map[string]bool)
+	for _, list := range targets {
+		for _, t := range list {
+			found[t.Description] = found[t.Description] || t.found
+		}
+	}
+
+	var missing []string
+	for description, ok := range found {
+		if !ok {
+			missing = append(missing, description)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// refetchAccount downloads all targets that exist in the account again
+func refetchAccount(ctx context.Context, syncdb *sync.DB, name string, mailbox config.Mailbox, folderPath string, targets []*refetchTarget) (result accountResult) {
+	result.Name = name
+
+	h, err := imap.New(folderPath, mailbox)
+	if err != nil {
+		result.Err = fmt.Errorf("cannot initalize new imap connection: %w", err)
+		return result
+	}
+	defer h.Logout()
+
+	for _, t := range targets {
+		for _, uid := range t.UIDs {
+			if err = ctx.Err(); err != nil {
+				result.Err = err
+				return result
+			}
+
+			err = h.Refetch(ctx, syncdb, uid.FolderName, uint32(uid.UIDValidity), uint32(uid.UID))
+			if errors.Is(err, imap.ErrMessageNotFound) {
+				continue
+			}
+			if err != nil {
+				log.Printf("%s: cannot refetch %s: %v\n", name, t.Description, err)
+				result.Skipped++
+				continue
+			}
+
+			fmt.Printf("%s: refetched %s from %s\n", name, syncdb.Describe(ctx, t.Description), uid.FolderName)
+			t.found = true
+		}
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+func TestParseRefetchTarget(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "nm-imap-sync-refetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncdb, err := sync.New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syncdb.Close()
+
+	known := sync.UID{FolderName: "INBOX", UIDValidity: 1, UID: 42}
+	err = syncdb.AddMessageSyncInfo(ctx, sync.MessageInfo{MessageID: "known@example.com", UIDs: []sync.UID{known}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value   string
+		want    []sync.UID
+		wantErr string
+	}{
+		{
+			value: "uid:INBOX:123",
+			want:  []sync.UID{{FolderName: "INBOX", UID: 123}},
+		},
+		{
+			value: "uid:Lists/go-nuts:7",
+			want:  []sync.UID{{FolderName: "Lists/go-nuts", UID: 7}},
+		},
+		{
+			value: "uid:Archive:2020:7",
+			want:  []sync.UID{{FolderName: "Archive:2020", UID: 7}},
+		},
+		{
+			value:   "uid:INBOX",
+			wantErr: "is not of the form uid:FOLDER:UID",
+		},
+		{
+			value:   "uid:INBOX:last",
+			wantErr: "is not of the form uid:FOLDER:UID",
+		},
+		{
+			value:   "uid::5",
+			wantErr: "is not of the form uid:FOLDER:UID",
+		},
+		{
+			value: "<known@example.com>",
+			want:  []sync.UID{known},
+		},
+		{
+			value: "known@example.com",
+			want:  []sync.UID{known},
+		},
+		{
+			value:   "unknown@example.com",
+			wantErr: "is not known to be on any server",
+		},
+		// notmuch queries that look like folder:UID
+		{
+			value:   "thread:0000000000000123",
+			wantErr: "no messages match",
+		},
+		{
+			value:   "date:2020",
+			wantErr: "no messages match",
+		},
+	}
+
+	for _, tt := range tests {
+		targets, err := parseRefetchTarget(ctx, syncdb, tt.value)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.value, err)
+			continue
+		}
+
+		var uids []sync.UID
+		for _, target := range targets {
+			uids = append(uids, target.UIDs...)
+		}
+		if !reflect.DeepEqual(uids, tt.want) {
+			t.Errorf("%s: UIDs = %v, want %v", tt.value, uids, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yzzyx/nm-imap-sync/imap"
+)
+
+// confirm asks the user a yes/no-question on stdin
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// resetFolderCmd removes all synchronization state for a single folder
+func resetFolderCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("reset-folder", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	account := fs.String("account", "", "Account the folder belongs to")
+	folder := fs.String("folder", "", "Folder to reset, as named on the server")
+	forgetMessages := fs.Bool("forget-messages", false, "Also remove messages that aren't known to be in any other folder")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Parse(args)
+
+	if *account == "" || *folder == "" {
+		fmt.Println("Both --account and --folder must be specified")
+		return exitConfigError
+	}
+
+	env, err := loadEnvironment(*configFile)
+	if err != nil {
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		return exitConfigError
+	}
+
+	mailbox, folderPath, err := env.mailbox(*account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	syncdb, err := env.openSyncDB(ctx, *account)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+	defer syncdb.Close()
+
+	count, err := syncdb.CountFolder(ctx, *folder)
+	if err != nil {
+		fmt.Printf("Cannot read sync database: %s\n", err)
+		return exitConfigError
+	}
+
+	fmt.Printf("This will remove the synchronization state of %d messages in %s (%s).\n", count, *folder, *account)
+	if *forgetMessages {
+		fmt.Println("Messages that are not known to exist in any other folder will be forgotten.")
+	}
+	if !*yes && !confirm("Continue?") {
+		return exitOK
+	}
+
+	uids, messages, err := syncdb.ResetFolder(ctx, *folder, *forgetMessages)
+	if err != nil {
+		fmt.Printf("Cannot reset folder: %s\n", err)
+		return exitConfigError
+	}
+
+	// The local directory of the folder is chosen again on the next run
+	err = syncdb.ForgetFolderPath(ctx, folderPath, *folder)
+	if err != nil {
+		fmt.Printf("Cannot reset folder: %s\n", err)
+		return exitConfigError
+	}
+
+	lastSeen, err := imap.ClearFolderState(mailbox.StateDir, *folder)
+	if err != nil {
+		fmt.Printf("Cannot reset folder state: %s\n", err)
+		return exitConfigError
+	}
+
+	fmt.Printf("Removed %d UIDs and %d messages, last seen UID was %d.\n", uids, messages, lastSeen)
+	fmt.Printf("The next run will check every message in %s on the server again. Messages that already\n", *folder)
+	fmt.Println("exist locally are matched by their Message-ID header and linked instead of downloaded.")
+	if *forgetMessages {
+		fmt.Println("Forgotten messages use the flags on the server as their synchronized state.")
+	} else {
+		fmt.Println("Their synchronized tags are kept.")
+	}
+	return exitOK
+}
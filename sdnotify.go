@@ -0,0 +1,85 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sdNotify sends 'state' to systemd, as described in sd_notify(3).
+// It does nothing unless we're started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Sockets in the abstract namespace start with '@', which is handled by net
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping,
+// which is half of WatchdogSec, or 0 if the watchdog isn't enabled for us
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog pings the systemd watchdog, but only as long as the synchronization makes progress.
+// A connection that stops responding thus eventually gets us restarted.
+type watchdog struct {
+	alive int32
+}
+
+// startWatchdog starts pinging the systemd watchdog until ctx is cancelled.
+// If the watchdog isn't enabled, nil is returned.
+func startWatchdog(ctx context.Context) *watchdog {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return nil
+	}
+
+	w := &watchdog{alive: 1}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if atomic.SwapInt32(&w.alive, 0) != 0 {
+					_ = sdNotify("WATCHDOG=1")
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// heartbeat signals that we've made progress since the last ping
+func (w *watchdog) heartbeat() {
+	if w != nil {
+		atomic.StoreInt32(&w.alive, 1)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// defaultStateDir returns the directory used for mutable state,
+// following the XDG base directory specification
+func defaultStateDir() string {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" || !filepath.IsAbs(stateHome) {
+		stateHome = filepath.Join(userHomeDir(), ".local", "state")
+	}
+	return filepath.Join(stateHome, "nm-imap-sync")
+}
+
+// migrateLegacyFile copies the file at legacyPath to newPath,
+// unless newPath already exists or there's nothing to migrate.
+// The legacy file is left in place.
+func migrateLegacyFile(legacyPath string, newPath string) error {
+	if _, err := os.Stat(newPath); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	src, err := os.Open(legacyPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer src.Close()
+
+	err = os.MkdirAll(filepath.Dir(newPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := newPath + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, newPath)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	log.Printf("migrated %s to %s, the old file can be removed\n", legacyPath, newPath)
+	return nil
+}
@@ -2,25 +2,71 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	gosync "sync"
+	"time"
 
 	"github.com/yzzyx/nm-imap-sync/config"
 	notmuch "github.com/zenhack/go.notmuch"
 )
 
 // CheckFolders iterates through all folders in maildirPath, and
-// compares the result with the existing database
+// compares the result with the existing database.
+// Nested folders are checked as well, and any directory containing
+// a 'cur' directory is treated as a mailbox.
+// Up to scanWorkers folders are checked at the same time, so updates
+// from different folders may be queued in any order.
+// Messages matching the push_exclude_query of mailbox are not queued.
 func (db *DB) CheckFolders(ctx context.Context, mailbox config.Mailbox, maildirPath string, imapQueue chan<- Update) error {
-	md, err := os.Open(maildirPath)
+	var folders []scanFolder
+	err := db.findFolders(ctx, mailbox, maildirPath, "", &folders)
+	if err != nil {
+		return err
+	}
+	return db.scanFolders(ctx, mailbox, folders, imapQueue)
+}
+
+// CheckFolder compares the folder stored at the local path 'path', relative to maildirPath,
+// with the existing database, like CheckFolders. Nothing is done if the folder doesn't exist.
+func (db *DB) CheckFolder(ctx context.Context, mailbox config.Mailbox, maildirPath string, path string, imapQueue chan<- Update) error {
+	mailboxPath := filepath.Join(maildirPath, path)
+	if !isMailDir(mailboxPath) || db.inTrash(mailboxPath) {
+		return nil
+	}
+
+	name, err := db.FolderName(ctx, maildirPath, path)
+	if err != nil || !mailbox.IncludesFolder(name) {
+		return err
+	}
+	return db.scanFolders(ctx, mailbox, []scanFolder{{path: mailboxPath, name: name}}, imapQueue)
+}
+
+// scanFolder is a local mailbox that should be checked
+type scanFolder struct {
+	path string // Full path of the mailbox
+	name string // Name of the folder on the server
+}
+
+// findFolders adds all mailboxes below the directory 'relPath' in maildirPath
+// that should be synchronized to 'folders'
+func (db *DB) findFolders(ctx context.Context, mailbox config.Mailbox, maildirPath string, relPath string, folders *[]scanFolder) error {
+	md, err := os.Open(filepath.Join(maildirPath, relPath))
 	if err != nil {
 		return err
 	}
 	defer md.Close()
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		entries, err := md.Readdir(10)
 		if err != nil {
 			if err == io.EOF {
@@ -30,35 +76,36 @@ func (db *DB) CheckFolders(ctx context.Context, mailbox config.Mailbox, maildirP
 		}
 
 		for _, e := range entries {
-			// Skip files at toplevel
-			if !e.IsDir() {
+			// Skip files, and hidden directories
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
 				continue
 			}
-			name := e.Name()
-
-			// Check if folder is included in sync
-			var include bool
-			if len(mailbox.Folders.Include) > 0 {
-				for _, includeFolder := range mailbox.Folders.Include {
-					if name == includeFolder {
-						include = true
-						break
-					}
-				}
-			} else {
-				include = true
-				for _, includeFolder := range mailbox.Folders.Exclude {
-					if name == includeFolder {
-						include = false
-						break
-					}
-				}
+
+			// The maildir directories of a mailbox are not folders themselves
+			if relPath != "" && (e.Name() == "cur" || e.Name() == "new" || e.Name() == "tmp") {
+				continue
 			}
-			if !include {
+
+			folderPath := filepath.Join(relPath, e.Name())
+			mailboxPath := filepath.Join(maildirPath, folderPath)
+
+			// Trashed mail must never be synchronized again
+			if db.inTrash(mailboxPath) {
 				continue
 			}
 
-			err = db.checkMailbox(ctx, filepath.Join(maildirPath, name), name, imapQueue)
+			// Folder names are escaped when stored locally,
+			// so we convert them back to the name used on the server
+			name, err := db.FolderName(ctx, maildirPath, folderPath)
+			if err != nil {
+				return err
+			}
+
+			if mailbox.IncludesFolder(name) && isMailDir(mailboxPath) {
+				*folders = append(*folders, scanFolder{path: mailboxPath, name: name})
+			}
+
+			err = db.findFolders(ctx, mailbox, maildirPath, folderPath, folders)
 			if err != nil {
 				return err
 			}
@@ -67,70 +114,339 @@ func (db *DB) CheckFolders(ctx context.Context, mailbox config.Mailbox, maildirP
 	return nil
 }
 
-func (db *DB) checkMailbox(ctx context.Context, mailboxPath string, folderName string, imapQueue chan<- Update) error {
-	curPath := filepath.Join(mailboxPath, "cur")
-	md, err := os.Open(curPath)
-	if err != nil {
-		return err
+// isMailDir returns true if path looks like a maildir mailbox
+func isMailDir(path string) bool {
+	st, err := os.Stat(filepath.Join(path, "cur"))
+	return err == nil && st.IsDir()
+}
+
+// scanBatchSize is the number of directory entries read and processed at a time
+const scanBatchSize = 1000
+
+// scanProgressInterval is how often progress is reported when scanning large folders
+const scanProgressInterval = 10 * time.Second
+
+// scanFolders checks the mailboxes in folders using up to scanWorkers goroutines.
+// Each goroutine looks up messages through its own scanHandle, since a notmuch handle
+// may only be used by one goroutine at a time. Writes to the sync database
+// are serialized as usual.
+func (db *DB) scanFolders(ctx context.Context, mailbox config.Mailbox, folders []scanFolder, imapQueue chan<- Update) error {
+	workers := db.scanWorkers
+	if workers > len(folders) {
+		workers = len(folders)
+	}
+	if workers < 1 {
+		return nil
 	}
-	defer md.Close()
 
-	entries, err := md.Readdirnames(0)
+	// The query is evaluated once, instead of for every message
+	excluded, err := db.PushExcluded(mailbox)
+	if err != nil {
+		return fmt.Errorf("cannot evaluate push_exclude_query: %w", err)
+	}
+	err = db.prunePushExcluded(ctx, excluded)
 	if err != nil {
 		return err
 	}
 
-	err = db.Wrap(func(nmDB *notmuch.DB) error {
+	// Stop all workers as soon as one of them fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		for _, name := range entries {
-			messagePath := filepath.Join(curPath, name)
-			msg, err := nmDB.FindMessageByFilename(messagePath)
+	jobs := make(chan scanFolder)
+	errs := make(chan error, workers)
+	var wg gosync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.scanWorker(ctx, mailbox, excluded, jobs, imapQueue)
 			if err != nil {
-				if err == notmuch.ErrNotFound {
-					// FIXME - if message is not found in notmuch, we need to index it
-					//return fmt.Errorf("missing message with filename %s: %w", messagePath, err)
-					continue
-				}
-				return fmt.Errorf("could not find message with filename %s: %w", messagePath, err)
+				cancel()
 			}
+			errs <- err
+		}()
+	}
+
+feed:
+	for _, folder := range folders {
+		select {
+		case jobs <- folder:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	// Report the error that made the other workers stop, rather than their cancellation
+	var firstErr error
+	for err := range errs {
+		if err != nil && (firstErr == nil || errors.Is(firstErr, context.Canceled)) {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// scanWorker checks the mailboxes received on jobs until it's closed.
+// Changes to messages in excluded are not queued.
+func (db *DB) scanWorker(ctx context.Context, mailbox config.Mailbox, excluded map[string]bool, jobs <-chan scanFolder, imapQueue chan<- Update) error {
+	h := &scanHandle{db: db}
+	defer h.close()
+
+	for folder := range jobs {
+		err := db.checkMailbox(ctx, mailbox, h, excluded, folder.path, folder.name, imapQueue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanHandle is a read-only notmuch handle used by a single scan worker.
+// Workers read at the same time as each other, but not while WrapRW is writing,
+// and the handle is reopened after each write so that lookups see the changes.
+type scanHandle struct {
+	db     *DB
+	nmDB   *notmuch.DB
+	writes int // db.nmWrites when nmDB was opened
+}
 
-			messageID := msg.ID()
-
-			tags := msg.Tags()
-			taglist := []string{}
-			tag := &notmuch.Tag{}
-			for tags.Next(&tag) {
-				// The signed and attachment tags are special, since its set based on the contents of the email.
-				// It can therefore not be added or removed during sync
-				if tag.Value == "attachment" || tag.Value == "signed" {
-					continue
-				}
-				taglist = append(taglist, tag.Value)
+// use calls fn with the handle, opening it first if needed
+func (h *scanHandle) use(fn func(nmDB *notmuch.DB) error) error {
+	h.db.nmLock.RLock()
+	defer h.db.nmLock.RUnlock()
+
+	if h.nmDB != nil && h.writes != h.db.nmWrites {
+		h.close()
+	}
+	if h.nmDB == nil {
+		nmDB, err := notmuch.Open(h.db.dbpath, notmuch.DBReadOnly)
+		if err != nil {
+			return err
+		}
+		h.nmDB = nmDB
+		h.writes = h.db.nmWrites
+	}
+	return fn(h.nmDB)
+}
+
+// close closes the handle, if it's open
+func (h *scanHandle) close() {
+	if h.nmDB != nil {
+		h.nmDB.Close()
+		h.nmDB = nil
+	}
+}
+
+// checkMailbox compares the messages in the mailbox at mailboxPath with the sync database.
+// Both 'cur' and 'new' are checked, since messages written locally may not have been
+// moved to 'cur' yet.
+func (db *DB) checkMailbox(ctx context.Context, mailbox config.Mailbox, h *scanHandle, excluded map[string]bool, mailboxPath string, folderName string, imapQueue chan<- Update) error {
+	progress := newScanProgress(folderName)
+	for _, dir := range []string{"cur", "new"} {
+		err := scanDir(ctx, filepath.Join(mailboxPath, dir), func(path string) error {
+			progress.add()
+			return db.checkMessage(ctx, mailbox, h, excluded, path, folderName, imapQueue)
+		})
+		if err != nil && !(dir == "new" && os.IsNotExist(err)) {
+			return err
+		}
+	}
+	progress.done()
+	return nil
+}
+
+// scanDir calls fn with the path of each entry in dir. The directory is read
+// in batches, so that huge folders don't have to be kept in memory all at once.
+func scanDir(ctx context.Context, dir string, fn func(path string) error) error {
+	md, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer md.Close()
+
+	for {
+		entries, err := md.Readdirnames(scanBatchSize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
 			}
-			err = tags.Close()
-			if err != nil {
+			return err
+		}
+
+		for _, name := range entries {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
-
-			err = msg.Close()
+			err = fn(filepath.Join(dir, name))
 			if err != nil {
 				return err
 			}
+		}
+	}
+}
 
-			info, err := db.CheckTags(ctx, folderName, messageID, taglist)
-			if err != nil {
-				return err
+// scanProgress reports how many messages have been checked in a folder, at most once per
+// scanProgressInterval. The total isn't known until the whole directory has been read,
+// so only folders that take long enough to be reported on get a final count.
+type scanProgress struct {
+	folderName string
+	scanned    int
+	start      time.Time
+	next       time.Time
+}
+
+func newScanProgress(folderName string) *scanProgress {
+	now := time.Now()
+	return &scanProgress{
+		folderName: folderName,
+		start:      now,
+		next:       now.Add(scanProgressInterval),
+	}
+}
+
+// add counts a message, and reports progress if it's time to
+func (p *scanProgress) add() {
+	p.scanned++
+	if p.scanned%100 != 0 {
+		return
+	}
+	if now := time.Now(); now.After(p.next) {
+		log.Printf("%s: checked %d messages so far\n", p.folderName, p.scanned)
+		p.next = now.Add(scanProgressInterval)
+	}
+}
+
+// done reports the final count, if progress has been reported before
+func (p *scanProgress) done() {
+	if time.Since(p.start) >= scanProgressInterval {
+		log.Printf("%s: checked %d messages in %s\n", p.folderName, p.scanned, time.Since(p.start).Round(time.Second))
+	}
+}
+
+// syncedTags returns the tags of msg that are synchronized with the server
+func syncedTags(mailbox config.Mailbox, msg *notmuch.Message) ([]string, error) {
+	tags := msg.Tags()
+	taglist := []string{}
+	tag := &notmuch.Tag{}
+	for tags.Next(&tag) {
+		// The signed and attachment tags are special, since its set based on the contents of the email.
+		// It can therefore not be added or removed during sync
+		if tag.Value == "attachment" || tag.Value == "signed" {
+			continue
+		}
+		// Automatic folder tags reflect the state of the server, and are never pushed
+		if mailbox.IsFolderTag(tag.Value) {
+			continue
+		}
+		// Neither are tags excluded by allowed_tags or ignored_tags
+		if !mailbox.SyncsTag(tag.Value) {
+			continue
+		}
+		taglist = append(taglist, tag.Value)
+	}
+	return taglist, tags.Close()
+}
+
+// SyncedTags returns the tags of the message with messageID that are synchronized with the server
+func (db *DB) SyncedTags(mailbox config.Mailbox, messageID string) ([]string, error) {
+	var tags []string
+	err := db.Wrap(func(nmDB *notmuch.DB) error {
+		msg, err := nmDB.FindMessage(messageID)
+		if err != nil {
+			return err
+		}
+		defer msg.Close()
+
+		tags, err = syncedTags(mailbox, msg)
+		return err
+	})
+	return tags, err
+}
+
+// checkMessage compares the tags of the message at messagePath with
+// our synchronized state, and queues an update if they differ,
+// unless the message is in excluded
+func (db *DB) checkMessage(ctx context.Context, mailbox config.Mailbox, h *scanHandle, excluded map[string]bool, messagePath string, folderName string, imapQueue chan<- Update) error {
+	var messageID, draftID string
+	var summary Summary
+	var taglist []string
+	isDraft := mailbox.DraftsFolder != "" && folderName == mailbox.DraftsFolder
+	found := true
+	err := h.use(func(nmDB *notmuch.DB) error {
+		msg, err := nmDB.FindMessageByFilename(messagePath)
+		if err != nil {
+			if err == notmuch.ErrNotFound {
+				// FIXME - if message is not found in notmuch, we need to index it
+				//return fmt.Errorf("missing message with filename %s: %w", messagePath, err)
+				found = false
+				return nil
 			}
+			return fmt.Errorf("could not find message with filename %s: %w", messagePath, err)
+		}
+
+		messageID = msg.ID()
 
-			// queue update to imap server
-			if len(info.AddedTags) > 0 || len(info.RemovedTags) > 0 || info.Created {
-				imapQueue <- Update{
-					MessageInfo: info,
-					Filename:    messagePath,
-				}
+		if isDraft {
+			// Some clients give each revision of a draft a new message id
+			draftID = strings.Trim(msg.Header("X-Draft-ID"), " <>")
+			if draftID == "" {
+				draftID = messageID
 			}
 		}
-		return nil
+
+		if mailbox.StoresHeaders() {
+			summary = NewSummary(msg.Header("From"), msg.Header("Subject"), msg.Header("Date"))
+		}
+
+		taglist, err = syncedTags(mailbox, msg)
+		if err != nil {
+			return err
+		}
+		return msg.Close()
 	})
-	return err
+	if err != nil || !found {
+		return err
+	}
+
+	info, err := db.CheckTags(ctx, folderName, messageID, taglist)
+	if err != nil {
+		return err
+	}
+	info.Summary = summary
+
+	var replaces []UID
+	if isDraft {
+		st, err := os.Stat(messagePath)
+		if err != nil {
+			return err
+		}
+		replaces, err = db.checkDraft(ctx, &info, draftID, folderName, st.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+
+	// queue update to imap server
+	if len(info.AddedTags) > 0 || len(info.RemovedTags) > 0 || info.Created {
+		// Remember why the change is not pushed, instead of treating it as pending forever
+		if excluded[messageID] {
+			return db.markPushExcluded(ctx, messageID)
+		}
+
+		select {
+		case imapQueue <- Update{
+			MessageInfo: info,
+			Filename:    messagePath,
+			DraftID:     draftID,
+			Replaces:    replaces,
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
@@ -0,0 +1,371 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// makeMailbox creates a maildir mailbox in dir containing 'cur' empty files in cur
+// and 'new' empty files in new
+func makeMailbox(tb testing.TB, dir string, cur int, new int) {
+	tb.Helper()
+	for sub, count := range map[string]int{"cur": cur, "new": new, "tmp": 0} {
+		path := filepath.Join(dir, sub)
+		err := os.MkdirAll(path, 0700)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			err = ioutil.WriteFile(filepath.Join(path, fmt.Sprintf("%d.%s:2,S", i, sub)), nil, 0600)
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestScanDirLarge(t *testing.T) {
+	dir := filepath.Join(tempDir(t), "Archive")
+	count := 3*scanBatchSize + 17
+	makeMailbox(t, dir, count, 0)
+
+	seen := make(map[string]int, count)
+	err := scanDir(context.Background(), filepath.Join(dir, "cur"), func(path string) error {
+		seen[path]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != count {
+		t.Errorf("scanned %d files, want %d", len(seen), count)
+	}
+	for path, n := range seen {
+		if n != 1 {
+			t.Errorf("%s was scanned %d times", path, n)
+		}
+	}
+}
+
+func TestScanDirStops(t *testing.T) {
+	dir := filepath.Join(tempDir(t), "Archive")
+	makeMailbox(t, dir, 2*scanBatchSize, 0)
+
+	// An error stops the scan immediately
+	failed := errors.New("failed")
+	scanned := 0
+	err := scanDir(context.Background(), filepath.Join(dir, "cur"), func(path string) error {
+		if scanned++; scanned == 10 {
+			return failed
+		}
+		return nil
+	})
+	if err != failed || scanned != 10 {
+		t.Errorf("scanDir() = %v after %d files, want %v after 10", err, scanned, failed)
+	}
+
+	// So does cancelling it
+	ctx, cancel := context.WithCancel(context.Background())
+	scanned = 0
+	err = scanDir(ctx, filepath.Join(dir, "cur"), func(path string) error {
+		if scanned++; scanned == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || scanned != 10 {
+		t.Errorf("scanDir() = %v after %d files, want %v after 10", err, scanned, context.Canceled)
+	}
+}
+
+func TestCheckFolderScansNew(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	db, err := New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Messages delivered locally may still be in 'new'
+	makeMailbox(t, filepath.Join(dir, "INBOX"), 0, 0)
+	want := map[string]bool{}
+	for i, sub := range []string{"cur", "cur", "new"} {
+		want[addMessage(t, db, filepath.Join(dir, "INBOX"), sub, fmt.Sprint(i))] = true
+	}
+
+	queue := make(chan Update, len(want))
+	err = db.CheckFolder(ctx, config.Mailbox{}, dir, "INBOX", queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(queue)
+
+	// None of the messages have been synchronized, so they're all queued
+	got := map[string]bool{}
+	for update := range queue {
+		got[update.Filename] = true
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
+
+// addMessage writes a message to the mailbox at dir and adds it to the notmuch database
+func addMessage(t *testing.T, db *DB, dir string, sub string, id string) string {
+	t.Helper()
+	path := filepath.Join(dir, sub, id+":2,")
+	err := ioutil.WriteFile(path, []byte(fmt.Sprintf("Message-ID: <%s@example.com>\r\nSubject: test\r\n\r\nTest\r\n", id)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WrapRW(func(nmDB *notmuch.DB) error {
+		msg, err := nmDB.AddMessage(path)
+		if err != nil {
+			return err
+		}
+		return msg.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFindFoldersNested(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	db, err := New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Archive.2023 was fetched from a server using "." as delimiter
+	archive, err := db.FolderPath(ctx, dir, "Archive.2023", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"INBOX", "Work", filepath.Join("Work", "Projects"), filepath.Join("Lists", "golang"), archive} {
+		makeMailbox(t, filepath.Join(dir, path), 0, 0)
+	}
+	// Neither hidden directories nor the maildir directories themselves are folders
+	for _, path := range []string{filepath.Join(".notmuch", "cur"), filepath.Join("INBOX", "cur", "cur")} {
+		err = os.MkdirAll(filepath.Join(dir, path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name: "all folders",
+			want: []string{"Archive.2023", "INBOX", "Lists/golang", "Work", "Work/Projects"},
+		},
+		{
+			name:    "excluded parent",
+			exclude: []string{"Work", "INBOX"},
+			want:    []string{"Archive.2023", "Lists/golang", "Work/Projects"},
+		},
+		{
+			name:    "included nested folder",
+			include: []string{"Work/Projects", "Archive.2023"},
+			want:    []string{"Archive.2023", "Work/Projects"},
+		},
+	}
+
+	for _, tt := range tests {
+		mailbox := config.Mailbox{}
+		mailbox.Folders.Include = tt.include
+		mailbox.Folders.Exclude = tt.exclude
+
+		var folders []scanFolder
+		err := db.findFolders(ctx, mailbox, dir, "", &folders)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		var got []string
+		for _, f := range folders {
+			path, err := filepath.Rel(dir, f.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := EscapeFolder(f.name, "/"); f.name != "Archive.2023" && path != want {
+				t.Errorf("%s: %s is stored at %s, want %s", tt.name, f.name, path, want)
+			}
+			got = append(got, f.name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: folders = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFoldersNested(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	db, err := New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The message was synchronized without tags, and has been flagged locally since
+	projects := filepath.Join(dir, "Work", "Projects")
+	makeMailbox(t, projects, 0, 0)
+	path := addMessage(t, db, projects, "cur", "1")
+	err = db.AddMessageSyncInfo(ctx, MessageInfo{
+		MessageID: "1@example.com",
+		UIDs:      []UID{{FolderName: "Work/Projects", UIDValidity: 1, UID: 1}},
+	}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.WrapRW(func(nmDB *notmuch.DB) error {
+		msg, err := nmDB.FindMessageByFilename(path)
+		if err != nil {
+			return err
+		}
+		defer msg.Close()
+		return msg.AddTag("flagged")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := make(chan Update, 1)
+	err = db.CheckFolders(ctx, config.Mailbox{}, dir, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(queue)
+
+	var updates []Update
+	for update := range queue {
+		updates = append(updates, update)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("queued %d updates, want 1", len(updates))
+	}
+	if updates[0].Filename != path || len(updates[0].UIDs) != 1 || updates[0].UIDs[0].FolderName != "Work/Projects" {
+		t.Errorf("queued %s in %v, want %s in Work/Projects", updates[0].Filename, updates[0].UIDs, path)
+	}
+}
+
+// TestScanFoldersDeterministic checks that the same updates are queued no matter how many
+// workers scan the folders, while the notmuch database is written to at the same time.
+// Run it with -race to check that the workers don't share anything unprotected.
+func TestScanFoldersDeterministic(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	db, err := New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for f := 0; f < 6; f++ {
+		folder := filepath.Join(dir, fmt.Sprintf("Folder%d", f))
+		makeMailbox(t, folder, 0, 0)
+		for i := 0; i < 5; i++ {
+			addMessage(t, db, folder, "cur", fmt.Sprintf("%d.%d", f, i))
+		}
+	}
+
+	// scan returns the queued updates, as "folder: filename", sorted
+	scan := func(workers int) []string {
+		db.SetScanWorkers(workers)
+
+		// Keep writing to the notmuch database while the folders are scanned
+		done := make(chan struct{})
+		writerErr := make(chan error, 1)
+		go func() {
+			for {
+				select {
+				case <-done:
+					writerErr <- nil
+					return
+				default:
+				}
+				err := db.WrapRW(func(nmDB *notmuch.DB) error { return nil })
+				if err != nil {
+					writerErr <- err
+					return
+				}
+			}
+		}()
+
+		queue := make(chan Update, 100)
+		err := db.CheckFolders(ctx, config.Mailbox{}, dir, queue)
+		close(done)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		if err := <-writerErr; err != nil {
+			t.Fatalf("%d workers: writer failed: %v", workers, err)
+		}
+		close(queue)
+
+		var updates []string
+		for update := range queue {
+			updates = append(updates, fmt.Sprintf("%s: %s", update.UIDs[0].FolderName, filepath.Base(update.Filename)))
+		}
+		sort.Strings(updates)
+		return updates
+	}
+
+	want := scan(1)
+	if len(want) != 30 {
+		t.Fatalf("queued %d updates with a single worker, want 30", len(want))
+	}
+	for _, workers := range []int{2, 4, 16} {
+		if got := scan(workers); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers: queued %v, want %v", workers, got, want)
+		}
+	}
+}
+
+// BenchmarkScanDir reads directories of different sizes. Since only a batch of names
+// is kept at a time, the memory allocated per file doesn't grow with the directory.
+func BenchmarkScanDir(b *testing.B) {
+	for _, count := range []int{1000, 10000, 100000} {
+		dir := filepath.Join(tempDir(b), "Archive")
+		makeMailbox(b, dir, count, 0)
+
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				scanned := 0
+				err := scanDir(context.Background(), filepath.Join(dir, "cur"), func(path string) error {
+					scanned++
+					return nil
+				})
+				if err != nil || scanned != count {
+					b.Fatalf("scanned %d of %d files: %v", scanned, count, err)
+				}
+			}
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/float64(b.N*count), "B/file")
+		})
+	}
+}
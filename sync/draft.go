@@ -0,0 +1,130 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// draftTag is the tag notmuch uses for drafts
+const draftTag = "draft"
+
+// hasTag returns true if tag is in tags
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// draftRevision is the latest revision of a draft that has been uploaded to the server
+type draftRevision struct {
+	MessageID string
+	ModTime   time.Time
+}
+
+// lookupDraft returns the latest uploaded revision of the draft with id draftID
+func (db *DB) lookupDraft(ctx context.Context, draftID string) (rev draftRevision, found bool, err error) {
+	var mtime int64
+	err = db.db.QueryRowContext(ctx, `SELECT messageid, mtime FROM drafts WHERE draft_id = ?`, draftID).
+		Scan(&rev.MessageID, &mtime)
+	if err == sql.ErrNoRows {
+		return rev, false, nil
+	}
+	if err != nil {
+		return rev, false, err
+	}
+	rev.ModTime = time.Unix(mtime, 0)
+	return rev, true, nil
+}
+
+// SetDraft records that the revision of draftID stored as messageID,
+// last modified at modTime, has been uploaded to the server
+func (db *DB) SetDraft(ctx context.Context, draftID string, messageID string, modTime time.Time) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	_, err := db.db.ExecContext(ctx, `INSERT INTO drafts(draft_id, messageid, mtime) VALUES(?, ?, ?)
+  ON CONFLICT(draft_id) DO UPDATE SET messageid = excluded.messageid, mtime = excluded.mtime`,
+		draftID, messageID, modTime.Unix())
+	return err
+}
+
+// RemoveUIDs forgets the given UIDs, i.e. after the messages have been removed from the server.
+// The message ids of the affected messages are returned.
+func (db *DB) RemoveUIDs(ctx context.Context, uids []UID) ([]string, error) {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seen := make(map[string]bool)
+	var messageIDs []string
+	for _, uid := range uids {
+		var messageID string
+		err = tx.QueryRowContext(ctx, checkTagsUIDQuery, uid.FolderName, uid.UIDValidity, uid.UID).Scan(new(string), &messageID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil && !seen[messageID] {
+			seen[messageID] = true
+			messageIDs = append(messageIDs, messageID)
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM uids WHERE foldername = ? AND uidvalidity = ? AND uid = ?`,
+			uid.FolderName, uid.UIDValidity, uid.UID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return messageIDs, tx.Commit()
+}
+
+// checkDraft checks if the message at messagePath is a new revision of a draft that has
+// already been uploaded. If so, info is changed so that the message is created on the server,
+// and the previous revision is returned, to be removed once that's done.
+func (db *DB) checkDraft(ctx context.Context, info *MessageInfo, draftID string, folderName string, modTime time.Time) ([]UID, error) {
+	// Only messages tagged as drafts are uploaded. Clients may leave the file
+	// around after the message has been sent, and it should not be uploaded again.
+	if !hasTag(info.WantedTags, draftTag) {
+		if info.Created {
+			info.Created = false
+			info.AddedTags = nil
+		}
+		return nil, nil
+	}
+
+	rev, found, err := db.lookupDraft(ctx, draftID)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	// Older revisions may still exist locally, and must not replace newer ones
+	if !modTime.After(rev.ModTime) {
+		return nil, nil
+	}
+
+	previous, err := db.LookupUIDs(ctx, rev.MessageID)
+	if err != nil {
+		return nil, err
+	}
+
+	var replaces []UID
+	for _, uid := range previous {
+		if uid.FolderName == folderName {
+			replaces = append(replaces, uid)
+		}
+	}
+
+	info.Created = true
+	info.AddedTags = info.WantedTags
+	info.RemovedTags = nil
+	info.UIDs = []UID{{FolderName: folderName}}
+	return replaces, nil
+}
@@ -0,0 +1,84 @@
+package sync
+
+import (
+	"context"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+)
+
+// PushExcluded returns the message ids of all messages matching the push_exclude_query
+// of mailbox. These are never pushed to the server. Nil is returned if no query is set.
+func (db *DB) PushExcluded(mailbox config.Mailbox) (map[string]bool, error) {
+	if mailbox.PushExcludeQuery == "" {
+		return nil, nil
+	}
+
+	ids, err := db.QueryMessageIDs(mailbox.PushExcludeQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		excluded[id] = true
+	}
+	return excluded, nil
+}
+
+// markPushExcluded records that the message with messageID has local changes
+// that are not pushed, since it matches push_exclude_query
+func (db *DB) markPushExcluded(ctx context.Context, messageID string) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	_, err := db.db.ExecContext(ctx, `INSERT INTO push_excluded (messageid) VALUES (?)
+  ON CONFLICT(messageid) DO NOTHING`, messageID)
+	return err
+}
+
+// prunePushExcluded forgets the messages that no longer match push_exclude_query,
+// so that their changes are pushed by the scan that follows
+func (db *DB) prunePushExcluded(ctx context.Context, excluded map[string]bool) error {
+	rows, err := db.db.QueryContext(ctx, `SELECT messageid FROM push_excluded`)
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for rows.Next() {
+		var messageID string
+		err = rows.Scan(&messageID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if !excluded[messageID] {
+			stale = append(stale, messageID)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	for _, messageID := range stale {
+		_, err = db.db.ExecContext(ctx, `DELETE FROM push_excluded WHERE messageid = ?`, messageID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountPushExcluded returns the number of messages with local changes that
+// are not pushed because they match push_exclude_query
+func (db *DB) CountPushExcluded(ctx context.Context) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM push_excluded`).Scan(&count)
+	return count, err
+}
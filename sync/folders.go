@@ -0,0 +1,170 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// unsafeFolderChars are characters that are escaped in local folder names. They are either
+// path separators, invalid on some file systems, or have a special meaning in maildir filenames.
+const unsafeFolderChars = `%/\:*?"<>|`
+
+// reservedFolderNames cannot be used as local directory names, either because they're
+// used by maildir itself, or because they're reserved on Windows
+var reservedFolderNames = map[string]bool{
+	"cur": true, "new": true, "tmp": true,
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// EscapeFolder returns the local path of the server folder 'name', relative to the maildir of the account.
+// Each level of the hierarchy, as separated by delimiter, becomes a directory, and characters that
+// cannot be used safely in directory names are percent-encoded.
+func EscapeFolder(name string, delimiter string) string {
+	parts := []string{name}
+	if delimiter != "" {
+		parts = strings.Split(name, delimiter)
+	}
+	for i, p := range parts {
+		parts[i] = escapeFolderPart(p)
+	}
+	return filepath.Join(parts...)
+}
+
+// escapeFolderPart escapes a single level of a folder name
+func escapeFolderPart(part string) string {
+	var b strings.Builder
+	for i := 0; i < len(part); i++ {
+		c := part[i]
+		escape := c < 0x20 || c == 0x7f || strings.IndexByte(unsafeFolderChars, c) >= 0
+		// A leading dot hides the directory, and trailing dots and spaces are stripped on Windows
+		escape = escape || (i == 0 && c == '.') || (i == len(part)-1 && (c == '.' || c == ' '))
+		if escape {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+
+	escaped := b.String()
+	base := strings.ToLower(escaped)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedFolderNames[base] {
+		escaped = fmt.Sprintf("%%%02X", escaped[0]) + escaped[1:]
+	}
+	return escaped
+}
+
+// UnescapeFolder returns the server name of the folder stored at the local path 'path',
+// relative to the maildir of the account, using delimiter to separate levels of the hierarchy.
+func UnescapeFolder(path string, delimiter string) string {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i, p := range parts {
+		parts[i] = unescapeFolderPart(p)
+	}
+	return strings.Join(parts, delimiter)
+}
+
+// unescapeFolderPart decodes all valid percent-encoded characters in part
+func unescapeFolderPart(part string) string {
+	var b strings.Builder
+	for i := 0; i < len(part); i++ {
+		if part[i] == '%' && i+2 < len(part) && isHex(part[i+1]) && isHex(part[i+2]) {
+			b.WriteByte(unhex(part[i+1])<<4 | unhex(part[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(part[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// accountKey identifies the account whose local copy is stored in maildirPath
+func (db *DB) accountKey(maildirPath string) string {
+	rel, err := filepath.Rel(db.dbpath, maildirPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(maildirPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// FolderPath returns the local path of the server folder 'name', relative to maildirPath,
+// which is the local copy of an account. The path is stored the first time it's used, so that
+// it stays the same even if the way names are escaped changes.
+// Directories created by earlier versions, which didn't escape names, are adopted if they exist.
+func (db *DB) FolderPath(ctx context.Context, maildirPath string, name string, delimiter string) (string, error) {
+	account := db.accountKey(maildirPath)
+
+	var path string
+	err := db.db.QueryRowContext(ctx, `SELECT path FROM folders WHERE account = ? AND name = ?`, account, name).Scan(&path)
+	if err == nil {
+		return filepath.FromSlash(path), nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	path = EscapeFolder(name, delimiter)
+	legacy := filepath.FromSlash(name)
+	if legacy != path && isMailDir(filepath.Join(maildirPath, legacy)) {
+		if isMailDir(filepath.Join(maildirPath, path)) {
+			log.Printf("%s: both %s and %s exist locally, using %s. Merge the messages in %s into it, and remove it\n",
+				name, legacy, path, path, legacy)
+		} else {
+			log.Printf("%s: using the existing directory %s. To use %s instead, move it there and run reset-folder on %s\n",
+				name, legacy, path, name)
+			path = legacy
+		}
+	}
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	_, err = db.db.ExecContext(ctx, `INSERT INTO folders (account, name, path) VALUES (?, ?, ?)`, account, name, filepath.ToSlash(path))
+	if err != nil {
+		return "", fmt.Errorf("cannot store local path of %s: %w", name, err)
+	}
+	return path, nil
+}
+
+// FolderName returns the server name of the folder stored at the local path 'path',
+// relative to maildirPath. Folders that haven't been fetched from the server are assumed
+// to use "/" as hierarchy delimiter.
+func (db *DB) FolderName(ctx context.Context, maildirPath string, path string) (string, error) {
+	var name string
+	err := db.db.QueryRowContext(ctx, `SELECT name FROM folders WHERE account = ? AND path = ?`,
+		db.accountKey(maildirPath), filepath.ToSlash(path)).Scan(&name)
+	if err == sql.ErrNoRows {
+		return UnescapeFolder(path, "/"), nil
+	}
+	return name, err
+}
+
+// ForgetFolderPath removes the stored local path of the server folder 'name',
+// so that it's chosen again the next time the folder is used
+func (db *DB) ForgetFolderPath(ctx context.Context, maildirPath string, name string) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	_, err := db.db.ExecContext(ctx, `DELETE FROM folders WHERE account = ? AND name = ?`, db.accountKey(maildirPath), name)
+	return err
+}
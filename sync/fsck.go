@@ -0,0 +1,323 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// ProblemKind describes a category of inconsistency found by Fsck
+type ProblemKind int
+
+// Inconsistencies that can be found between the maildir, notmuch and the sync database
+const (
+	// UnindexedFile is a file in the maildir that notmuch doesn't know about
+	UnindexedFile ProblemKind = iota
+	// MissingFile is a filename in notmuch that doesn't exist on disk
+	MissingFile
+	// OrphanedMessage is a message in the sync database that notmuch doesn't know about
+	OrphanedMessage
+	// UnknownFolder is a folder in the sync database that doesn't exist in the maildir
+	UnknownFolder
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case UnindexedFile:
+		return "files not indexed by notmuch"
+	case MissingFile:
+		return "files in notmuch that no longer exist"
+	case OrphanedMessage:
+		return "messages in the sync database that notmuch doesn't have"
+	case UnknownFolder:
+		return "folders in the sync database that don't exist locally"
+	}
+	return "unknown"
+}
+
+// Repairable returns true if problems of this kind can be fixed without losing information
+func (k ProblemKind) Repairable() bool {
+	return k != UnknownFolder
+}
+
+// Problem is a single inconsistency found by Fsck
+type Problem struct {
+	Kind ProblemKind
+	// Subject is the path, message id or folder name the problem concerns
+	Subject string
+}
+
+// Action describes what Repair will do to fix the problem
+func (p Problem) Action() string {
+	switch p.Kind {
+	case UnindexedFile:
+		return fmt.Sprintf("index %s", p.Subject)
+	case MissingFile:
+		return fmt.Sprintf("remove %s from notmuch", p.Subject)
+	case OrphanedMessage:
+		return fmt.Sprintf("remove <%s> from the sync database", p.Subject)
+	}
+	return fmt.Sprintf("no automatic repair for %s", p.Subject)
+}
+
+// Fsck cross-checks the maildir at mailboxPath, which is the local copy of a single account,
+// with the notmuch index and the sync database, and returns all inconsistencies found.
+func (db *DB) Fsck(ctx context.Context, mailboxPath string) ([]Problem, error) {
+	var problems []Problem
+
+	folders, err := db.fsckFiles(ctx, mailboxPath, &problems)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.fsckNotmuch(ctx, mailboxPath, &problems)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.fsckSyncDB(ctx, folders, &problems)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Kind < problems[j].Kind })
+	return problems, nil
+}
+
+// fsckFiles looks for files in the maildir that aren't indexed,
+// and returns the names of all folders found
+func (db *DB) fsckFiles(ctx context.Context, mailboxPath string, problems *[]Problem) (map[string]bool, error) {
+	folders := make(map[string]bool)
+	err := filepath.Walk(mailboxPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != mailboxPath && (strings.HasPrefix(info.Name(), ".") || db.inTrash(path)) {
+			return filepath.SkipDir
+		}
+		if !isMailDir(path) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(mailboxPath, path)
+		if err != nil {
+			return err
+		}
+		name, err := db.FolderName(ctx, mailboxPath, rel)
+		if err != nil {
+			return err
+		}
+		folders[name] = true
+
+		for _, sub := range []string{"cur", "new"} {
+			err = db.fsckDir(filepath.Join(path, sub), problems)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return folders, err
+}
+
+// fsckDir checks that all files in the directory dir are indexed
+func (db *DB) fsckDir(dir string, problems *[]Problem) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer d.Close()
+
+	for {
+		names, err := d.Readdirnames(scanBatchSize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		err = db.Wrap(func(nmdb *notmuch.DB) error {
+			for _, name := range names {
+				path := filepath.Join(dir, name)
+				msg, err := nmdb.FindMessageByFilename(path)
+				if err == notmuch.ErrNotFound {
+					*problems = append(*problems, Problem{Kind: UnindexedFile, Subject: path})
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("could not look up %s: %w", path, err)
+				}
+				msg.Close()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fsckNotmuch looks for filenames in the notmuch index below mailboxPath that don't exist
+func (db *DB) fsckNotmuch(ctx context.Context, mailboxPath string, problems *[]Problem) error {
+	rel, err := filepath.Rel(db.dbpath, mailboxPath)
+	if err != nil {
+		return err
+	}
+
+	return db.Wrap(func(nmdb *notmuch.DB) error {
+		q := nmdb.NewQuery(fmt.Sprintf(`path:"%s/**"`, filepath.ToSlash(rel)))
+		defer q.Close()
+
+		msgs, err := q.Messages()
+		if err != nil {
+			return err
+		}
+		defer msgs.Close()
+
+		msg := &notmuch.Message{}
+		for msgs.Next(&msg) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			filenames := msg.Filenames()
+			var filename string
+			for filenames.Next(&filename) {
+				if !strings.HasPrefix(filename, mailboxPath+string(filepath.Separator)) {
+					continue
+				}
+				if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+					*problems = append(*problems, Problem{Kind: MissingFile, Subject: filename})
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// fsckSyncDB looks for messages in the sync database that notmuch doesn't have,
+// and folders that are not in the list of local folders
+func (db *DB) fsckSyncDB(ctx context.Context, folders map[string]bool, problems *[]Problem) error {
+	rows, err := db.db.QueryContext(ctx, `SELECT messageid FROM messages`)
+	if err != nil {
+		return err
+	}
+
+	var messageIDs []string
+	for rows.Next() {
+		var messageID string
+		if err = rows.Scan(&messageID); err != nil {
+			rows.Close()
+			return err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	err = db.Wrap(func(nmdb *notmuch.DB) error {
+		for _, messageID := range messageIDs {
+			msg, err := nmdb.FindMessage(messageID)
+			if err == notmuch.ErrNotFound {
+				*problems = append(*problems, Problem{Kind: OrphanedMessage, Subject: messageID})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			msg.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The sync database does not know which account a folder belongs to,
+	// so these are only reported, never removed automatically
+	rows, err = db.db.QueryContext(ctx, `SELECT DISTINCT foldername FROM uids ORDER BY foldername`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var folder string
+		if err = rows.Scan(&folder); err != nil {
+			return err
+		}
+		if !folders[folder] {
+			*problems = append(*problems, Problem{Kind: UnknownFolder, Subject: folder})
+		}
+	}
+	return rows.Err()
+}
+
+// Repair fixes a single problem found by Fsck.
+// Problems that are not Repairable are left as they are.
+func (db *DB) Repair(ctx context.Context, p Problem) error {
+	switch p.Kind {
+	case UnindexedFile:
+		return db.WrapRW(func(nmdb *notmuch.DB) error {
+			msg, err := nmdb.AddMessage(p.Subject)
+			if err != nil && !errors.Is(err, notmuch.ErrDuplicateMessageID) {
+				return err
+			}
+			if msg != nil {
+				return msg.Close()
+			}
+			return nil
+		})
+	case MissingFile:
+		return db.WrapRW(func(nmdb *notmuch.DB) error {
+			err := nmdb.RemoveMessage(p.Subject)
+			if err != nil && !errors.Is(err, notmuch.ErrDuplicateMessageID) {
+				return err
+			}
+			return nil
+		})
+	case OrphanedMessage:
+		db.writeLock.Lock()
+		defer db.writeLock.Unlock()
+
+		tx, err := db.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM uids WHERE message_id IN (SELECT id FROM messages WHERE messageid = ?)`, p.Subject)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM message_tags WHERE message_id IN (SELECT id FROM messages WHERE messageid = ?)`, p.Subject)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM messages WHERE messageid = ?`, p.Subject)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	return nil
+}
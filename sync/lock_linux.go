@@ -0,0 +1,25 @@
+package sync
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockHeld returns true if another process holds a lock on the file at path,
+// like the one Xapian takes while the database is open for writing
+func lockHeld(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		// Without a lock file, there can't be a lock
+		return false
+	}
+	defer f.Close()
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK}
+	err = syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lock)
+	if err != nil {
+		// We can't tell, so we assume that it is
+		return true
+	}
+	return lock.Type != syscall.F_UNLCK
+}
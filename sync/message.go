@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"strings"
 )
 
 // UID is used to identify the message on the IMAP server
@@ -29,15 +28,22 @@ type MessageInfo struct {
 	RemovedTags []string // RemovedTags lists the flags to be removed from the other side
 	WantedTags  []string // WantedTags is the list of tags that we'll have after we've applied the changes
 	Created     bool     // If set to true, we haven't got this message in the database yet
+
+	// Summary is stored together with the tags, if it's set
+	Summary Summary
+
+	// GmailMessageID is the X-GM-MSGID of the message, which identifies it
+	// across all folders on Gmail. It's stored if it's set.
+	GmailMessageID uint64
+
+	// EmailID is the RFC 8474 EMAILID of the message, which identifies it across
+	// all folders on servers supporting OBJECTID. It's stored if it's set.
+	EmailID string
 }
 
 // CheckTagsUID fetches tags for a messages based on UID and compares them to the list of wanted tags
 func (db *DB) CheckTagsUID(ctx context.Context, folderName string, uidValidity int, uid int, wantedTags []string) (info MessageInfo, err error) {
-	var tags string
-	query := `SELECT tags, messageid FROM uids
-INNER JOIN messages ON messages.id = uids.message_id
-WHERE folderName = ? AND uidvalidity = ? AND uid = ?`
-
+	var id int64
 	info.WantedTags = wantedTags
 	info.UIDs = []UID{{
 		FolderName:  folderName,
@@ -45,8 +51,8 @@ WHERE folderName = ? AND uidvalidity = ? AND uid = ?`
 		UID:         uid,
 	}}
 
-	err = db.db.QueryRowContext(ctx, query, folderName, uidValidity, uid).
-		Scan(&tags, &info.MessageID)
+	err = db.stmts.checkTagsUID.QueryRowContext(ctx, folderName, uidValidity, uid).
+		Scan(&id, &info.MessageID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			info.Created = true
@@ -56,21 +62,21 @@ WHERE folderName = ? AND uidvalidity = ? AND uid = ?`
 		return info, err
 	}
 
+	tags, err := db.syncedTags(ctx, id)
+	if err != nil {
+		return info, err
+	}
 	db.compareTags(&info, tags, wantedTags)
 	return info, nil
 }
 
 // CheckTags fetches tags for a message based on MessageID, and compares those tags to list the of wanted tags
 func (db *DB) CheckTags(ctx context.Context, folderName string, messageid string, wantedTags []string) (info MessageInfo, err error) {
-	var tags string
+	var id int64
 	info.MessageID = messageid
 	info.WantedTags = wantedTags
 
-	query := `SELECT tags, foldername, uidvalidity, uid FROM messages
-INNER JOIN uids ON uids.message_id = messages.id
-WHERE messageid = ?`
-
-	rows, err := db.db.QueryContext(ctx, query, messageid)
+	rows, err := db.stmts.checkTags.QueryContext(ctx, messageid)
 	if err != nil {
 		return info, err
 	}
@@ -79,7 +85,7 @@ WHERE messageid = ?`
 	for rows.Next() {
 		uid := UID{}
 
-		err = rows.Scan(&tags, &uid.FolderName, &uid.UIDValidity, &uid.UID)
+		err = rows.Scan(&id, &uid.FolderName, &uid.UIDValidity, &uid.UID)
 		if err != nil {
 			return info, err
 		}
@@ -87,6 +93,10 @@ WHERE messageid = ?`
 		info.UIDs = append(info.UIDs, uid)
 	}
 
+	if err = rows.Err(); err != nil {
+		return info, err
+	}
+
 	// We found no matches
 	if len(info.UIDs) == 0 {
 		info.Created = true
@@ -99,15 +109,68 @@ WHERE messageid = ?`
 		return info, nil
 	}
 
+	tags, err := db.syncedTags(ctx, id)
+	if err != nil {
+		return info, err
+	}
+	db.compareTags(&info, tags, wantedTags)
+	return info, nil
+}
+
+// CheckTagsMessage fetches tags for a message based on MessageID, like CheckTags, but also
+// for messages that currently have no UIDs, i.e. since they were moved on the server.
+// Created is only set if the message has never been synchronized.
+func (db *DB) CheckTagsMessage(ctx context.Context, messageid string, wantedTags []string) (info MessageInfo, err error) {
+	var id int64
+	info.MessageID = messageid
+	info.WantedTags = wantedTags
+
+	err = db.stmts.selectMessage.QueryRowContext(ctx, messageid).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			info.Created = true
+			info.AddedTags = wantedTags
+			return info, nil
+		}
+		return info, err
+	}
+
+	info.UIDs, err = db.LookupUIDs(ctx, messageid)
+	if err != nil {
+		return info, err
+	}
+
+	tags, err := db.syncedTags(ctx, id)
+	if err != nil {
+		return info, err
+	}
 	db.compareTags(&info, tags, wantedTags)
 	return info, nil
 }
 
-func (db *DB) compareTags(info *MessageInfo, tags string, wantedTags []string) {
+// syncedTags returns the tags that were synchronized for the message with row id 'id'
+func (db *DB) syncedTags(ctx context.Context, id int64) ([]string, error) {
+	rows, err := db.stmts.selectTags.QueryContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (db *DB) compareTags(info *MessageInfo, tags []string, wantedTags []string) {
 	dbMap := map[string]struct{}{}
-	dbTags := strings.Split(tags, ",")
-	for _, t := range dbTags {
-		t = strings.TrimSpace(t)
+	for _, t := range tags {
 		if t == "" {
 			continue
 		}
@@ -115,7 +178,6 @@ func (db *DB) compareTags(info *MessageInfo, tags string, wantedTags []string) {
 	}
 
 	for _, t := range wantedTags {
-		t = strings.TrimSpace(t)
 		if t == "" {
 			continue
 		}
@@ -136,26 +198,121 @@ func (db *DB) compareTags(info *MessageInfo, tags string, wantedTags []string) {
 }
 
 // AddMessageInfo updates the list of synchronized tags for a message
-func (db *DB) AddMessageSyncInfo(info MessageInfo, tags []string) error {
-	// We need to insert the messageid into 'messages', and also update the 'uids'-table
-	query := `INSERT INTO messages(messageid, tags) VALUES(?, ?)
-  ON CONFLICT(messageid) DO UPDATE SET tags=?;`
+func (db *DB) AddMessageSyncInfo(ctx context.Context, info MessageInfo, tags []string) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// We need to insert the messageid into 'messages', replace its tags in 'message_tags',
+	// and also update the 'uids'-table
+	_, err = tx.StmtContext(ctx, db.stmts.insertMessage).ExecContext(ctx, info.MessageID)
+	if err != nil {
+		return fmt.Errorf("cannot exec query %s: %w", insertMessageQuery, err)
+	}
 
-	tagStr := strings.Join(tags, ",")
-	_, err := db.db.Exec(query, info.MessageID, tagStr, tagStr)
+	_, err = tx.StmtContext(ctx, db.stmts.deleteTags).ExecContext(ctx, info.MessageID)
 	if err != nil {
-		return fmt.Errorf("cannot exec query %s: %w", query, err)
+		return fmt.Errorf("cannot exec query %s: %w", deleteTagsQuery, err)
+	}
+
+	insertTag := tx.StmtContext(ctx, db.stmts.insertTag)
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		_, err = insertTag.ExecContext(ctx, tag, info.MessageID)
+		if err != nil {
+			return fmt.Errorf("cannot exec query %s: %w", insertTagQuery, err)
+		}
+	}
+
+	if !info.Summary.IsZero() {
+		err = db.setSummary(ctx, tx, info.MessageID, info.Summary)
+		if err != nil {
+			return err
+		}
+	}
+
+	if info.GmailMessageID != 0 {
+		_, err = tx.StmtContext(ctx, db.stmts.setGmailMessageID).ExecContext(ctx, int64(info.GmailMessageID), info.MessageID)
+		if err != nil {
+			return fmt.Errorf("cannot exec query %s: %w", setGmailMessageIDQuery, err)
+		}
+	}
+
+	if info.EmailID != "" {
+		_, err = tx.StmtContext(ctx, db.stmts.setEmailID).ExecContext(ctx, info.EmailID, info.MessageID)
+		if err != nil {
+			return fmt.Errorf("cannot exec query %s: %w", setEmailIDQuery, err)
+		}
 	}
 
+	insertUID := tx.StmtContext(ctx, db.stmts.insertUID)
 	for _, uid := range info.UIDs {
-		query = `INSERT INTO uids(message_id, foldername, uidvalidity, uid)
-			 SELECT id, ?, ?, ? FROM messages WHERE messageid = ?
-  ON CONFLICT(uidvalidity, uid) DO NOTHING;`
+		_, err = insertUID.ExecContext(ctx, uid.FolderName, uid.UIDValidity, uid.UID, info.MessageID)
+		if err != nil {
+			return fmt.Errorf("cannot exec query %s: %w", insertUIDQuery, err)
+		}
+	}
+	return tx.Commit()
+}
 
-		_, err = db.db.Exec(query, uid.FolderName, uid.UIDValidity, uid.UID, info.MessageID)
+// LookupUIDs returns all UIDs known for the message with id messageid
+func (db *DB) LookupUIDs(ctx context.Context, messageid string) ([]UID, error) {
+	rows, err := db.stmts.checkTags.QueryContext(ctx, messageid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []UID
+	for rows.Next() {
+		var id int64
+		uid := UID{}
+		err = rows.Scan(&id, &uid.FolderName, &uid.UIDValidity, &uid.UID)
 		if err != nil {
-			return fmt.Errorf("cannot exec query %s: %w", query, err)
+			return nil, err
 		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+// LookupGmailMessage returns the message id of the message with the Gmail message id gmMsgID,
+// or an empty string if we don't have it
+func (db *DB) LookupGmailMessage(ctx context.Context, gmMsgID uint64) (string, error) {
+	var messageID string
+	err := db.stmts.lookupGmailMessage.QueryRowContext(ctx, int64(gmMsgID)).Scan(&messageID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return messageID, err
+}
+
+// LookupEmailID returns the message id of the message with the EMAILID emailID,
+// or an empty string if we don't have it
+func (db *DB) LookupEmailID(ctx context.Context, emailID string) (string, error) {
+	var messageID string
+	err := db.stmts.lookupEmailID.QueryRowContext(ctx, emailID).Scan(&messageID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return messageID, err
+}
+
+// AddUID records that the message with id messageID is also stored as uid
+func (db *DB) AddUID(ctx context.Context, messageID string, uid UID) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	_, err := db.stmts.insertUID.ExecContext(ctx, uid.FolderName, uid.UIDValidity, uid.UID, messageID)
+	if err != nil {
+		return fmt.Errorf("cannot exec query %s: %w", insertUIDQuery, err)
 	}
 	return nil
 }
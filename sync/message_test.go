@@ -0,0 +1,177 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sorted returns a sorted copy of tags
+func sorted(tags []string) []string {
+	tags = append([]string(nil), tags...)
+	sort.Strings(tags)
+	return tags
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		changed []string // The tags after they've been changed locally
+		added   []string
+		removed []string
+	}{
+		{
+			name:    "commas",
+			tags:    []string{"a,b", "a", "b", ","},
+			changed: []string{"a", "b"},
+			removed: []string{",", "a,b"},
+		},
+		{
+			name:    "spaces",
+			tags:    []string{"to do", " leading", "trailing "},
+			changed: []string{"to do", "leading", "trailing "},
+			added:   []string{"leading"},
+			removed: []string{" leading"},
+		},
+		{
+			name:    "unicode",
+			tags:    []string{"ärende", "日本語", "📌"},
+			changed: []string{"ärende", "日本語", "📌", "ärende,日本語"},
+			added:   []string{"ärende,日本語"},
+		},
+		{
+			name: "no tags",
+		},
+	}
+
+	ctx := context.Background()
+	dir := tempDir(t)
+	db, err := New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i, tt := range tests {
+		messageID := fmt.Sprintf("%d@example.com", i)
+		uid := UID{FolderName: "INBOX", UIDValidity: 1, UID: i + 1}
+		err = db.AddMessageSyncInfo(ctx, MessageInfo{MessageID: messageID, UIDs: []UID{uid}}, tt.tags)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		// The tags are stored exactly as given
+		info, err := db.CheckTagsUID(ctx, uid.FolderName, uid.UIDValidity, uid.UID, tt.tags)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if info.Created || len(info.AddedTags) > 0 || len(info.RemovedTags) > 0 {
+			t.Errorf("%s: unchanged tags reported as added %q, removed %q", tt.name, info.AddedTags, info.RemovedTags)
+		}
+
+		// Changes to them are found, both by UID and by message id
+		byUID, err := db.CheckTagsUID(ctx, uid.FolderName, uid.UIDValidity, uid.UID, tt.changed)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		byMessageID, err := db.CheckTags(ctx, uid.FolderName, messageID, tt.changed)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, info := range []MessageInfo{byUID, byMessageID} {
+			if !reflect.DeepEqual(sorted(info.AddedTags), sorted(tt.added)) || !reflect.DeepEqual(sorted(info.RemovedTags), sorted(tt.removed)) {
+				t.Errorf("%s: added %q, removed %q, want added %q, removed %q", tt.name, info.AddedTags, info.RemovedTags, tt.added, tt.removed)
+			}
+		}
+
+		// Storing the changed tags replaces the old ones
+		err = db.AddMessageSyncInfo(ctx, MessageInfo{MessageID: messageID}, tt.changed)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		info, err = db.CheckTags(ctx, uid.FolderName, messageID, tt.changed)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(info.AddedTags) > 0 || len(info.RemovedTags) > 0 {
+			t.Errorf("%s: stored tags reported as added %q, removed %q", tt.name, info.AddedTags, info.RemovedTags)
+		}
+	}
+}
+
+func TestMigrateCommaSeparatedTags(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	path := filepath.Join(dir, "sync.db")
+
+	// Create a database as it was before message_tags was added
+	version := -1
+	for i, m := range migrations {
+		if strings.Contains(m, "'message_tags'") {
+			version = i
+			break
+		}
+	}
+	if version < 0 {
+		t.Fatal("no migration creates message_tags")
+	}
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[:version] {
+		if _, err = old.Exec(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := map[string]string{
+		"1@example.com": "inbox,unread",
+		"2@example.com": "inbox, flagged ,work",
+		"3@example.com": "",
+		"4@example.com": ",,replied,",
+	}
+	for messageID, tags := range stored {
+		_, err = old.Exec(`INSERT INTO messages (messageid, tags) VALUES (?, ?)`, messageID, tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = old.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	db, err := New(ctx, dir, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	want := map[string][]string{
+		"1@example.com": {"inbox", "unread"},
+		"2@example.com": {"flagged", "inbox", "work"},
+		"3@example.com": nil,
+		"4@example.com": {"replied"},
+	}
+	for messageID, tags := range want {
+		var id int64
+		err = db.db.QueryRowContext(ctx, selectMessageQuery, messageID).Scan(&id)
+		if err != nil {
+			t.Fatalf("%s: %v", messageID, err)
+		}
+		got, err := db.syncedTags(ctx, id)
+		if err != nil {
+			t.Fatalf("%s: %v", messageID, err)
+		}
+		if got := sorted(got); !reflect.DeepEqual(got, tags) {
+			t.Errorf("%s: tags %q were migrated to %q, want %q", messageID, stored[messageID], got, tags)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"context"
+)
+
+// SetFolderMetadata replaces the stored METADATA entries of the server folder 'name'
+// in the account stored in maildirPath. Entries with an empty value are not stored.
+func (db *DB) SetFolderMetadata(ctx context.Context, maildirPath string, name string, entries map[string]string) error {
+	account := db.accountKey(maildirPath)
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM folder_metadata WHERE account = ? AND foldername = ?`, account, name)
+	if err != nil {
+		return err
+	}
+
+	for entry, value := range entries {
+		if value == "" {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO folder_metadata (account, foldername, entry, value) VALUES (?, ?, ?, ?)`,
+			account, name, entry, value)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FolderMetadata returns the METADATA entries stored for the server folder 'name'
+// in the account stored in maildirPath
+func (db *DB) FolderMetadata(ctx context.Context, maildirPath string, name string) (map[string]string, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT entry, value FROM folder_metadata WHERE account = ? AND foldername = ?`,
+		db.accountKey(maildirPath), name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]string)
+	for rows.Next() {
+		var entry, value string
+		err = rows.Scan(&entry, &value)
+		if err != nil {
+			return nil, err
+		}
+		entries[entry] = value
+	}
+	return entries, rows.Err()
+}
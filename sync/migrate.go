@@ -2,27 +2,93 @@ package sync
 
 import (
 	"context"
+	"fmt"
 )
 
-func (db *DB) migrate(ctx context.Context) error {
-	migrations := []string{
-		`CREATE TABLE IF NOT EXISTS 'messages' (
+// migrations lists all changes to the database schema, in order.
+// The number of applied migrations is stored in the user_version pragma,
+// so new migrations must always be added at the end of the list.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS 'messages' (
 id INTEGER PRIMARY KEY AUTOINCREMENT,
 messageid varchar(256) NOT NULL UNIQUE,
 tags text NOT NULL
 );`,
-		`CREATE TABLE IF NOT EXISTS 'uids' (
+	`CREATE TABLE IF NOT EXISTS 'uids' (
 	message_id	INTEGER NOT NULL,
 	foldername	VARCHAR(256) NOT NULL,
 	uidvalidity INTEGER NOT NULL,
 	uid			INTEGER NOT NULL,
 	FOREIGN KEY (message_id) REFERENCES messages(id)
 );`,
-		`CREATE UNIQUE INDEX IF NOT EXISTS uid_unique ON uids (uidvalidity, uid);`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS uid_unique ON uids (uidvalidity, uid);`,
+	`ALTER TABLE messages ADD COLUMN header_from VARCHAR(256) NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN header_subject VARCHAR(256) NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN header_date INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE IF NOT EXISTS 'drafts' (
+	draft_id	VARCHAR(256) NOT NULL PRIMARY KEY,
+	messageid	VARCHAR(256) NOT NULL,
+	mtime		INTEGER NOT NULL
+);`,
+	`ALTER TABLE messages ADD COLUMN gm_msgid INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE INDEX IF NOT EXISTS messages_gm_msgid ON messages (gm_msgid);`,
+	`ALTER TABLE messages ADD COLUMN emailid VARCHAR(256) NOT NULL DEFAULT '';`,
+	`CREATE INDEX IF NOT EXISTS messages_emailid ON messages (emailid);`,
+	`CREATE TABLE IF NOT EXISTS 'folders' (
+	account		VARCHAR(256) NOT NULL,
+	name		VARCHAR(256) NOT NULL,
+	path		VARCHAR(256) NOT NULL,
+	PRIMARY KEY (account, name),
+	UNIQUE (account, path)
+);`,
+	`CREATE TABLE IF NOT EXISTS 'message_tags' (
+	message_id	INTEGER NOT NULL,
+	tag			TEXT NOT NULL,
+	PRIMARY KEY (message_id, tag),
+	FOREIGN KEY (message_id) REFERENCES messages(id)
+);`,
+	`CREATE INDEX IF NOT EXISTS message_tags_tag ON message_tags (tag);`,
+	// Tags were previously stored comma-separated in messages.tags
+	`INSERT OR IGNORE INTO message_tags (message_id, tag)
+WITH RECURSIVE split(message_id, tag, rest) AS (
+	SELECT id, '', tags || ',' FROM messages
+	UNION ALL
+	SELECT message_id, trim(substr(rest, 1, instr(rest, ',') - 1)), substr(rest, instr(rest, ',') + 1)
+	FROM split WHERE rest != ''
+)
+SELECT message_id, tag FROM split WHERE tag != '';`,
+	`CREATE TABLE IF NOT EXISTS 'rejected_keywords' (
+	foldername	VARCHAR(256) NOT NULL,
+	keyword		TEXT NOT NULL,
+	PRIMARY KEY (foldername, keyword)
+);`,
+	`CREATE TABLE IF NOT EXISTS 'push_excluded' (
+	messageid	VARCHAR(256) NOT NULL PRIMARY KEY
+);`,
+	`CREATE TABLE IF NOT EXISTS 'folder_metadata' (
+	account		VARCHAR(256) NOT NULL,
+	foldername	VARCHAR(256) NOT NULL,
+	entry		VARCHAR(256) NOT NULL,
+	value		TEXT NOT NULL,
+	PRIMARY KEY (account, foldername, entry)
+);`,
+}
+
+func (db *DB) migrate(ctx context.Context) error {
+	var version int
+	err := db.db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return err
 	}
 
-	for _, m := range migrations {
-		_, err := db.db.ExecContext(ctx, m)
+	for ; version < len(migrations); version++ {
+		_, err = db.db.ExecContext(ctx, migrations[version])
+		if err != nil {
+			return fmt.Errorf("cannot apply migration %d: %w", version, err)
+		}
+
+		// PRAGMA does not support placeholders
+		_, err = db.db.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, version+1))
 		if err != nil {
 			return err
 		}
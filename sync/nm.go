@@ -2,61 +2,208 @@ package sync
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
 
 	notmuch "github.com/zenhack/go.notmuch"
 )
 
-// Wrap creates a readonly database connection, and executes the 'fn' function with this connection
+// Wrap creates a readonly database connection, and executes the 'fn' function with this connection.
+// Access to the notmuch database is serialized, so 'fn' must not call Wrap or WrapRW itself.
 func (db *DB) Wrap(fn func(db *notmuch.DB) error) error {
+	db.nmLock.Lock()
+	defer db.nmLock.Unlock()
 	return db.wrap(notmuch.DBReadOnly, fn)
 }
 
 // WrapRW creates a readwrite-connection and exectues the 'fn' function with this connection
+// Access to the notmuch database is serialized, so 'fn' must not call Wrap or WrapRW itself.
 func (db *DB) WrapRW(fn func(db *notmuch.DB) error) error {
+	db.nmLock.Lock()
+	defer db.nmLock.Unlock()
+	db.nmWrites++
 	return db.wrap(notmuch.DBReadWrite, fn)
 }
 
+// wrap must be called with nmLock held
 func (db *DB) wrap(mode notmuch.DBMode, fn func(*notmuch.DB) error) error {
-	if mode == notmuch.DBReadWrite && db.nmdb != nil {
-		err := db.nmdb.Close()
+	// The readonly connection is kept open between calls
+	if mode == notmuch.DBReadOnly && db.nmdb != nil {
+		return fn(db.nmdb)
+	}
+
+	if mode == notmuch.DBReadWrite {
+		nmdb, err := db.openRW()
 		if err != nil {
+			// The readonly connection is still usable, so reads can continue
 			return err
 		}
+		defer nmdb.Close()
+
+		// The database is upgraded the first time it's opened for writing,
+		// so that commands that only read never need to write to it
+		if !db.upgraded {
+			if nmdb.NeedsUpgrade() {
+				err = nmdb.Upgrade()
+				if err != nil {
+					return err
+				}
+			}
+			db.upgraded = true
+		}
+
+		// The readonly connection doesn't see our changes, so it's reopened on the next read
+		if db.nmdb != nil {
+			db.nmdb.Close()
+			db.nmdb = nil
+		}
+		return fn(nmdb)
 	}
 
 	nmdb, err := notmuch.Open(db.dbpath, mode)
 	if err != nil && errors.Is(err, notmuch.ErrFileError) {
 		nmdb, err = notmuch.Create(db.dbpath)
 	}
-
 	if err != nil {
 		return err
 	}
 
-	if mode == notmuch.DBReadWrite {
-		defer nmdb.Close()
-	}
-	err = fn(nmdb)
-	return err
+	db.nmdb = nmdb
+	return fn(nmdb)
 }
 
-// createOrUpgrade opens the database located at 'p' and upgrades it if necessary,
-// or creates it if it doesn't exist yet.
-func (db *DB) createOrUpgrade() error {
-	nmdb, err := notmuch.Open(db.dbpath, notmuch.DBReadWrite)
-	if err != nil && errors.Is(err, notmuch.ErrFileError) {
-		nmdb, err = notmuch.Create(db.dbpath)
-	}
-	if err != nil {
-		return err
+// DefaultLockTimeout is how long we wait for the write lock on the notmuch database by default
+const DefaultLockTimeout = 30 * time.Second
+
+// ErrLocked is returned when the notmuch database could not be opened for writing,
+// because another process kept it locked for longer than the lock timeout
+var ErrLocked = errors.New("notmuch database is locked by another process")
+
+// SetLockTimeout sets how long we wait for another process to release
+// its write lock on the notmuch database
+func (db *DB) SetLockTimeout(timeout time.Duration) {
+	db.lockTimeout = timeout
+}
+
+// openRW opens the notmuch database for writing, creating it if it doesn't exist.
+// If another process holds the write lock, we retry with backoff until lockTimeout has passed.
+func (db *DB) openRW() (*notmuch.DB, error) {
+	deadline := time.Now().Add(db.lockTimeout)
+	delay := 100 * time.Millisecond
+	waiting := false
+	for {
+		nmdb, err := notmuch.Open(db.dbpath, notmuch.DBReadWrite)
+		if err != nil && errors.Is(err, notmuch.ErrFileError) {
+			nmdb, err = notmuch.Create(db.dbpath)
+		}
+
+		// notmuch reports a held lock as a Xapian exception, but so are
+		// many other problems, which retrying won't help with
+		if err == nil || !errors.Is(err, notmuch.ErrXapianException) || !lockHeld(db.lockFile()) {
+			if waiting && err == nil {
+				log.Printf("notmuch database lock acquired\n")
+			}
+			return nmdb, err
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("%w (gave up after %s, lock file %s)", ErrLocked, db.lockTimeout, db.lockFile())
+		}
+		if !waiting {
+			log.Printf("waiting up to %s for another process to release the notmuch database (%s)\n", db.lockTimeout, db.lockFile())
+			waiting = true
+		}
+
+		time.Sleep(delay)
+		if delay *= 2; delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
 	}
-	defer nmdb.Close()
+}
+
+// lockFile returns the path of the file Xapian uses to lock the notmuch database
+func (db *DB) lockFile() string {
+	return filepath.Join(db.dbpath, ".notmuch", "xapian", "flintlock")
+}
+
+// QueryMessageIDs returns the message ids of all messages matching the notmuch query
+func (db *DB) QueryMessageIDs(query string) ([]string, error) {
+	var ids []string
+	err := db.Wrap(func(nmdb *notmuch.DB) error {
+		q := nmdb.NewQuery(query)
+		defer q.Close()
 
-	if nmdb.NeedsUpgrade() {
-		err = nmdb.Upgrade()
+		msgs, err := q.Messages()
 		if err != nil {
 			return err
 		}
-	}
-	return nil
+		defer msgs.Close()
+
+		msg := &notmuch.Message{}
+		for msgs.Next(&msg) {
+			ids = append(ids, msg.ID())
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// ReplaceFiles removes all filenames of the message with id messageID that are
+// located in one of the directories in dirs, except for keepPath.
+// The files are removed both from the notmuch index and from disk.
+func (db *DB) ReplaceFiles(messageID string, keepPath string, dirs ...string) error {
+	return db.WrapRW(func(nmdb *notmuch.DB) error {
+		msg, err := nmdb.FindMessage(messageID)
+		if err != nil {
+			return err
+		}
+
+		var oldPaths []string
+		filenames := msg.Filenames()
+		var filename string
+		for filenames.Next(&filename) {
+			if filename == keepPath {
+				continue
+			}
+			for _, dir := range dirs {
+				if filepath.Dir(filename) == dir {
+					oldPaths = append(oldPaths, filename)
+					break
+				}
+			}
+		}
+		msg.Close()
+
+		for _, p := range oldPaths {
+			// notmuch signals that other filenames are still
+			// available for this message with ErrDuplicateMessageID
+			err = nmdb.RemoveMessage(p)
+			if err != nil && !errors.Is(err, notmuch.ErrDuplicateMessageID) {
+				return err
+			}
+
+			err = db.removeFile(p)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MessageIDByFilename returns the message id of the message stored in filename
+func (db *DB) MessageIDByFilename(filename string) (string, error) {
+	var messageID string
+	err := db.Wrap(func(nmdb *notmuch.DB) error {
+		msg, err := nmdb.FindMessageByFilename(filename)
+		if err != nil {
+			return err
+		}
+		messageID = msg.ID()
+		return msg.Close()
+	})
+	return messageID, err
 }
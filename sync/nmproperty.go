@@ -0,0 +1,74 @@
+package sync
+
+// The version of go.notmuch we use doesn't support message properties, so they're
+// accessed through libnotmuch directly. Properties were added in notmuch 0.23.
+
+// #cgo LDFLAGS: -lnotmuch
+// #include <stdlib.h>
+// #include <notmuch.h>
+import "C"
+import (
+	"errors"
+	"unsafe"
+
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// MessageProperty is a key/value pair stored with a notmuch message
+type MessageProperty struct {
+	Key   string
+	Value string
+}
+
+// messagePtr returns the libnotmuch message that m wraps.
+// go.notmuch stores it as the first field of every wrapper type, which doesn't
+// change as long as go.mod pins the same version.
+func messagePtr(m *notmuch.Message) *C.notmuch_message_t {
+	return *(**C.notmuch_message_t)(unsafe.Pointer(m))
+}
+
+// statusErr returns nil if s is NOTMUCH_STATUS_SUCCESS, and an error describing it otherwise
+func statusErr(s C.notmuch_status_t) error {
+	if s == C.NOTMUCH_STATUS_SUCCESS {
+		return nil
+	}
+	return errors.New(C.GoString(C.notmuch_status_to_string(s)))
+}
+
+// MessageProperties returns the properties of m with keys starting with prefix
+func MessageProperties(m *notmuch.Message, prefix string) []MessageProperty {
+	ckey := C.CString(prefix)
+	defer C.free(unsafe.Pointer(ckey))
+
+	var props []MessageProperty
+	iter := C.notmuch_message_get_properties(messagePtr(m), ckey, C.FALSE)
+	if iter == nil {
+		return nil
+	}
+	defer C.notmuch_message_properties_destroy(iter)
+	for ; C.notmuch_message_properties_valid(iter) != 0; C.notmuch_message_properties_move_to_next(iter) {
+		props = append(props, MessageProperty{
+			Key:   C.GoString(C.notmuch_message_properties_key(iter)),
+			Value: C.GoString(C.notmuch_message_properties_value(iter)),
+		})
+	}
+	return props
+}
+
+// AddMessageProperty adds the property key with value to m. A key may have several values.
+// The database must be opened in read-write mode.
+func AddMessageProperty(m *notmuch.Message, key, value string) error {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(cvalue))
+	return statusErr(C.notmuch_message_add_property(messagePtr(m), ckey, cvalue))
+}
+
+// RemoveMessageProperties removes all values of the property key from m.
+// The database must be opened in read-write mode.
+func RemoveMessageProperties(m *notmuch.Message, key string) error {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	return statusErr(C.notmuch_message_remove_all_properties(messagePtr(m), ckey))
+}
@@ -0,0 +1,102 @@
+package sync
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// Notmuch message properties describing where a message is stored on the server.
+// nmsync.folder is set once for each folder, and the UID validity and UID in that
+// folder are stored in nmsync.uidvalidity.<folder> and nmsync.uid.<folder>.
+// Properties are separate from tags, so they're never pushed to the server.
+const (
+	propertyPrefix      = "nmsync."
+	propertyFolder      = propertyPrefix + "folder"
+	propertyUIDValidity = propertyPrefix + "uidvalidity."
+	propertyUID         = propertyPrefix + "uid."
+)
+
+// propertyKeyFolder returns folder in a form that can be used in a property key,
+// which must not contain '='
+func propertyKeyFolder(folder string) string {
+	return strings.NewReplacer("%", "%25", "=", "%3D").Replace(folder)
+}
+
+// SetLocationProperties replaces the location properties of the message with messageID
+// with uids. Nothing is done if notmuch doesn't know the message.
+func (db *DB) SetLocationProperties(messageID string, uids []UID) error {
+	return db.WrapRW(func(nmdb *notmuch.DB) error {
+		m, err := nmdb.FindMessage(messageID)
+		if err != nil {
+			if err == notmuch.ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		defer m.Close()
+
+		// Each key may have been set several times, but is only removed once
+		keys := make(map[string]bool)
+		for _, prop := range MessageProperties(m, propertyPrefix) {
+			keys[prop.Key] = true
+		}
+
+		for key := range keys {
+			err = RemoveMessageProperties(m, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, uid := range uids {
+			folder := propertyKeyFolder(uid.FolderName)
+			for key, value := range map[string]string{
+				propertyFolder:               uid.FolderName,
+				propertyUIDValidity + folder: strconv.Itoa(uid.UIDValidity),
+				propertyUID + folder:         strconv.Itoa(uid.UID),
+			} {
+				err = AddMessageProperty(m, key, value)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// LocationProperties returns the locations stored in the properties of the message
+// with messageID, ordered by folder. Folders without a valid UID are returned with UID 0.
+func (db *DB) LocationProperties(messageID string) ([]UID, error) {
+	var uids []UID
+	err := db.Wrap(func(nmdb *notmuch.DB) error {
+		m, err := nmdb.FindMessage(messageID)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+
+		values := make(map[string]string)
+		var folders []string
+		for _, prop := range MessageProperties(m, propertyPrefix) {
+			if prop.Key == propertyFolder {
+				folders = append(folders, prop.Value)
+			} else {
+				values[prop.Key] = prop.Value
+			}
+		}
+
+		sort.Strings(folders)
+		for _, folder := range folders {
+			uid := UID{FolderName: folder}
+			uid.UIDValidity, _ = strconv.Atoi(values[propertyUIDValidity+propertyKeyFolder(folder)])
+			uid.UID, _ = strconv.Atoi(values[propertyUID+propertyKeyFolder(folder)])
+			uids = append(uids, uid)
+		}
+		return nil
+	})
+	return uids, err
+}
@@ -0,0 +1,62 @@
+package sync
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocationProperties(t *testing.T) {
+	tests := []struct {
+		name string
+		uids []UID
+	}{
+		{
+			name: "one folder",
+			uids: []UID{{FolderName: "INBOX", UIDValidity: 1, UID: 42}},
+		},
+		{
+			name: "folders that need escaping",
+			uids: []UID{
+				{FolderName: "100%", UIDValidity: 5, UID: 1},
+				{FolderName: "Archive=2023", UIDValidity: 3, UID: 10},
+				{FolderName: "INBOX", UIDValidity: 1, UID: 42},
+			},
+		},
+		{
+			name: "moved",
+			uids: []UID{{FolderName: "Trash", UIDValidity: 7, UID: 2}},
+		},
+		{
+			name: "removed from the server",
+		},
+	}
+
+	ctx := context.Background()
+	dir := tempDir(t)
+	db, err := New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	inbox := filepath.Join(dir, "INBOX")
+	makeMailbox(t, inbox, 0, 0)
+	addMessage(t, db, inbox, "cur", "1")
+
+	// Each case replaces the properties set by the one before it
+	for _, tt := range tests {
+		err = db.SetLocationProperties("1@example.com", tt.uids)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := db.LocationProperties("1@example.com")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.uids) {
+			t.Errorf("%s: LocationProperties() = %v, want %v", tt.name, got, tt.uids)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package sync
+
+import (
+	"context"
+)
+
+// RejectKeyword records that the server refuses to store keyword on messages in folderName
+func (db *DB) RejectKeyword(ctx context.Context, folderName string, keyword string) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	_, err := db.db.ExecContext(ctx, `INSERT INTO rejected_keywords (foldername, keyword) VALUES (?, ?)
+  ON CONFLICT(foldername, keyword) DO NOTHING`, folderName, keyword)
+	return err
+}
+
+// RejectedKeywords returns the keywords that the server refuses to store in folderName
+func (db *DB) RejectedKeywords(ctx context.Context, folderName string) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT keyword FROM rejected_keywords WHERE foldername = ? ORDER BY keyword`, folderName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keywords []string
+	for rows.Next() {
+		var keyword string
+		err = rows.Scan(&keyword)
+		if err != nil {
+			return nil, err
+		}
+		keywords = append(keywords, keyword)
+	}
+	return keywords, rows.Err()
+}
+
+// ClearRejectedKeywords forgets all rejected keywords, so that they're stored again.
+// The number of forgotten keywords is returned.
+func (db *DB) ClearRejectedKeywords(ctx context.Context) (int64, error) {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	res, err := db.db.ExecContext(ctx, `DELETE FROM rejected_keywords`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,125 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// FolderUIDs returns up to 'limit' of the UIDs stored for folderName, together with
+// the message id of each, which is used to recognize the folder under another name
+func (db *DB) FolderUIDs(ctx context.Context, folderName string, limit int) ([]UID, []string, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT uidvalidity, uid, messageid FROM uids
+INNER JOIN messages ON messages.id = uids.message_id
+WHERE foldername = ? ORDER BY uid DESC LIMIT ?`, folderName, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var uids []UID
+	var messageIDs []string
+	for rows.Next() {
+		uid := UID{FolderName: folderName}
+		var messageID string
+		err = rows.Scan(&uid.UIDValidity, &uid.UID, &messageID)
+		if err != nil {
+			return nil, nil, err
+		}
+		uids = append(uids, uid)
+		messageIDs = append(messageIDs, messageID)
+	}
+	return uids, messageIDs, rows.Err()
+}
+
+// RenameFolder moves the local mailbox at oldPath to newPath, updates the notmuch index
+// with the new filenames, and changes the folder name of all UIDs stored for oldName.
+// Only the maildir directories of the mailbox are moved, so that any subfolders
+// are left in place, since the server reports those separately.
+func (db *DB) RenameFolder(ctx context.Context, oldName string, newName string, oldPath string, newPath string) error {
+	if _, err := os.Stat(newPath); err == nil && isMailDir(newPath) {
+		return fmt.Errorf("cannot rename %s to %s: %s already exists", oldName, newName, newPath)
+	}
+
+	err := os.MkdirAll(newPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "cur", "new"} {
+		err = os.Rename(filepath.Join(oldPath, sub), filepath.Join(newPath, sub))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if sub == "tmp" {
+			continue
+		}
+		err = db.reindexDir(ctx, filepath.Join(oldPath, sub), filepath.Join(newPath, sub))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove the old directory, unless there are subfolders left in it
+	os.Remove(oldPath)
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	_, err = db.db.ExecContext(ctx, `UPDATE uids SET foldername = ? WHERE foldername = ?`, newName, oldName)
+	return err
+}
+
+// reindexDir updates the notmuch index after all files in oldDir have been moved to newDir
+func (db *DB) reindexDir(ctx context.Context, oldDir string, newDir string) error {
+	d, err := os.Open(newDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer d.Close()
+
+	for {
+		names, err := d.Readdirnames(scanBatchSize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		err = db.WrapRW(func(nmdb *notmuch.DB) error {
+			for _, name := range names {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				// Adding the new filename first keeps the tags of the message,
+				// since it's never removed completely from the index
+				msg, err := nmdb.AddMessage(filepath.Join(newDir, name))
+				if err != nil && !errors.Is(err, notmuch.ErrDuplicateMessageID) {
+					return err
+				}
+				if msg != nil {
+					msg.Close()
+				}
+
+				err = nmdb.RemoveMessage(filepath.Join(oldDir, name))
+				if err != nil && !errors.Is(err, notmuch.ErrDuplicateMessageID) && !errors.Is(err, notmuch.ErrNotFound) {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package sync
+
+import (
+	"context"
+)
+
+// ResetFolder removes all UIDs stored for folderName.
+// If forgetMessages is set, messages that have no UIDs in other folders are removed as well.
+// The number of removed UIDs and messages is returned.
+func (db *DB) ResetFolder(ctx context.Context, folderName string, forgetMessages bool) (uids int64, messages int64, err error) {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if forgetMessages {
+		_, err = tx.ExecContext(ctx, `DELETE FROM message_tags
+WHERE message_id IN (SELECT message_id FROM uids WHERE foldername = ?)
+AND message_id NOT IN (SELECT message_id FROM uids WHERE foldername != ?)`, folderName, folderName)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		query := `DELETE FROM messages
+WHERE id IN (SELECT message_id FROM uids WHERE foldername = ?)
+AND id NOT IN (SELECT message_id FROM uids WHERE foldername != ?)`
+		res, err := tx.ExecContext(ctx, query, folderName, folderName)
+		if err != nil {
+			return 0, 0, err
+		}
+		messages, err = res.RowsAffected()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM uids WHERE foldername = ?`, folderName)
+	if err != nil {
+		return 0, 0, err
+	}
+	uids, err = res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uids, messages, tx.Commit()
+}
+
+// CountFolder returns the number of UIDs stored for folderName
+func (db *DB) CountFolder(ctx context.Context, folderName string) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM uids WHERE foldername = ?`, folderName).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,105 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// statements contains the queries that are executed once per message.
+// They are prepared once when the database is opened, instead of being
+// parsed again for every message we look at.
+type statements struct {
+	checkTagsUID  *sql.Stmt
+	checkTags     *sql.Stmt
+	selectTags    *sql.Stmt
+	selectMessage *sql.Stmt
+	insertMessage *sql.Stmt
+	deleteTags    *sql.Stmt
+	insertTag     *sql.Stmt
+	insertUID     *sql.Stmt
+	setSummary    *sql.Stmt
+
+	lookupGmailMessage *sql.Stmt
+	lookupEmailID      *sql.Stmt
+	setGmailMessageID  *sql.Stmt
+	setEmailID         *sql.Stmt
+}
+
+const (
+	checkTagsUIDQuery = `SELECT messages.id, messageid FROM uids
+INNER JOIN messages ON messages.id = uids.message_id
+WHERE folderName = ? AND uidvalidity = ? AND uid = ?`
+
+	checkTagsQuery = `SELECT messages.id, foldername, uidvalidity, uid FROM messages
+INNER JOIN uids ON uids.message_id = messages.id
+WHERE messageid = ?`
+
+	selectTagsQuery = `SELECT tag FROM message_tags WHERE message_id = ?`
+
+	selectMessageQuery = `SELECT id FROM messages WHERE messageid = ?`
+
+	// The tags column is no longer used, see the message_tags table
+	insertMessageQuery = `INSERT INTO messages(messageid, tags) VALUES(?, '')
+  ON CONFLICT(messageid) DO NOTHING;`
+
+	deleteTagsQuery = `DELETE FROM message_tags
+WHERE message_id IN (SELECT id FROM messages WHERE messageid = ?)`
+
+	insertTagQuery = `INSERT INTO message_tags(message_id, tag)
+			 SELECT id, ? FROM messages WHERE messageid = ?
+  ON CONFLICT(message_id, tag) DO NOTHING;`
+
+	insertUIDQuery = `INSERT INTO uids(message_id, foldername, uidvalidity, uid)
+			 SELECT id, ?, ?, ? FROM messages WHERE messageid = ?
+  ON CONFLICT(uidvalidity, uid) DO NOTHING;`
+
+	setSummaryQuery = `UPDATE messages SET header_from = ?, header_subject = ?, header_date = ? WHERE messageid = ?`
+
+	lookupGmailMessageQuery = `SELECT messageid FROM messages WHERE gm_msgid = ?`
+	lookupEmailIDQuery      = `SELECT messageid FROM messages WHERE emailid = ?`
+	setGmailMessageIDQuery  = `UPDATE messages SET gm_msgid = ? WHERE messageid = ?`
+	setEmailIDQuery         = `UPDATE messages SET emailid = ? WHERE messageid = ?`
+)
+
+// prepare compiles all statements against db
+func (s *statements) prepare(ctx context.Context, db *sql.DB) error {
+	list := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.checkTagsUID, checkTagsUIDQuery},
+		{&s.checkTags, checkTagsQuery},
+		{&s.selectTags, selectTagsQuery},
+		{&s.selectMessage, selectMessageQuery},
+		{&s.insertMessage, insertMessageQuery},
+		{&s.deleteTags, deleteTagsQuery},
+		{&s.insertTag, insertTagQuery},
+		{&s.insertUID, insertUIDQuery},
+		{&s.setSummary, setSummaryQuery},
+		{&s.lookupGmailMessage, lookupGmailMessageQuery},
+		{&s.lookupEmailID, lookupEmailIDQuery},
+		{&s.setGmailMessageID, setGmailMessageIDQuery},
+		{&s.setEmailID, setEmailIDQuery},
+	}
+
+	for _, l := range list {
+		stmt, err := db.PrepareContext(ctx, l.query)
+		if err != nil {
+			s.close()
+			return fmt.Errorf("cannot prepare query %s: %w", l.query, err)
+		}
+		*l.stmt = stmt
+	}
+	return nil
+}
+
+// close releases all prepared statements
+func (s *statements) close() {
+	for _, stmt := range []*sql.Stmt{s.checkTagsUID, s.checkTags, s.selectTags, s.selectMessage, s.insertMessage, s.deleteTags, s.insertTag, s.insertUID, s.setSummary,
+		s.lookupGmailMessage, s.lookupEmailID, s.setGmailMessageID, s.setEmailID} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
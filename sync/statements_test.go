@@ -0,0 +1,135 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// benchmarkMessages is the number of messages in the database used by the benchmarks
+const benchmarkMessages = 1000
+
+// newBenchmarkDB returns a sync database containing benchmarkMessages messages in INBOX
+func newBenchmarkDB(tb testing.TB) *DB {
+	tb.Helper()
+	ctx := context.Background()
+	dir := tempDir(tb)
+	db, err := New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(db.Close)
+
+	for i := 1; i <= benchmarkMessages; i++ {
+		err = db.AddMessageSyncInfo(ctx, MessageInfo{
+			MessageID: fmt.Sprintf("%d@example.com", i),
+			EmailID:   fmt.Sprintf("E%d", i),
+			UIDs:      []UID{{FolderName: "INBOX", UIDValidity: 1, UID: i}},
+		}, []string{"inbox", "flagged"})
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return db
+}
+
+// checkTagsUnprepared does what CheckTagsUID does, but parses every query again,
+// which is how the queries were executed before they were prepared
+func checkTagsUnprepared(ctx context.Context, db *DB, folderName string, uidValidity int, uid int, wantedTags []string) (info MessageInfo, err error) {
+	var id int64
+	err = db.db.QueryRowContext(ctx, checkTagsUIDQuery, folderName, uidValidity, uid).Scan(&id, &info.MessageID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			info.Created = true
+			return info, nil
+		}
+		return info, err
+	}
+
+	rows, err := db.db.QueryContext(ctx, selectTagsQuery, id)
+	if err != nil {
+		return info, err
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return info, err
+		}
+		tags = append(tags, tag)
+	}
+	db.compareTags(&info, tags, wantedTags)
+	return info, rows.Err()
+}
+
+func BenchmarkCheckTagsUID(b *testing.B) {
+	ctx := context.Background()
+	db := newBenchmarkDB(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := db.CheckTagsUID(ctx, "INBOX", 1, i%benchmarkMessages+1, []string{"inbox"})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCheckTagsUIDUnprepared(b *testing.B) {
+	ctx := context.Background()
+	db := newBenchmarkDB(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := checkTagsUnprepared(ctx, db, "INBOX", 1, i%benchmarkMessages+1, []string{"inbox"})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookupEmailID(b *testing.B) {
+	ctx := context.Background()
+	db := newBenchmarkDB(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := db.LookupEmailID(ctx, fmt.Sprintf("E%d", i%benchmarkMessages+1))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCheckTagsUID(t *testing.T) {
+	ctx := context.Background()
+	db := newBenchmarkDB(t)
+
+	info, err := db.CheckTagsUID(ctx, "INBOX", 1, 7, []string{"inbox", "replied"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Created || info.MessageID != "7@example.com" {
+		t.Errorf("CheckTagsUID() = %s (created %v), want 7@example.com", info.MessageID, info.Created)
+	}
+	if fmt.Sprint(info.AddedTags) != "[replied]" || fmt.Sprint(info.RemovedTags) != "[flagged]" {
+		t.Errorf("CheckTagsUID() added %v and removed %v, want [replied] and [flagged]", info.AddedTags, info.RemovedTags)
+	}
+
+	messageID, err := db.LookupEmailID(ctx, "E7")
+	if err != nil || messageID != "7@example.com" {
+		t.Errorf("LookupEmailID() = %q, %v, want 7@example.com", messageID, err)
+	}
+
+	// Queries are abandoned once the context is cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = db.CheckTagsUID(cancelled, "INBOX", 1, 7, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("CheckTagsUID() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,116 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxSummaryLength is the maximum number of bytes stored for each header
+const maxSummaryLength = 200
+
+// Summary contains the headers used to describe a message to the user
+type Summary struct {
+	From    string
+	Subject string
+	Date    time.Time
+}
+
+// NewSummary creates a summary from raw header values.
+// The values are sanitized and truncated before they're stored.
+func NewSummary(from string, subject string, date string) Summary {
+	s := Summary{
+		From:    sanitizeHeader(from),
+		Subject: sanitizeHeader(subject),
+	}
+
+	if t, err := mail.ParseDate(date); err == nil {
+		s.Date = t
+	}
+	return s
+}
+
+// IsZero returns true if no information is available
+func (s Summary) IsZero() bool {
+	return s.From == "" && s.Subject == "" && s.Date.IsZero()
+}
+
+// String formats the summary like "Re: invoice — billing@example.com — 2024-03-02"
+func (s Summary) String() string {
+	var parts []string
+	if s.Subject != "" {
+		parts = append(parts, s.Subject)
+	}
+	if s.From != "" {
+		parts = append(parts, s.From)
+	}
+	if !s.Date.IsZero() {
+		parts = append(parts, s.Date.Format("2006-01-02"))
+	}
+	return strings.Join(parts, " — ")
+}
+
+// sanitizeHeader removes control characters and redundant whitespace from v,
+// and truncates it to at most maxSummaryLength bytes
+func sanitizeHeader(v string) string {
+	v = strings.Join(strings.Fields(v), " ")
+	v = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, v)
+
+	if len(v) <= maxSummaryLength {
+		return v
+	}
+
+	// Don't cut a multibyte character in half
+	end := maxSummaryLength
+	for end > 0 && !utf8.RuneStart(v[end]) {
+		end--
+	}
+	return v[:end]
+}
+
+// setSummary stores the summary of a message as part of the transaction tx
+func (db *DB) setSummary(ctx context.Context, tx *sql.Tx, messageID string, s Summary) error {
+	var date int64
+	if !s.Date.IsZero() {
+		date = s.Date.Unix()
+	}
+
+	_, err := tx.StmtContext(ctx, db.stmts.setSummary).ExecContext(ctx, s.From, s.Subject, date, messageID)
+	if err != nil {
+		return fmt.Errorf("cannot exec query %s: %w", setSummaryQuery, err)
+	}
+	return nil
+}
+
+// Describe returns a human readable description of a message,
+// based on its stored headers. If no headers are stored, the message id is returned.
+func (db *DB) Describe(ctx context.Context, messageID string) string {
+	var s Summary
+	var date int64
+	err := db.db.QueryRowContext(ctx, `SELECT header_from, header_subject, header_date FROM messages WHERE messageid = ?`, messageID).
+		Scan(&s.From, &s.Subject, &date)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return fmt.Sprintf("%s (%v)", messageID, err)
+		}
+		return messageID
+	}
+
+	if date != 0 {
+		s.Date = time.Unix(date, 0)
+	}
+	if s.IsZero() {
+		return messageID
+	}
+	return s.String()
+}
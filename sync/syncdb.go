@@ -3,49 +3,142 @@ package sync
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	gosync "sync"
+	"syscall"
+	"time"
 
+	"github.com/mattn/go-sqlite3"
 	notmuch "github.com/zenhack/go.notmuch"
 )
 
 // DB is a structure for checking the
 // sync status of messages in a maildir,
+//
+// DB is safe for concurrent use. Both sqlite and notmuch only allow a single writer,
+// so all writes to the sync database are serialized through writeLock, and all
+// access to the notmuch database is serialized through nmLock. The exception is
+// the workers of the local scan, which read through read-only handles of their own
+// at the same time as each other, but never at the same time as a writer, see scanHandle.
+// Reads from the sync database are not serialized.
+// When both locks are needed, nmLock must be taken first.
 type DB struct {
 	dbpath   string
 	db       *sql.DB
 	nmDBPath string
 	nmdb     *notmuch.DB
+
+	stmts statements
+
+	writeLock gosync.Mutex
+	nmLock    gosync.RWMutex
+	// nmWrites counts the calls to WrapRW, so that read-only handles
+	// can be reopened to see the changes. It's protected by nmLock.
+	nmWrites int
+
+	// trashDir is where removed files are moved, if set
+	trashDir string
+
+	// lockTimeout is how long we wait for the write lock on the notmuch database
+	lockTimeout time.Duration
+	// upgraded is set once the notmuch database has been checked for upgrades, see wrap
+	upgraded bool
+
+	// scanWorkers is the number of folders that are scanned at the same time
+	scanWorkers int
 }
 
-// New creates a new sync-db instance, and applies all migrations
-func New(ctx context.Context, dbPath string) (*DB, error) {
-	syncdbPath := filepath.Join(dbPath, ".nmsyncdb")
-	sqliteDatabase, err := sql.Open("sqlite3", syncdbPath) // Open the created SQLite File
+// New creates a new sync-db instance, and applies all migrations.
+// dbPath is the location of the notmuch database, and syncdbPath
+// is the file used to keep track of the synchronization state.
+func New(ctx context.Context, dbPath string, syncdbPath string) (*DB, error) {
+	err := os.MkdirAll(filepath.Dir(syncdbPath), 0700)
 	if err != nil {
 		return nil, err
 	}
 
-	db := &DB{
-		dbpath: dbPath,
-		db:     sqliteDatabase,
+	// sqlite opens read-only databases without complaining, and fails on the first write
+	err = checkWritable(filepath.Dir(syncdbPath))
+	if err != nil {
+		return nil, err
 	}
 
-	err = db.createOrUpgrade()
+	// Wait for other processes instead of failing immediately if the database is busy
+	sqliteDatabase, err := sql.Open("sqlite3", syncdbPath+"?_busy_timeout=5000") // Open the created SQLite File
 	if err != nil {
 		return nil, err
 	}
 
+	db := &DB{
+		dbpath:      dbPath,
+		db:          sqliteDatabase,
+		lockTimeout: DefaultLockTimeout,
+		scanWorkers: DefaultScanWorkers,
+	}
+
 	err = db.migrate(ctx)
 	if err != nil {
 		db.db.Close()
-		return nil, err
+		return nil, corruptError(syncdbPath, err)
+	}
+
+	err = db.stmts.prepare(ctx, db.db)
+	if err != nil {
+		db.db.Close()
+		return nil, corruptError(syncdbPath, err)
 	}
 
 	return db, nil
 }
 
+// DefaultScanWorkers is the number of folders that are scanned at the same time by default
+const DefaultScanWorkers = 4
+
+// SetScanWorkers sets the number of folders that are scanned at the same time
+func (db *DB) SetScanWorkers(workers int) {
+	db.scanWorkers = workers
+}
+
+// ErrCorrupt is returned when the sync database is damaged, or isn't an sqlite database at all
+var ErrCorrupt = errors.New("sync database is corrupt")
+
+// corruptError wraps err with ErrCorrupt if sqlite reports that the database at path is damaged
+func corruptError(path string, err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB) {
+		return fmt.Errorf("%w (%s): %v", ErrCorrupt, path, err)
+	}
+	return err
+}
+
+// checkWritable returns an error if files cannot be created in dir.
+// sqlite needs this both for the database and for its journal.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".nmsyncdb-check")
+	if err != nil {
+		if errors.Is(err, syscall.EROFS) {
+			return fmt.Errorf("cannot use %s for the sync database: the file system is read-only", dir)
+		}
+		return fmt.Errorf("cannot use %s for the sync database: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 // Close closes the underlying database
 func (db *DB) Close() {
+	// Locks are always taken in this order, since WrapRW callers may write to the sync database
+	db.nmLock.Lock()
+	defer db.nmLock.Unlock()
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	db.stmts.close()
+
 	if db.db != nil {
 		db.db.Close()
 	}
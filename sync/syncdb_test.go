@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	gosync "sync"
+	"testing"
+
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// tempDir returns a temporary directory that is removed when the test ends
+func tempDir(t testing.TB) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "nm-imap-sync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestNewCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "sync.db")
+	err := ioutil.WriteFile(path, []byte("this is not an sqlite database, but it's long enough to look like one"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(context.Background(), dir, path)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("New() = %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestNewEmpty(t *testing.T) {
+	dir := tempDir(t)
+	db, err := New(context.Background(), dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	db.Close()
+}
+
+// TestConcurrentUse uses the database from several goroutines at the same time, the way
+// parallel accounts and downloads do. Run it with -race to check that access is serialized.
+func TestConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	db, err := New(ctx, dir, filepath.Join(dir, "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const workers = 8
+	const messages = 25
+
+	errs := make(chan error, workers)
+	var wg gosync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- concurrentWorker(ctx, db, w, messages)
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every other message has had its UID removed again
+	for w := 0; w < workers; w++ {
+		for i := 0; i < messages; i++ {
+			uids, err := db.LookupUIDs(ctx, fmt.Sprintf("%d.%d@example.com", w, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 2
+			if i%2 == 1 {
+				want = 1
+			}
+			if len(uids) != want {
+				t.Errorf("%d.%d@example.com has %d UIDs, want %d", w, i, len(uids), want)
+			}
+		}
+	}
+}
+
+// concurrentWorker adds, looks up and removes messages of its own, mixing reads and writes
+// of both the sync and the notmuch database
+func concurrentWorker(ctx context.Context, db *DB, w int, messages int) error {
+	folder := fmt.Sprintf("Folder%d", w)
+	for i := 0; i < messages; i++ {
+		messageID := fmt.Sprintf("%d.%d@example.com", w, i)
+		uid := UID{FolderName: folder, UIDValidity: w + 1, UID: i + 1}
+		err := db.AddMessageSyncInfo(ctx, MessageInfo{MessageID: messageID, UIDs: []UID{uid}}, []string{"inbox", "unread"})
+		if err != nil {
+			return err
+		}
+
+		copied := UID{FolderName: "All", UIDValidity: 1000 + w, UID: i + 1}
+		err = db.AddUID(ctx, messageID, copied)
+		if err != nil {
+			return err
+		}
+
+		info, err := db.CheckTags(ctx, folder, messageID, []string{"inbox"})
+		if err != nil {
+			return err
+		}
+		if info.Created || !reflect.DeepEqual(info.RemovedTags, []string{"unread"}) {
+			return fmt.Errorf("%s: CheckTags() = %+v, want unread removed", messageID, info)
+		}
+
+		err = db.WrapRW(func(nmDB *notmuch.DB) error { return nil })
+		if err != nil {
+			return err
+		}
+		err = db.Wrap(func(nmDB *notmuch.DB) error { return nil })
+		if err != nil {
+			return err
+		}
+
+		if i%2 == 1 {
+			_, err = db.RemoveUIDs(ctx, []UID{uid})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
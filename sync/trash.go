@@ -0,0 +1,85 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// TrashDateFormat is the format of the dated subdirectories in the local trash directory
+const TrashDateFormat = "2006-01-02"
+
+// SetTrashDir makes files that are removed from the maildir be moved into trashDir,
+// instead of being deleted. If trashDir is empty, files are deleted.
+func (db *DB) SetTrashDir(trashDir string) {
+	db.trashDir = trashDir
+}
+
+// inTrash returns true if path is the local trash directory, or inside it
+func (db *DB) inTrash(path string) bool {
+	if db.trashDir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(db.trashDir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// removeFile removes a file from the maildir, by moving it to the local trash directory
+// if one is configured. The folder structure of the maildir is kept in the trash.
+func (db *DB) removeFile(path string) error {
+	if db.trashDir == "" {
+		return os.Remove(path)
+	}
+
+	rel, err := filepath.Rel(db.dbpath, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(path)
+	}
+
+	dest := filepath.Join(db.trashDir, time.Now().Format(TrashDateFormat), rel)
+	err = os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path, dest)
+	if err != nil && errors.Is(err, syscall.EXDEV) {
+		// The trash is on another filesystem
+		err = moveFile(path, dest)
+	}
+	return err
+}
+
+// moveFile copies src to dest, and removes src once the copy is complete
+func moveFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("cannot move %s to %s: %w", src, dest, err)
+	}
+
+	in.Close()
+	return os.Remove(src)
+}
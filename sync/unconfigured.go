@@ -0,0 +1,188 @@
+package sync
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+)
+
+// UnconfiguredFolder is a folder that is no longer synchronized according to the
+// configuration, but still has a local directory or state in the sync database
+type UnconfiguredFolder struct {
+	Name string // Name of the folder on the server
+	Path string // Local path, relative to the account maildir, or empty if there is no local directory
+	UIDs int    // Number of UIDs stored for the folder
+}
+
+// UnconfiguredFolders returns the folders of the account stored in maildirPath that are
+// not included by the configuration of mailbox, but have a local directory or known UIDs.
+func (db *DB) UnconfiguredFolders(ctx context.Context, mailbox config.Mailbox, maildirPath string) ([]UnconfiguredFolder, error) {
+	found := make(map[string]*UnconfiguredFolder)
+
+	// Folders that we have chosen a local path for
+	rows, err := db.db.QueryContext(ctx, `SELECT name, path FROM folders WHERE account = ?`, db.accountKey(maildirPath))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, path string
+		err = rows.Scan(&name, &path)
+		if err != nil {
+			return nil, err
+		}
+		if mailbox.IncludesFolder(name) {
+			continue
+		}
+		folder := &UnconfiguredFolder{Name: name}
+		if isMailDir(filepath.Join(maildirPath, filepath.FromSlash(path))) {
+			folder.Path = filepath.FromSlash(path)
+		}
+		found[name] = folder
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Local directories, which may have been created by earlier versions
+	err = db.findUnconfigured(ctx, mailbox, maildirPath, "", found)
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make([]UnconfiguredFolder, 0, len(found))
+	for _, folder := range found {
+		folder.UIDs, err = db.CountFolder(ctx, folder.Name)
+		if err != nil {
+			return nil, err
+		}
+		// Only the local path is known, which doesn't matter
+		if folder.UIDs == 0 && folder.Path == "" {
+			continue
+		}
+		folders = append(folders, *folder)
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+	return folders, nil
+}
+
+// findUnconfigured adds all mailboxes below the directory 'relPath' in maildirPath
+// that are not included by the configuration to 'found'
+func (db *DB) findUnconfigured(ctx context.Context, mailbox config.Mailbox, maildirPath string, relPath string, found map[string]*UnconfiguredFolder) error {
+	md, err := os.Open(filepath.Join(maildirPath, relPath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer md.Close()
+
+	for {
+		entries, err := md.Readdir(10)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		for _, e := range entries {
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			if relPath != "" && (e.Name() == "cur" || e.Name() == "new" || e.Name() == "tmp") {
+				continue
+			}
+
+			folderPath := filepath.Join(relPath, e.Name())
+			mailboxPath := filepath.Join(maildirPath, folderPath)
+			if db.inTrash(mailboxPath) {
+				continue
+			}
+
+			name, err := db.FolderName(ctx, maildirPath, folderPath)
+			if err != nil {
+				return err
+			}
+			if !mailbox.IncludesFolder(name) && isMailDir(mailboxPath) {
+				if folder, ok := found[name]; ok {
+					folder.Path = folderPath
+				} else {
+					found[name] = &UnconfiguredFolder{Name: name, Path: folderPath}
+				}
+			}
+
+			err = db.findUnconfigured(ctx, mailbox, maildirPath, folderPath, found)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeFolder removes all state of the server folder 'name' from the sync database,
+// including messages that aren't known to be in any other folder.
+// The local directory of the folder is left alone, see RemoveFolder.
+func (db *DB) PurgeFolder(ctx context.Context, maildirPath string, name string) (uids int64, messages int64, err error) {
+	uids, messages, err = db.ResetFolder(ctx, name, true)
+	if err != nil {
+		return uids, messages, err
+	}
+	return uids, messages, db.ForgetFolderPath(ctx, maildirPath, name)
+}
+
+// RemoveFolder removes the messages in the local folder at 'path', relative to maildirPath.
+// Messages are moved to the local trash directory if one is configured.
+// The directory itself is removed if nothing else is left in it, such as nested folders.
+func (db *DB) RemoveFolder(maildirPath string, path string) error {
+	mailboxPath := filepath.Join(maildirPath, path)
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		dir := filepath.Join(mailboxPath, sub)
+		names, err := readDirNames(dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = db.removeFile(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+		}
+		err = os.Remove(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Nested folders are kept
+	err := os.Remove(mailboxPath)
+	if err != nil && !os.IsNotExist(err) {
+		if names, _ := readDirNames(mailboxPath); len(names) > 0 {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// readDirNames returns the names of the entries in dir, or nothing if it doesn't exist
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
@@ -5,4 +5,10 @@ package sync
 type Update struct {
 	MessageInfo
 	Filename string
+
+	// DraftID identifies a draft in the drafts folder across revisions
+	DraftID string
+	// Replaces lists the UIDs of the previous revision of a draft,
+	// which should be removed from the server once this message has been created
+	Replaces []UID
 }
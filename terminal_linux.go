@@ -0,0 +1,71 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func getTermios(f *os.File, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setTermios(f *os.File, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal returns true if f is a terminal
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	return getTermios(f, &t) == nil
+}
+
+// readPassword reads a line from the terminal f without echoing it.
+// The terminal is restored if ctx is cancelled while we're waiting for input.
+func readPassword(ctx context.Context, f *os.File) (string, error) {
+	var saved syscall.Termios
+	err := getTermios(f, &saved)
+	if err != nil {
+		return "", err
+	}
+
+	t := saved
+	t.Lflag &^= syscall.ECHO
+	t.Lflag |= syscall.ICANON | syscall.ISIG
+	t.Iflag |= syscall.ICRNL
+	err = setTermios(f, &t)
+	if err != nil {
+		return "", err
+	}
+	defer setTermios(f, &saved)
+
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := bufio.NewReader(f).ReadString('\n')
+		done <- result{line, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.line, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
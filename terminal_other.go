@@ -0,0 +1,24 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// isTerminal always returns false, since reading a password without echo is only supported on Linux
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+func readPassword(ctx context.Context, f *os.File) (string, error) {
+	return "", fmt.Errorf("not supported on %s", runtime.GOOS)
+}
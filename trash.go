@@ -0,0 +1,105 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// parseAge parses a duration, which in addition to the units supported
+// by time.ParseDuration may be specified in days, e.g. "30d"
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// emptyLocalTrashCmd removes files from the local trash directory that were trashed
+// longer ago than the specified age
+func emptyLocalTrashCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("empty-local-trash", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	olderThan := fs.String("older-than", "30d", "Only remove files that were trashed longer ago than this, e.g. 30d or 12h")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be removed")
+	fs.Parse(args)
+
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		fmt.Printf("Invalid --older-than: %s\n", err)
+		return exitConfigError
+	}
+
+	env, err := loadEnvironment(*configFile)
+	if err != nil {
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		return exitConfigError
+	}
+
+	trashDir := env.trashDir()
+	if trashDir == "" {
+		fmt.Println("local_trash_dir is not configured")
+		return exitConfigError
+	}
+
+	entries, err := ioutil.ReadDir(trashDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return exitOK
+		}
+		fmt.Printf("Cannot read local trash: %s\n", err)
+		return exitConfigError
+	}
+
+	// Files are trashed into a directory per day, so a directory
+	// is only old enough once the whole day is
+	cutoff := time.Now().Add(-age)
+	removed := 0
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+
+		day, err := time.ParseInLocation(sync.TrashDateFormat, e.Name(), time.Local)
+		if !e.IsDir() || err != nil {
+			continue
+		}
+		if !day.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(trashDir, e.Name())
+		if *dryRun {
+			fmt.Printf("would remove %s\n", path)
+			continue
+		}
+
+		fmt.Printf("removing %s\n", path)
+		err = os.RemoveAll(path)
+		if err != nil {
+			fmt.Printf("Cannot remove %s: %s\n", path, err)
+			return exitPartial
+		}
+		removed++
+	}
+
+	if !*dryRun {
+		fmt.Printf("removed %d days of trashed mail\n", removed)
+	}
+	return exitOK
+}
@@ -0,0 +1,67 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+	"github.com/yzzyx/nm-imap-sync/sync"
+)
+
+// checkUnconfigured warns about folders of the account 'name' that are no longer synchronized,
+// but still have local state. If purge is set, their state is removed from the sync database,
+// and their local directories are removed if the user confirms it.
+func checkUnconfigured(ctx context.Context, syncdb *sync.DB, name string, mailbox config.Mailbox, folderPath string, purge bool) error {
+	folders, err := syncdb.UnconfiguredFolders(ctx, mailbox, folderPath)
+	if err != nil {
+		return fmt.Errorf("cannot check for unconfigured folders: %w", err)
+	}
+	if len(folders) == 0 {
+		return nil
+	}
+
+	for _, folder := range folders {
+		where := "has no local directory"
+		if folder.Path != "" {
+			where = "is stored in " + filepath.Join(folderPath, folder.Path)
+		}
+		fmt.Printf("%s: %s is no longer synchronized, but %d UIDs are known and it %s\n", name, folder.Name, folder.UIDs, where)
+	}
+	if !purge {
+		fmt.Printf("%s: run with --purge-unconfigured to remove the state of these folders\n", name)
+		return nil
+	}
+
+	if !confirm(fmt.Sprintf("Remove the synchronization state of %d folders in %s?", len(folders), name)) {
+		return nil
+	}
+	for _, folder := range folders {
+		uids, messages, err := syncdb.PurgeFolder(ctx, folderPath, folder.Name)
+		if err != nil {
+			return fmt.Errorf("cannot purge %s: %w", folder.Name, err)
+		}
+		fmt.Printf("%s: removed %d UIDs and %d messages of %s from the sync database\n", name, uids, messages, folder.Name)
+	}
+
+	var local []sync.UnconfiguredFolder
+	for _, folder := range folders {
+		if folder.Path != "" {
+			local = append(local, folder)
+		}
+	}
+	if len(local) == 0 || !confirm(fmt.Sprintf("Also remove the messages in the local directories of %d folders?", len(local))) {
+		return nil
+	}
+	for _, folder := range local {
+		err = syncdb.RemoveFolder(folderPath, folder.Path)
+		if err != nil {
+			return fmt.Errorf("cannot remove %s: %w", folder.Path, err)
+		}
+		fmt.Printf("%s: removed %s\n", name, filepath.Join(folderPath, folder.Path))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// watchEvent signals that something changed locally in an account. Folder is the local path
+// of the folder, relative to the account maildir. If it's empty, the folder isn't known,
+// and the whole account has to be checked.
+type watchEvent struct {
+	Account string
+	Folder  string
+}
+
+// watchCmd synchronizes all accounts periodically, and pushes local changes
+// as soon as they're made, if the maildir can be watched for changes
+func watchCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	interval := fs.Duration("interval", 15*time.Minute, "How often all accounts are synchronized")
+	debounce := fs.Duration("debounce", 2*time.Second, "How long to wait for more local changes before pushing them")
+	fs.Parse(args)
+
+	env, err := loadEnvironment(*configFile)
+	if err != nil {
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		return exitConfigError
+	}
+
+	err = env.askPasswords(ctx, env.accountNames())
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return exitConfigError
+	}
+
+	dbs := newSyncDBs(env)
+	defer dbs.close()
+
+	watcher, err := newFolderWatcher()
+	if err != nil {
+		log.Printf("cannot watch the maildir, local changes are pushed every %s: %v\n", *interval, err)
+	}
+	defer watcher.close()
+
+	dog := startWatchdog(ctx)
+	opts := runOptions{heartbeat: dog.heartbeat}
+
+	// run synchronizes the accounts in 'pending', or all accounts if it's nil
+	run := func(pending map[string]map[string]bool) {
+		var results []accountResult
+		for _, name := range env.accountNames() {
+			accountOpts := opts
+			if pending != nil {
+				folders, ok := pending[name]
+				if !ok {
+					continue
+				}
+				accountOpts.pushOnly = true
+				if !folders[""] {
+					accountOpts.folders = make([]string, 0, len(folders))
+					for folder := range folders {
+						accountOpts.folders = append(accountOpts.folders, folder)
+					}
+					sort.Strings(accountOpts.folders)
+				}
+			}
+
+			_ = sdNotify("STATUS=synchronizing " + name)
+			mailbox, folderPath, _ := env.mailbox(name)
+			syncdb, err := dbs.get(ctx, name)
+			if err != nil {
+				results = append(results, accountResult{Name: name, Err: err})
+				continue
+			}
+			results = append(results, syncAccount(ctx, syncdb, name, mailbox, folderPath, accountOpts))
+
+			// New folders may have been created
+			if pending == nil {
+				if err := watcher.addAccount(name, mailbox, folderPath); err != nil {
+					log.Printf("%s: cannot watch for local changes: %v\n", name, err)
+				}
+			}
+		}
+		notifyNewMail(ctx, results)
+		summarize(ctx, results, 0)
+		_ = sdNotify("STATUS=waiting for changes")
+	}
+
+	run(nil)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	// While we're waiting for changes, we're healthy as long as the loop keeps running.
+	// During synchronization, dog pings the watchdog as long as progress is made.
+	var ping <-chan time.Time
+	if wd := watchdogInterval(); wd > 0 {
+		pinger := time.NewTicker(wd)
+		defer pinger.Stop()
+		ping = pinger.C
+	}
+
+	// The initial synchronization is done, and we're watching for changes
+	_ = sdNotify("READY=1")
+
+	pending := make(map[string]map[string]bool)
+	var flush <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			_ = sdNotify("STOPPING=1")
+			return exitInterrupted
+		case <-ping:
+			_ = sdNotify("WATCHDOG=1")
+		case ev, ok := <-watcher.events():
+			if !ok {
+				log.Printf("stopped watching the maildir, local changes are pushed every %s\n", *interval)
+				watcher = nil
+				continue
+			}
+			if pending[ev.Account] == nil {
+				pending[ev.Account] = make(map[string]bool)
+			}
+			pending[ev.Account][ev.Folder] = true
+			flush = time.After(*debounce)
+		case <-flush:
+			run(pending)
+			pending = make(map[string]map[string]bool)
+			flush = nil
+			watcher.drain()
+		case <-ticker.C:
+			run(nil)
+			pending = make(map[string]map[string]bool)
+			flush = nil
+			watcher.drain()
+		}
+	}
+}
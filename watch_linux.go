@@ -0,0 +1,238 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+)
+
+const (
+	// Files being added, removed or renamed (i.e. when maildir flags change) in cur/ and new/
+	maildirMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE
+	// notmuch writes to its database when tags are changed
+	xapianMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE
+	// New folders
+	treeMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+)
+
+// watchTarget describes what a watch descriptor is watching
+type watchTarget struct {
+	account string
+	folder  string
+	tree    bool // A directory that may get new folders
+}
+
+type watchedAccount struct {
+	mailbox    config.Mailbox
+	folderPath string
+}
+
+// folderWatcher watches the maildirs of accounts for changes using inotify
+type folderWatcher struct {
+	file *os.File
+	fd   int
+
+	mu       gosync.Mutex
+	accounts map[string]watchedAccount
+	targets  map[int32][]watchTarget
+
+	ch chan watchEvent
+}
+
+func newFolderWatcher() (*folderWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &folderWatcher{
+		// A non-blocking file is handled by the runtime poller, so that Close interrupts Read
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		fd:       fd,
+		accounts: make(map[string]watchedAccount),
+		targets:  make(map[int32][]watchTarget),
+		ch:       make(chan watchEvent, 100),
+	}
+	go w.run()
+	return w, nil
+}
+
+// events returns the channel that changes are delivered on
+func (w *folderWatcher) events() <-chan watchEvent {
+	if w == nil {
+		return nil
+	}
+	return w.ch
+}
+
+// drain discards all changes that have been delivered so far,
+// i.e. the ones caused by our own synchronization
+func (w *folderWatcher) drain() {
+	if w == nil {
+		return
+	}
+	for {
+		select {
+		case _, ok := <-w.ch:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (w *folderWatcher) close() {
+	if w != nil {
+		w.file.Close()
+	}
+}
+
+// watch adds a watch on path, which is described by t
+func (w *folderWatcher) watch(path string, mask uint32, t watchTarget) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, path, mask)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, existing := range w.targets[int32(wd)] {
+		if existing == t {
+			return nil
+		}
+	}
+	w.targets[int32(wd)] = append(w.targets[int32(wd)], t)
+	return nil
+}
+
+// addAccount watches all folders of an account.
+// It can be called again to start watching folders created since.
+func (w *folderWatcher) addAccount(name string, mailbox config.Mailbox, folderPath string) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	w.accounts[name] = watchedAccount{mailbox: mailbox, folderPath: folderPath}
+	w.mu.Unlock()
+
+	err := w.watch(filepath.Join(mailbox.DBPath, ".notmuch", "xapian"), xapianMask, watchTarget{account: name})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Folders may be removed while we're walking
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != folderPath && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		switch info.Name() {
+		case "cur", "new":
+			// Excluded folders are skipped when they're checked
+			rel, err := filepath.Rel(folderPath, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			err = w.watch(path, maildirMask, watchTarget{account: name, folder: rel})
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return filepath.SkipDir
+		case "tmp":
+			return filepath.SkipDir
+		}
+
+		err = w.watch(path, treeMask, watchTarget{account: name, tree: true})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+// run reads events from inotify until the watcher is closed
+func (w *folderWatcher) run() {
+	defer close(w.ch)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(ev.Len)
+			w.handle(ev.Wd, ev.Mask)
+		}
+	}
+}
+
+// handle turns an inotify event into watchEvents
+func (w *folderWatcher) handle(wd int32, mask uint32) {
+	// Events were lost, so we have to check everything
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.mu.Lock()
+		names := make([]string, 0, len(w.accounts))
+		for name := range w.accounts {
+			names = append(names, name)
+		}
+		w.mu.Unlock()
+		for _, name := range names {
+			w.ch <- watchEvent{Account: name}
+		}
+		return
+	}
+
+	w.mu.Lock()
+	targets := w.targets[wd]
+	// The watched directory has been removed
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.targets, wd)
+		targets = nil
+	}
+	w.mu.Unlock()
+
+	for _, t := range targets {
+		if t.tree {
+			if mask&syscall.IN_ISDIR == 0 {
+				continue
+			}
+			w.mu.Lock()
+			account := w.accounts[t.account]
+			w.mu.Unlock()
+			err := w.addAccount(t.account, account.mailbox, account.folderPath)
+			if err != nil {
+				log.Printf("%s: cannot watch new folder: %v\n", t.account, err)
+			}
+		}
+		w.ch <- watchEvent{Account: t.account, Folder: t.folder}
+	}
+}
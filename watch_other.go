@@ -0,0 +1,34 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/yzzyx/nm-imap-sync/config"
+)
+
+// folderWatcher is only supported on Linux, elsewhere local changes are found by the periodic sync
+type folderWatcher struct{}
+
+func newFolderWatcher() (*folderWatcher, error) {
+	return nil, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
+
+func (w *folderWatcher) events() <-chan watchEvent {
+	return nil
+}
+
+func (w *folderWatcher) drain() {}
+
+func (w *folderWatcher) close() {}
+
+func (w *folderWatcher) addAccount(name string, mailbox config.Mailbox, folderPath string) error {
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright © 2020 Elias Norberg
+// Licensed under the GPLv3 or later.
+// See COPYING at the root of the repository for details.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/yzzyx/nm-imap-sync/sync"
+	notmuch "github.com/zenhack/go.notmuch"
+)
+
+// whereCmd prints the folders and UIDs a message is stored with on the server,
+// both according to the sync database and to its notmuch properties
+func whereCmd(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("where", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigPath(), "Use specific configuration file or directory")
+	account := fs.String("account", "", "Only look in this account")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("usage: nm-imap-sync where [--config file] [--account name] <message-id>")
+		return exitConfigError
+	}
+	messageID := strings.TrimSuffix(strings.TrimPrefix(fs.Arg(0), "<"), ">")
+
+	env, err := loadEnvironment(*configFile)
+	if err != nil {
+		fmt.Printf("Cannot load configuration: %s\n", err)
+		return exitConfigError
+	}
+
+	names := env.accountNames()
+	if *account != "" {
+		if _, _, err := env.mailbox(*account); err != nil {
+			fmt.Printf("%s\n", err)
+			return exitConfigError
+		}
+		names = []string{*account}
+	}
+
+	dbs := newSyncDBs(env)
+	defer dbs.close()
+
+	// Accounts may share a sync database, which only has to be checked once
+	checked := make(map[*sync.DB]bool)
+	found := false
+	for _, name := range names {
+		syncdb, err := dbs.get(ctx, name)
+		if err != nil {
+			fmt.Printf("%s: %s\n", name, err)
+			return exitConfigError
+		}
+		if checked[syncdb] {
+			continue
+		}
+		checked[syncdb] = true
+
+		uids, err := syncdb.LookupUIDs(ctx, messageID)
+		if err != nil {
+			fmt.Printf("%s: cannot read sync database: %s\n", name, err)
+			return exitConfigError
+		}
+		properties, err := syncdb.LocationProperties(messageID)
+		if err != nil && !errors.Is(err, notmuch.ErrNotFound) {
+			fmt.Printf("%s: cannot read notmuch properties: %s\n", name, err)
+			return exitConfigError
+		}
+		if len(uids) == 0 && len(properties) == 0 {
+			continue
+		}
+		found = true
+
+		fmt.Printf("%s:\n", name)
+		printLocations("sync database", uids)
+		printLocations("notmuch properties", properties)
+	}
+
+	if !found {
+		fmt.Printf("%s is not known to be on any server\n", messageID)
+		return exitConfigError
+	}
+	return exitOK
+}
+
+// printLocations prints the folders and UIDs in uids under the heading 'source'
+func printLocations(source string, uids []sync.UID) {
+	if len(uids) == 0 {
+		fmt.Printf("  %s: none\n", source)
+		return
+	}
+	fmt.Printf("  %s:\n", source)
+	for _, uid := range uids {
+		fmt.Printf("    %s  uidvalidity %d  uid %d\n", uid.FolderName, uid.UIDValidity, uid.UID)
+	}
+}